@@ -0,0 +1,79 @@
+package commands
+
+import (
+	"fmt"
+	"net/rpc"
+	"time"
+
+	"github.com/mcuadros/passage/server"
+
+	"github.com/spf13/cobra"
+)
+
+type AddCommand struct {
+	RPCAddr string
+	Server  string
+	Local   string
+	TTL     time.Duration
+	Persist bool
+}
+
+func NewAddCommand() *AddCommand {
+	return &AddCommand{}
+}
+
+func (c *AddCommand) Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add [passage-name] [remote]",
+		Short: "adds a passage to the running server, returning its local address",
+		Long: "adds a passage to the running server, returning its local address. The remote is a port, " +
+			"as 8080 or :8080, an address, as 10.0.0.1:8080, or a container, as container=foo:8080, " +
+			"optionally followed by /tcp or /udp. Except for DNS servers, an /udp remote requires " +
+			"passage udp-relay running at the SSH server, and the address of the relay as remote.",
+		RunE: c.Execute,
+	}
+
+	cmd.Flags().StringVar(&c.RPCAddr, "rpc-addr", rpcAddrDefault, "passage rpc server address, is an unix socket.")
+	cmd.Flags().StringVar(&c.Server, "server", "", "server of the passage, may be omitted if there is only one.")
+	cmd.Flags().StringVar(&c.Local, "local", "", "local address of the passage (default is a random port).")
+	cmd.Flags().DurationVar(&c.TTL, "ttl", 0, "time after which the passage is removed.")
+	cmd.Flags().BoolVar(&c.Persist, "persist", false, "saves the passage in the passages file, loaded with the config.")
+	return cmd
+}
+
+func (c *AddCommand) Execute(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("invalid args: %q", args)
+	}
+
+	if _, err := server.ParseRemote(args[1]); err != nil {
+		return err
+	}
+
+	rpcClient, err := rpc.Dial("unix", c.RPCAddr)
+	if err != nil {
+		return err
+	}
+
+	var reply server.PassageInfo
+	err = rpcClient.Call("Server.Add", server.AddPassageArgs{
+		Name:    args[0],
+		Server:  c.Server,
+		Remote:  args[1],
+		Local:   c.Local,
+		TTL:     c.TTL,
+		Persist: c.Persist,
+	}, &reply)
+
+	if err != nil {
+		return err
+	}
+
+	addr, err := localAddr(reply.Local)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(addr)
+	return nil
+}
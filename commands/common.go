@@ -2,14 +2,41 @@ package commands
 
 import (
 	"fmt"
+	"io"
 	"net"
+	"path/filepath"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/mcuadros/passage/core"
+	"github.com/mcuadros/passage/server"
 )
 
 const rpcAddrDefault = "/tmp/passage.sock"
 
+// localAddr returns an address to connect to the listener address, unix
+// socket paths are returned as they are
+func localAddr(addr string) (string, error) {
+	if filepath.IsAbs(addr) {
+		return addr, nil
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+
+	if net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+func newTabWriter(out io.Writer) *tabwriter.Writer {
+	return tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+}
+
 type ServerAddr struct {
 	Addr
 }
@@ -34,7 +61,7 @@ func (a *Addr) Set(value string) error {
 		return err
 	}
 
-	a.Addr = core.Addr{addr}
+	a.Addr = core.Addr{Addr: addr}
 	return nil
 }
 
@@ -53,39 +80,18 @@ type Remote struct {
 func (r *Remote) Type() string { return "remote" }
 
 func (r *Remote) Set(value string) error {
-	slash := strings.Split(value, "/")
-
-	network := "tcp"
-	if len(slash) == 2 {
-		network = slash[1]
-	}
-
-	if slash[0][0] == ':' {
-		slash[0] = slash[0][1:]
-	}
-
-	if strings.Count(slash[0], ":") == 0 {
-		r.Remote = core.NewRemote(network, fmt.Sprintf("127.0.0.1:%s", slash[0]))
-		return nil
-	}
-
-	equal := strings.Split(slash[0], "=")
-	if len(equal) == 1 {
-		r.Remote = core.NewRemote(network, slash[0])
-		return nil
+	config, err := server.ParseRemote(value)
+	if err != nil {
+		return err
 	}
 
-	dots := strings.Split(equal[1], ":")
-
-	switch equal[0] {
+	switch config.Type {
 	case "container":
-		r.Remote = core.NewContainerRemote(network, dots[0], dots[1])
-		return nil
-	}
-
-	if r.Remote == nil {
-		return fmt.Errorf("invalid remote format: %s", value)
-
+		r.Remote = core.NewContainerRemote("tcp", config.Container, config.Port)
+	case "udp":
+		r.Remote = core.NewRemote("udp", config.Address)
+	default:
+		r.Remote = core.NewRemote("tcp", config.Address)
 	}
 
 	return nil
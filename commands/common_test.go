@@ -36,3 +36,31 @@ func (s *CommonSuite) TestNewRemoteContainer(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(r.Remote.String(), Equals, "<container=foo>::42/tcp")
 }
+
+func (s *CommonSuite) TestLocalAddr(c *C) {
+	addr, err := localAddr("[::]:8400")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "127.0.0.1:8400")
+
+	addr, err = localAddr("10.0.0.1:8400")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "10.0.0.1:8400")
+
+	addr, err = localAddr("/tmp/docker.sock")
+	c.Assert(err, IsNil)
+	c.Assert(addr, Equals, "/tmp/docker.sock")
+}
+
+func (s *CommonSuite) TestNewRemoteUDP(c *C) {
+	r := &Remote{}
+	err := r.Set("10.0.0.1:53/udp")
+	c.Assert(err, IsNil)
+	c.Assert(r.Remote.String(), Equals, "10.0.0.1:53/udp")
+}
+
+func (s *CommonSuite) TestNewRemoteInvalid(c *C) {
+	r := &Remote{}
+	c.Assert(r.Set(""), ErrorMatches, "invalid remote format: ")
+	c.Assert(r.Set("container=foo"), ErrorMatches, "invalid remote format: container=foo")
+	c.Assert(r.Set("42/unix"), ErrorMatches, `invalid remote network "unix"`)
+}
@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"fmt"
+	"net/rpc"
+	"os"
+
+	"github.com/mcuadros/passage/server"
+
+	"github.com/spf13/cobra"
+)
+
+// ConnectCommand connects, disconnects or reconnects SSH servers, depending on
+// the rpc method
+type ConnectCommand struct {
+	RPCAddr string
+	All     bool
+
+	use, short, method string
+}
+
+func NewConnectCommand() *ConnectCommand {
+	return &ConnectCommand{
+		use:    "connect [server-name...]",
+		short:  "connects to the SSH servers ahead of its use",
+		method: "Server.Connect",
+	}
+}
+
+func NewDisconnectCommand() *ConnectCommand {
+	return &ConnectCommand{
+		use:    "disconnect [server-name...]",
+		short:  "closes the connections to the SSH servers, cutting its tunnels",
+		method: "Server.Disconnect",
+	}
+}
+
+func NewReconnectCommand() *ConnectCommand {
+	return &ConnectCommand{
+		use:    "reconnect [server-name...]",
+		short:  "closes the connections to the SSH servers and connects again",
+		method: "Server.Reconnect",
+	}
+}
+
+func (c *ConnectCommand) Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   c.use,
+		Short: c.short,
+		RunE:  c.Execute,
+	}
+
+	cmd.Flags().StringVar(&c.RPCAddr, "rpc-addr", rpcAddrDefault, "passage rpc server address, is an unix socket.")
+	cmd.Flags().BoolVar(&c.All, "all", false, "acts on all the SSH servers.")
+	return cmd
+}
+
+func (c *ConnectCommand) Execute(cmd *cobra.Command, args []string) error {
+	if (len(args) == 0) != c.All {
+		return fmt.Errorf("invalid args: %q, server names or --all required", args)
+	}
+
+	rpcClient, err := rpc.Dial("unix", c.RPCAddr)
+	if err != nil {
+		return err
+	}
+
+	var reply []server.ServerInfo
+	if err := rpcClient.Call(c.method, server.ServerArgs{Names: args}, &reply); err != nil {
+		return err
+	}
+
+	printServers(os.Stdout, reply)
+	return nil
+}
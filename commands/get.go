@@ -2,7 +2,6 @@ package commands
 
 import (
 	"fmt"
-	"net"
 	"net/rpc"
 
 	"github.com/spf13/cobra"
@@ -43,15 +42,11 @@ func (l *GetCommand) Execute(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	host, port, err := net.SplitHostPort(reply)
+	addr, err := localAddr(reply)
 	if err != nil {
 		return err
 	}
 
-	if net.ParseIP(host).IsUnspecified() {
-		host = "127.0.0.1"
-	}
-
-	fmt.Printf("%s:%s", host, port)
+	fmt.Print(addr)
 	return nil
 }
@@ -0,0 +1,77 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"time"
+
+	"github.com/mcuadros/passage/server"
+
+	"github.com/spf13/cobra"
+)
+
+type ListCommand struct {
+	RPCAddr string
+	Server  string
+}
+
+func NewListCommand() *ListCommand {
+	return &ListCommand{}
+}
+
+func (c *ListCommand) Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ls",
+		Short: "lists the passages with its server, remote and state",
+		RunE:  c.Execute,
+	}
+
+	cmd.Flags().StringVar(&c.RPCAddr, "rpc-addr", rpcAddrDefault, "passage rpc server address, is an unix socket.")
+	cmd.Flags().StringVar(&c.Server, "server", "", "lists only the passages of the given server.")
+	return cmd
+}
+
+func (c *ListCommand) Execute(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("invalid args: %q", args)
+	}
+
+	rpcClient, err := rpc.Dial("unix", c.RPCAddr)
+	if err != nil {
+		return err
+	}
+
+	var reply []server.PassageInfo
+	if err := rpcClient.Call("Server.List", c.Server, &reply); err != nil {
+		return err
+	}
+
+	printPassages(os.Stdout, reply)
+	return nil
+}
+
+func printPassages(out io.Writer, passages []server.PassageInfo) {
+	w := newTabWriter(out)
+	fmt.Fprintln(w, "NAME\tSERVER\tTYPE\tLOCAL\tREMOTE\tSTATE\tORIGIN")
+	for _, p := range passages {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.Name, p.Server, p.Type, p.Local, p.Remote, p.State, origin(p))
+	}
+
+	w.Flush()
+}
+
+// origin returns where the passage comes from, the config file or added at
+// runtime, with the time left if it expires
+func origin(p server.PassageInfo) string {
+	if !p.Ephemeral {
+		return "config"
+	}
+
+	if p.Expires.IsZero() {
+		return "runtime"
+	}
+
+	return fmt.Sprintf("runtime, %s left", time.Until(p.Expires).Round(time.Second))
+}
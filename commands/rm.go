@@ -0,0 +1,45 @@
+package commands
+
+import (
+	"fmt"
+	"net/rpc"
+
+	"github.com/mcuadros/passage/server"
+
+	"github.com/spf13/cobra"
+)
+
+type RemoveCommand struct {
+	RPCAddr string
+	Persist bool
+}
+
+func NewRemoveCommand() *RemoveCommand {
+	return &RemoveCommand{}
+}
+
+func (c *RemoveCommand) Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rm [passage-name]",
+		Short: "removes a passage added at runtime from the running server",
+		RunE:  c.Execute,
+	}
+
+	cmd.Flags().StringVar(&c.RPCAddr, "rpc-addr", rpcAddrDefault, "passage rpc server address, is an unix socket.")
+	cmd.Flags().BoolVar(&c.Persist, "persist", false, "removes the passage from the passages file too, required for the persisted ones.")
+	return cmd
+}
+
+func (c *RemoveCommand) Execute(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("invalid args: %q", args)
+	}
+
+	rpcClient, err := rpc.Dial("unix", c.RPCAddr)
+	if err != nil {
+		return err
+	}
+
+	var reply bool
+	return rpcClient.Call("Server.Remove", server.RemovePassageArgs{Name: args[0], Persist: c.Persist}, &reply)
+}
@@ -14,6 +14,15 @@ var RootCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(NewServerCommand().Command())
 	RootCmd.AddCommand(NewGetCommand().Command())
+	RootCmd.AddCommand(NewAddCommand().Command())
+	RootCmd.AddCommand(NewRemoveCommand().Command())
+	RootCmd.AddCommand(NewListCommand().Command())
+	RootCmd.AddCommand(NewStatusCommand().Command())
+	RootCmd.AddCommand(NewConnectCommand().Command())
+	RootCmd.AddCommand(NewDisconnectCommand().Command())
+	RootCmd.AddCommand(NewReconnectCommand().Command())
+	RootCmd.AddCommand(NewStatsCommand().Command())
+	RootCmd.AddCommand(NewUDPRelayCommand().Command())
 }
 
 func Execute() {
@@ -5,23 +5,28 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"github.com/mcuadros/passage/server"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"github.com/fsnotify/fsnotify"
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
 type ServerCommand struct {
-	LogLevel   string
-	LogFile    string
-	ConfigFile string
-	Config     *server.Config
-	Server     *server.Server
-	RPCAddr    string
-	RPCServer  *server.RPCServer
+	LogLevel     string
+	LogFile      string
+	ConfigFile   string
+	PassagesFile string
+	Config       *server.Config
+	Server       *server.Server
+	RPCAddr      string
+	RPCServer    *server.RPCServer
+
+	MetricsAddr   string
+	MetricsServer *server.MetricsServer
 
 	done chan bool
 }
@@ -41,9 +46,11 @@ func (c *ServerCommand) Command() *cobra.Command {
 	}
 
 	cmd.Flags().StringVar(&c.ConfigFile, "config", "", "config file (default is $HOME/.passage.yaml)")
+	cmd.Flags().StringVar(&c.PassagesFile, "passages-file", "", "file of the passages added with --persist (default is the config file with the .passages.yaml extension)")
 	cmd.Flags().StringVar(&c.LogFile, "log-file", "", "log file")
 	cmd.Flags().StringVar(&c.LogLevel, "log-level", "info", "max log level enabled")
 	cmd.Flags().StringVar(&c.RPCAddr, "rpc-addr", rpcAddrDefault, "passage rpc server address, is an unix socket.")
+	cmd.Flags().StringVar(&c.MetricsAddr, "metrics-addr", "", "address serving the prometheus metrics at /metrics, disabled by default.")
 	return cmd
 }
 
@@ -61,6 +68,10 @@ func (c *ServerCommand) Execute(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	if err := c.setupMetricsServer(); err != nil {
+		return err
+	}
+
 	<-c.done
 	log15.Info("server stopped successfully")
 	return nil
@@ -71,6 +82,11 @@ func (c *ServerCommand) setupServer() error {
 		return err
 	}
 
+	c.Server.PassagesFile = c.PassagesFile
+	if c.PassagesFile == "" {
+		c.Server.PassagesFile = server.PassagesFile(viper.ConfigFileUsed())
+	}
+
 	if err := c.loadConfig(); err != nil {
 		return err
 	}
@@ -102,6 +118,20 @@ func (c *ServerCommand) setupRPCServer() error {
 	return nil
 }
 
+func (c *ServerCommand) setupMetricsServer() error {
+	c.MetricsServer = server.NewMetricsServer(c.Server)
+	if c.MetricsAddr == "" {
+		return nil
+	}
+
+	if err := c.MetricsServer.Listen(c.MetricsAddr); err != nil {
+		return err
+	}
+
+	log15.Info("metrics server started", "addr", c.MetricsServer.Addr())
+	return nil
+}
+
 func (c *ServerCommand) readConfig() error {
 	if c.ConfigFile != "" {
 		viper.SetConfigFile(c.ConfigFile)
@@ -119,10 +149,7 @@ func (c *ServerCommand) loadConfig() error {
 		return err
 	}
 
-	if err := c.Config.Validate(); err != nil {
-		return err
-	}
-
+	// the config is validated by Load, so the failures count as reloads
 	if err := c.Server.Load(c.Config); err != nil {
 		return err
 	}
@@ -155,7 +182,7 @@ func (c *ServerCommand) setupLogging() error {
 
 func (c *ServerCommand) handleSignals() {
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-signals
 		if err := c.stop(); err != nil {
@@ -164,13 +191,22 @@ func (c *ServerCommand) handleSignals() {
 	}()
 }
 
+// stop closes the services, the signal may arrive before they are set up
 func (c *ServerCommand) stop() error {
 	if err := c.Server.Close(); err != nil {
 		return err
 	}
 
-	if err := c.RPCServer.Close(); err != nil {
-		return err
+	if c.RPCServer != nil {
+		if err := c.RPCServer.Close(); err != nil {
+			return err
+		}
+	}
+
+	if c.MetricsServer != nil {
+		if err := c.MetricsServer.Close(); err != nil {
+			return err
+		}
 	}
 
 	c.done <- true
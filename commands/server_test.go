@@ -0,0 +1,17 @@
+package commands
+
+import . "gopkg.in/check.v1"
+
+type ServerSuite struct{}
+
+var _ = Suite(&ServerSuite{})
+
+func (s *ServerSuite) TestStopBeforeSetup(c *C) {
+	cmd := NewServerCommand()
+
+	errs := make(chan error, 1)
+	go func() { errs <- cmd.stop() }()
+
+	<-cmd.done
+	c.Assert(<-errs, IsNil)
+}
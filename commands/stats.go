@@ -0,0 +1,149 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mcuadros/passage/core"
+	"github.com/mcuadros/passage/server"
+
+	"github.com/spf13/cobra"
+)
+
+type StatsCommand struct {
+	RPCAddr string
+}
+
+func NewStatsCommand() *StatsCommand {
+	return &StatsCommand{}
+}
+
+func (c *StatsCommand) Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "stats [passage-name]",
+		Short: "returns the traffic metrics of the passages and its servers",
+		RunE:  c.Execute,
+	}
+
+	cmd.Flags().StringVar(&c.RPCAddr, "rpc-addr", rpcAddrDefault, "passage rpc server address, is an unix socket.")
+	return cmd
+}
+
+func (c *StatsCommand) Execute(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("invalid args: %q", args)
+	}
+
+	var passage string
+	if len(args) == 1 {
+		passage = args[0]
+	}
+
+	rpcClient, err := rpc.Dial("unix", c.RPCAddr)
+	if err != nil {
+		return err
+	}
+
+	var reply server.Stats
+	if err := rpcClient.Call("Server.Stats", passage, &reply); err != nil {
+		return err
+	}
+
+	printStats(os.Stdout, &reply)
+	return nil
+}
+
+func printStats(out io.Writer, s *server.Stats) {
+	w := newTabWriter(out)
+	fmt.Fprintln(w, "PASSAGE\tACTIVE\tTOTAL\tIN\tOUT\tDIAL\tDURATION\tERRORS")
+	for _, name := range sortedStatsKeys(s.Passages) {
+		p := s.Passages[name]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			name, p.ActiveConnections, p.TotalConnections,
+			formatBytes(p.BytesIn), formatBytes(p.BytesOut),
+			formatMean(p.DialLatency), formatMean(p.TunnelDuration),
+			formatErrors(p.Errors),
+		)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "SERVER\tCONNECTED\tCONNECTS\tRECONNECTS\tDIAL ERRORS\tCONNECT\tIN\tOUT")
+
+	var servers []string
+	for name := range s.Servers {
+		servers = append(servers, name)
+	}
+
+	sort.Strings(servers)
+	for _, name := range servers {
+		ss := s.Servers[name]
+		fmt.Fprintf(w, "%s\t%t\t%d\t%d\t%d\t%s\t%s\t%s\n",
+			name, ss.Connected, ss.Connects, ss.Reconnects, ss.DialErrors,
+			formatMean(ss.ConnectLatency),
+			formatBytes(ss.Traffic.BytesIn), formatBytes(ss.Traffic.BytesOut),
+		)
+	}
+
+	w.Flush()
+}
+
+func sortedStatsKeys(m map[string]core.PassageStats) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatMean returns the mean of the histogram, or - if empty
+func formatMean(h core.HistogramSnapshot) string {
+	if h.Count == 0 {
+		return "-"
+	}
+
+	d := h.Mean()
+	switch {
+	case d >= time.Second:
+		d = d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		d = d.Round(time.Microsecond)
+	}
+
+	return d.String()
+}
+
+func formatErrors(errors map[string]uint64) string {
+	var kinds []string
+	for kind, n := range errors {
+		kinds = append(kinds, fmt.Sprintf("%s=%d", kind, n))
+	}
+
+	if len(kinds) == 0 {
+		return "-"
+	}
+
+	sort.Strings(kinds)
+	return strings.Join(kinds, ",")
+}
@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/mcuadros/passage/core"
+	"github.com/mcuadros/passage/server"
+
+	. "gopkg.in/check.v1"
+)
+
+type StatsSuite struct{}
+
+var _ = Suite(&StatsSuite{})
+
+func (s *StatsSuite) TestFormatBytes(c *C) {
+	c.Assert(formatBytes(42), Equals, "42B")
+	c.Assert(formatBytes(1536), Equals, "1.5KiB")
+	c.Assert(formatBytes(3*1024*1024*1024), Equals, "3.0GiB")
+}
+
+func (s *StatsSuite) TestPrintStats(c *C) {
+	var buf bytes.Buffer
+	printStats(&buf, &server.Stats{
+		Passages: map[string]core.PassageStats{
+			"foo": {
+				ActiveConnections: 1,
+				TotalConnections:  3,
+				BytesIn:           42,
+				BytesOut:          2048,
+				DialLatency:       core.HistogramSnapshot{Count: 2, Sum: 3 * time.Millisecond},
+				Errors:            map[string]uint64{core.ErrorKindResolve: 1, core.ErrorKindDial: 2},
+			},
+		},
+		Servers: map[string]server.ServerStats{
+			"baz": {
+				ConnectionStats: core.ConnectionStats{Connected: true, Connects: 2, Reconnects: 1},
+				Traffic:         core.PassageStats{BytesIn: 42, BytesOut: 2048},
+			},
+		},
+	})
+
+	c.Assert(buf.String(), Equals, ""+
+		"PASSAGE  ACTIVE  TOTAL  IN   OUT     DIAL   DURATION  ERRORS\n"+
+		"foo      1       3      42B  2.0KiB  1.5ms  -         dial=2,resolve=1\n"+
+		"\n"+
+		"SERVER  CONNECTED  CONNECTS  RECONNECTS  DIAL ERRORS  CONNECT  IN   OUT\n"+
+		"baz     true       2         1           0            -        42B  2.0KiB\n",
+	)
+}
@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mcuadros/passage/server"
+
+	"github.com/spf13/cobra"
+)
+
+type StatusCommand struct {
+	RPCAddr string
+}
+
+func NewStatusCommand() *StatusCommand {
+	return &StatusCommand{}
+}
+
+func (c *StatusCommand) Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status [passage-name]",
+		Short: "returns the state of the SSH servers, or the description of a passage",
+		RunE:  c.Execute,
+	}
+
+	cmd.Flags().StringVar(&c.RPCAddr, "rpc-addr", rpcAddrDefault, "passage rpc server address, is an unix socket.")
+	return cmd
+}
+
+func (c *StatusCommand) Execute(cmd *cobra.Command, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("invalid args: %q", args)
+	}
+
+	rpcClient, err := rpc.Dial("unix", c.RPCAddr)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 {
+		var reply server.PassageDescription
+		if err := rpcClient.Call("Server.Describe", args[0], &reply); err != nil {
+			return err
+		}
+
+		printDescription(os.Stdout, &reply)
+		return nil
+	}
+
+	var reply []server.ServerInfo
+	if err := rpcClient.Call("Server.Servers", "", &reply); err != nil {
+		return err
+	}
+
+	printServers(os.Stdout, reply)
+	return nil
+}
+
+func printServers(out io.Writer, servers []server.ServerInfo) {
+	w := newTabWriter(out)
+	fmt.Fprintln(w, "SERVER\tADDRESS\tMODE\tSTATE\tUPTIME\tPASSAGES\tLAST ERROR")
+	for _, s := range servers {
+		uptime := "-"
+		if s.Connected {
+			uptime = s.Uptime.Round(time.Second).String()
+		}
+
+		lastError := s.LastError
+		if lastError == "" {
+			lastError = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\n", s.Name, s.Address, s.Mode, s.State, uptime, len(s.Passages), lastError)
+	}
+
+	w.Flush()
+}
+
+func printDescription(out io.Writer, d *server.PassageDescription) {
+	var path []string
+	for _, s := range d.Path.Servers {
+		if s == d.Path.Active {
+			s += " (active)"
+		}
+
+		path = append(path, s)
+	}
+
+	w := newTabWriter(out)
+	fmt.Fprintf(w, "Name:\t%s\n", d.Name)
+	fmt.Fprintf(w, "Type:\t%s\n", d.Type)
+	fmt.Fprintf(w, "Server:\t%s\n", d.Server)
+	fmt.Fprintf(w, "Path:\t%s\n", strings.Join(path, ", "))
+	fmt.Fprintf(w, "Local:\t%s\n", d.Local)
+	fmt.Fprintf(w, "Remote:\t%s\n", d.Remote)
+	fmt.Fprintf(w, "State:\t%s\n", d.State)
+	if d.Error != "" {
+		fmt.Fprintf(w, "Error:\t%s\n", d.Error)
+	}
+
+	fmt.Fprintf(w, "Connections:\t%d active, %d total\n", d.Stats.ActiveConnections, d.Stats.TotalConnections)
+	fmt.Fprintf(w, "Traffic:\t%s in, %s out\n", formatBytes(d.Stats.BytesIn), formatBytes(d.Stats.BytesOut))
+	fmt.Fprintf(w, "Dial:\t%s\n", formatMean(d.Stats.DialLatency))
+	fmt.Fprintf(w, "Errors:\t%s\n", formatErrors(d.Stats.Errors))
+	w.Flush()
+}
@@ -0,0 +1,80 @@
+package commands
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/mcuadros/passage/core"
+	"github.com/mcuadros/passage/server"
+
+	. "gopkg.in/check.v1"
+)
+
+type StatusSuite struct{}
+
+var _ = Suite(&StatusSuite{})
+
+func (s *StatusSuite) TestPrintPassages(c *C) {
+	var buf bytes.Buffer
+	printPassages(&buf, []server.PassageInfo{
+		{Name: "foo", Server: "baz", Type: "tcp", Local: "127.0.0.1:8400", Remote: "localhost:80/tcp", State: "up"},
+		{Name: "qux", Server: "baz", Type: "reverse", Local: "<nil>", Remote: "localhost:80/tcp", State: "pending", Ephemeral: true},
+	})
+
+	c.Assert(buf.String(), Equals, ""+
+		"NAME  SERVER  TYPE     LOCAL           REMOTE            STATE    ORIGIN\n"+
+		"foo   baz     tcp      127.0.0.1:8400  localhost:80/tcp  up       config\n"+
+		"qux   baz     reverse  <nil>           localhost:80/tcp  pending  runtime\n",
+	)
+}
+
+func (s *StatusSuite) TestOrigin(c *C) {
+	c.Assert(origin(server.PassageInfo{}), Equals, "config")
+	c.Assert(origin(server.PassageInfo{Ephemeral: true}), Equals, "runtime")
+
+	expires := time.Now().Add(time.Hour + 500*time.Millisecond)
+	c.Assert(origin(server.PassageInfo{Ephemeral: true, Expires: expires}), Equals, "runtime, 1h0m0s left")
+}
+
+func (s *StatusSuite) TestPrintServers(c *C) {
+	var buf bytes.Buffer
+	printServers(&buf, []server.ServerInfo{
+		{Name: "baz", Address: "10.0.0.1:22", Mode: "eager", State: "connected", Connected: true, Uptime: 90*time.Second + time.Millisecond, Passages: []string{"foo"}},
+		{Name: "qux", Address: "10.0.0.2:22", Mode: "lazy", State: "disconnected", LastError: "error dialing server: timeout"},
+		{Name: "quux", Address: "10.0.0.3:22", Mode: "on-demand", State: "connecting"},
+	})
+
+	c.Assert(buf.String(), Equals, ""+
+		"SERVER  ADDRESS      MODE       STATE         UPTIME  PASSAGES  LAST ERROR\n"+
+		"baz     10.0.0.1:22  eager      connected     1m30s   1         -\n"+
+		"qux     10.0.0.2:22  lazy       disconnected  -       0         error dialing server: timeout\n"+
+		"quux    10.0.0.3:22  on-demand  connecting    -       0         -\n",
+	)
+}
+
+func (s *StatusSuite) TestPrintDescription(c *C) {
+	var buf bytes.Buffer
+	printDescription(&buf, &server.PassageDescription{
+		PassageInfo: server.PassageInfo{
+			Name: "foo", Server: "baz", Type: "tcp", Local: "127.0.0.1:8400",
+			Remote: "localhost:80/tcp", State: "down", Error: "ssh: handshake failed",
+		},
+		Path:  server.PassagePath{Servers: []string{"baz", "qux"}, Active: "qux"},
+		Stats: core.PassageStats{ActiveConnections: 1, TotalConnections: 2, BytesIn: 10, BytesOut: 20},
+	})
+
+	c.Assert(buf.String(), Equals, ""+
+		"Name:         foo\n"+
+		"Type:         tcp\n"+
+		"Server:       baz\n"+
+		"Path:         baz, qux (active)\n"+
+		"Local:        127.0.0.1:8400\n"+
+		"Remote:       localhost:80/tcp\n"+
+		"State:        down\n"+
+		"Error:        ssh: handshake failed\n"+
+		"Connections:  1 active, 2 total\n"+
+		"Traffic:      10B in, 20B out\n"+
+		"Dial:         -\n"+
+		"Errors:       -\n",
+	)
+}
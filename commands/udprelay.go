@@ -0,0 +1,63 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mcuadros/passage/core"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// UDPRelayCommand runs at the SSH server, relaying the streams of the udp
+// passages to a UDP service
+type UDPRelayCommand struct {
+	LogLevel string
+}
+
+func NewUDPRelayCommand() *UDPRelayCommand {
+	return &UDPRelayCommand{}
+}
+
+func (c *UDPRelayCommand) Command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "udp-relay <listen> <target>",
+		Short: "relays the streams of the udp passages to an UDP service, runs at the SSH server",
+		Long: "Relays the streams of the udp passages to an UDP service, runs at the SSH server. " +
+			"The streams are accepted at listen, an unix socket if it's an absolute path, " +
+			"and its datagrams sent to target, as 127.0.0.1:8125.",
+		RunE: c.Execute,
+	}
+
+	cmd.Flags().StringVar(&c.LogLevel, "log-level", "info", "max log level enabled")
+	return cmd
+}
+
+func (c *UDPRelayCommand) Execute(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("invalid args: %q, listen address and target required", args)
+	}
+
+	lvl, err := log15.LvlFromString(c.LogLevel)
+	if err != nil {
+		return fmt.Errorf("unknown log level name %q", c.LogLevel)
+	}
+
+	log15.Root().SetHandler(log15.LvlFilterHandler(lvl, log15.StderrHandler))
+
+	r := core.NewUDPRelay(args[1])
+	if err := r.Listen(args[0]); err != nil {
+		return err
+	}
+
+	log15.Info("udp relay started", "addr", r.Addr(), "target", args[1])
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	return r.Close()
+}
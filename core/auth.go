@@ -0,0 +1,142 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Signers returns the keys of a publickey auth source, like the agent
+type Signers func() ([]ssh.Signer, error)
+
+// SSHPublicKeys returns a publickey auth method offering the keys of the
+// sources in order. The ssh client tries each method only once, so the agent
+// and the identity files have to share a single one.
+func SSHPublicKeys(sources ...Signers) ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		for _, source := range sources {
+			s, err := source()
+			if err != nil {
+				return nil, err
+			}
+
+			signers = append(signers, s...)
+		}
+
+		return signers, nil
+	})
+}
+
+func SSHAgent() ssh.AuthMethod {
+	return SSHPublicKeys(SSHAgentSigners())
+}
+
+// SSHAgentSigners returns the keys of the agent at SSH_AUTH_SOCK, none if not
+// available
+func SSHAgentSigners() Signers {
+	a := &sshAgent{}
+	return a.Signers
+}
+
+type sshAgent struct {
+	sync.Mutex
+	conn   net.Conn
+	client agent.Agent
+}
+
+func (a *sshAgent) Signers() ([]ssh.Signer, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.client == nil {
+		if err := a.dial(); err != nil {
+			// an unavailable agent shouldn't abort the authentication, the
+			// next auth method will be tried
+			log15.Warn("ssh agent not available", "error", err)
+			return nil, nil
+		}
+	}
+
+	signers, err := a.client.Signers()
+	if err != nil {
+		log15.Warn("error requesting keys from ssh agent", "error", err)
+		a.conn.Close()
+		a.client = nil
+		return nil, nil
+	}
+
+	return signers, nil
+}
+
+func (a *sshAgent) dial() error {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return fmt.Errorf("SSH_AUTH_SOCK is not set")
+	}
+
+	var err error
+	a.conn, err = net.Dial("unix", sock)
+	if err != nil {
+		return err
+	}
+
+	a.client = agent.NewClient(a.conn)
+	return nil
+}
+
+func SSHIdentityFile(file string, passphrase []byte) (ssh.AuthMethod, error) {
+	signers, err := SSHIdentityFileSigners(file, passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return SSHPublicKeys(signers), nil
+}
+
+// SSHIdentityFileSigners returns the key of the identity file, read and
+// decrypted once
+func SSHIdentityFileSigners(file string, passphrase []byte) (Signers, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading identity file: %s", err)
+	}
+
+	var signer ssh.Signer
+	if len(passphrase) == 0 {
+		signer, err = ssh.ParsePrivateKey(pem)
+	} else {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, passphrase)
+	}
+
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, fmt.Errorf("identity file %q: is encrypted, passphrase required", file)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("identity file %q: %s", file, err)
+	}
+
+	return func() ([]ssh.Signer, error) {
+		return []ssh.Signer{signer}, nil
+	}, nil
+}
+
+func SSHKeyboardInteractive(password string) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(func(
+		name, instruction string, questions []string, echos []bool,
+	) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			answers[i] = password
+		}
+
+		return answers, nil
+	})
+}
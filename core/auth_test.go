@@ -0,0 +1,130 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	. "gopkg.in/check.v1"
+)
+
+type AuthSuite struct {
+	dir  string
+	key  *rsa.PrivateKey
+	echo net.Listener
+	ssh  *sshServerFixture
+}
+
+var _ = Suite(&AuthSuite{})
+
+func (s *AuthSuite) SetUpSuite(c *C) {
+	var err error
+	s.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+}
+
+func (s *AuthSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.echo = newEchoServer(c)
+	s.ssh = newSSHServerFixture(c)
+}
+
+func (s *AuthSuite) TearDownTest(c *C) {
+	s.ssh.Close()
+	s.echo.Close()
+}
+
+func (s *AuthSuite) writeKey(c *C, passphrase string) string {
+	block := &pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(s.key),
+	}
+
+	if passphrase != "" {
+		var err error
+		block, err = x509.EncryptPEMBlock(
+			rand.Reader, block.Type, block.Bytes, []byte(passphrase), x509.PEMCipherAES256,
+		)
+		c.Assert(err, IsNil)
+	}
+
+	file := filepath.Join(s.dir, "id_rsa")
+	err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600)
+	c.Assert(err, IsNil)
+
+	return file
+}
+
+func (s *AuthSuite) authorizeKey(c *C) {
+	pub, err := ssh.NewPublicKey(&s.key.PublicKey)
+	c.Assert(err, IsNil)
+	s.ssh.AuthorizedKey = pub
+}
+
+func (s *AuthSuite) assertConnects(c *C, auth ...ssh.AuthMethod) {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(auth...), 0)
+	r, err := conn.Conn(s.echo.Addr())
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	_, err = r.Write([]byte("foo"))
+	c.Assert(err, IsNil)
+
+	buf := make([]byte, 3)
+	_, err = r.Read(buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "foo")
+}
+
+func (s *AuthSuite) TestSSHIdentityFile(c *C) {
+	s.authorizeKey(c)
+
+	auth, err := SSHIdentityFile(s.writeKey(c, ""), nil)
+	c.Assert(err, IsNil)
+	s.assertConnects(c, auth)
+}
+
+func (s *AuthSuite) TestSSHIdentityFileEncrypted(c *C) {
+	s.authorizeKey(c)
+
+	auth, err := SSHIdentityFile(s.writeKey(c, "qux"), []byte("qux"))
+	c.Assert(err, IsNil)
+	s.assertConnects(c, auth)
+}
+
+func (s *AuthSuite) TestSSHIdentityFileMissingPassphrase(c *C) {
+	_, err := SSHIdentityFile(s.writeKey(c, "qux"), nil)
+	c.Assert(err, ErrorMatches, ".*is encrypted, passphrase required")
+}
+
+func (s *AuthSuite) TestSSHIdentityFileNotFound(c *C) {
+	_, err := SSHIdentityFile(filepath.Join(s.dir, "missing"), nil)
+	c.Assert(err, ErrorMatches, "error reading identity file: .*")
+}
+
+func (s *AuthSuite) TestSSHKeyboardInteractive(c *C) {
+	s.assertConnects(c, SSHKeyboardInteractive("bar"))
+}
+
+func (s *AuthSuite) TestSSHAgentNotAvailable(c *C) {
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Unsetenv("SSH_AUTH_SOCK")
+
+	s.assertConnects(c, SSHAgent(), ssh.Password("bar"))
+}
+
+func (s *AuthSuite) TestSSHPublicKeysAgentNotAvailable(c *C) {
+	defer os.Setenv("SSH_AUTH_SOCK", os.Getenv("SSH_AUTH_SOCK"))
+	os.Unsetenv("SSH_AUTH_SOCK")
+	s.authorizeKey(c)
+
+	key, err := SSHIdentityFileSigners(s.writeKey(c, ""), nil)
+	c.Assert(err, IsNil)
+	s.assertConnects(c, SSHPublicKeys(SSHAgentSigners(), key))
+}
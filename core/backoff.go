@@ -0,0 +1,57 @@
+package core
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+type Backoff struct {
+	InitialDelay time.Duration
+	Multiplier   float64
+	MaxDelay     time.Duration
+	// Jitter is the fraction, between 0 and 1, of the delay randomly added or
+	// subtracted to avoid reconnecting all the clients at the same time
+	Jitter float64
+	// MaxElapsed is the maximum time spent retrying, zero means no limit
+	MaxElapsed time.Duration
+}
+
+var DefaultBackoff = Backoff{
+	InitialDelay: time.Second,
+	Multiplier:   2,
+	MaxDelay:     30 * time.Second,
+	Jitter:       0.2,
+}
+
+// Delay returns the time to wait before the given retry, starting from 0
+func (b Backoff) Delay(retry int) time.Duration {
+	d := float64(b.InitialDelay) * math.Pow(math.Max(b.Multiplier, 1), float64(retry))
+	if b.MaxDelay > 0 && d > float64(b.MaxDelay) {
+		d = float64(b.MaxDelay)
+	}
+
+	if b.Jitter > 0 {
+		d += d * b.Jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(d)
+}
+
+// ServerDownError is returned without trying to connect while the circuit
+// breaker of a SSH server is open, this happens after exhausting the retries.
+type ServerDownError struct {
+	Server string
+	Until  time.Time
+	Err    error
+}
+
+func (e *ServerDownError) Error() string {
+	msg := fmt.Sprintf("ssh server %s is down, failing fast until %s", e.Server, e.Until.Format(time.RFC3339))
+	if e.Err == nil {
+		return msg
+	}
+
+	return fmt.Sprintf("%s: %s", msg, e.Err)
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"fmt"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type BackoffSuite struct{}
+
+var _ = Suite(&BackoffSuite{})
+
+func (s *BackoffSuite) TestDelay(c *C) {
+	b := Backoff{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}
+
+	c.Assert(b.Delay(0), Equals, time.Second)
+	c.Assert(b.Delay(1), Equals, 2*time.Second)
+	c.Assert(b.Delay(2), Equals, 4*time.Second)
+	c.Assert(b.Delay(3), Equals, 5*time.Second)
+	c.Assert(b.Delay(100), Equals, 5*time.Second)
+}
+
+func (s *BackoffSuite) TestDelayJitter(c *C) {
+	b := Backoff{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second, Jitter: 0.5}
+
+	for i := 0; i < 100; i++ {
+		d := b.Delay(1)
+		c.Assert(d >= time.Second && d <= 3*time.Second, Equals, true)
+	}
+}
+
+func (s *BackoffSuite) TestServerDownError(c *C) {
+	until := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	err := &ServerDownError{Server: "foo", Until: until, Err: fmt.Errorf("bar")}
+	c.Assert(err, ErrorMatches, "ssh server foo is down, failing fast until 2017-01-01T00:00:00Z: bar")
+
+	err = &ServerDownError{Server: "foo", Until: until}
+	c.Assert(err, ErrorMatches, "ssh server foo is down, failing fast until 2017-01-01T00:00:00Z")
+}
@@ -0,0 +1,231 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const (
+	BalancePolicyRoundRobin = "round-robin"
+	BalancePolicyLeastConn  = "least-conn"
+	BalancePolicyRandom     = "random"
+
+	DefaultHealthCheckInterval = 10 * time.Second
+)
+
+// Backend is a remote reached through a SSH connection
+type Backend struct {
+	Conn   SSHConnection
+	Remote Remote
+}
+
+func (b Backend) String() string {
+	return fmt.Sprintf("(%s)-[%s]", b.Conn, b.Remote)
+}
+
+type backend struct {
+	Backend
+	active    int64
+	unhealthy int32
+}
+
+// dial dials the backend once, a failure moves on to the next backend instead
+// of waiting for the retries
+func (b *backend) dial(ctx context.Context) (net.Conn, error) {
+	a, err := b.Remote.AddrContext(ctx, b.Conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return dialOnce(ctx, b.Conn, a)
+}
+
+func (b *backend) healthy() bool {
+	return atomic.LoadInt32(&b.unhealthy) == 0
+}
+
+// Balancer distributes the connections between several backends. A backend
+// failing to dial is marked as unhealthy, and skipped, until a health check,
+// dialing it again, succeeds.
+type Balancer struct {
+	policy   string
+	interval time.Duration
+	backends []*backend
+	next     uint32
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewBalancer returns a balancer with the given policy, BalancePolicyRoundRobin
+// by default, checking the unhealthy backends every interval
+func NewBalancer(policy string, interval time.Duration, backends ...Backend) *Balancer {
+	if interval == 0 {
+		interval = DefaultHealthCheckInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Balancer{
+		policy:   policy,
+		interval: interval,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	for _, be := range backends {
+		b.backends = append(b.backends, &backend{Backend: be})
+	}
+
+	return b
+}
+
+// Handle tunnels c to one of the healthy backends, if the dial fails the next
+// one is tried
+func (b *Balancer) Handle(c net.Conn) error {
+	return b.HandleContext(context.Background(), c)
+}
+
+// HandleContext is like Handle, the successful dial is observed by ctx. The
+// dials are canceled when the balancer is closed, not when ctx is done.
+func (b *Balancer) HandleContext(ctx context.Context, c net.Conn) error {
+	candidates := b.candidates()
+	if len(candidates) == 0 {
+		return newPassageError(ErrorKindNoBackend, fmt.Errorf("no healthy backends"))
+	}
+
+	var err error
+	for _, be := range candidates {
+		start := time.Now()
+		var r net.Conn
+		r, err = be.dial(b.ctx)
+		if err != nil {
+			b.markUnhealthy(be, err)
+			continue
+		}
+
+		observeDial(ctx, start)
+		atomic.AddInt64(&be.active, 1)
+		tunnel(c, r)
+		atomic.AddInt64(&be.active, -1)
+		return nil
+	}
+
+	return fmt.Errorf("all backends failed, last error: %s", err)
+}
+
+// candidates returns the healthy backends, starting by the one chosen by the
+// policy and followed by the rest in order
+func (b *Balancer) candidates() []*backend {
+	var healthy []*backend
+	for _, be := range b.backends {
+		if be.healthy() {
+			healthy = append(healthy, be)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	offset := int(atomic.AddUint32(&b.next, 1)-1) % len(healthy)
+	first := offset
+	switch b.policy {
+	case BalancePolicyRandom:
+		first = rand.Intn(len(healthy))
+	case BalancePolicyLeastConn:
+		// the ties are broken in round-robin
+		for i := range healthy {
+			be := healthy[(offset+i)%len(healthy)]
+			if atomic.LoadInt64(&be.active) < atomic.LoadInt64(&healthy[first].active) {
+				first = (offset + i) % len(healthy)
+			}
+		}
+	}
+
+	candidates := make([]*backend, 0, len(healthy))
+	candidates = append(candidates, healthy[first:]...)
+	return append(candidates, healthy[:first]...)
+}
+
+func (b *Balancer) markUnhealthy(be *backend, err error) {
+	if !atomic.CompareAndSwapInt32(&be.unhealthy, 0, 1) {
+		return
+	}
+
+	log15.Warn("backend unhealthy", "backend", be, "error", err)
+	go b.check(be)
+}
+
+// check dials the backend every interval until it succeeds
+func (b *Balancer) check(be *backend) {
+	t := time.NewTicker(b.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(b.ctx, b.interval)
+		conn, err := be.dial(ctx)
+		cancel()
+
+		if err != nil {
+			log15.Debug("backend health check failed", "backend", be, "error", err)
+			continue
+		}
+
+		conn.Close()
+		atomic.StoreInt32(&be.unhealthy, 0)
+		log15.Info("backend healthy", "backend", be)
+		return
+	}
+}
+
+// Err returns an error if all the backends are unhealthy
+func (b *Balancer) Err() error {
+	for _, be := range b.backends {
+		if be.healthy() {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no healthy backends")
+}
+
+// Close stops the health checks and closes the remotes, the active tunnels are
+// not affected
+func (b *Balancer) Close() error {
+	b.cancel()
+	for _, be := range b.backends {
+		if c, ok := be.Remote.(io.Closer); ok {
+			c.Close()
+		}
+	}
+
+	return nil
+}
+
+func (b *Balancer) String() string {
+	var backends []string
+	for _, be := range b.backends {
+		backends = append(backends, be.String())
+	}
+
+	policy := b.policy
+	if policy == "" {
+		policy = BalancePolicyRoundRobin
+	}
+
+	return fmt.Sprintf("<%s>{%s}", policy, strings.Join(backends, ", "))
+}
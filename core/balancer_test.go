@@ -0,0 +1,180 @@
+package core
+
+import (
+	"io/ioutil"
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type BalancerSuite struct {
+	ssh *sshServerFixture
+}
+
+var _ = Suite(&BalancerSuite{})
+
+func (s *BalancerSuite) SetUpTest(c *C) {
+	s.ssh = newSSHServerFixture(c)
+}
+
+func (s *BalancerSuite) TearDownTest(c *C) {
+	s.ssh.Close()
+}
+
+func (s *BalancerSuite) TestRoundRobin(c *C) {
+	foo := listenNameServer(c, "127.0.0.1:0", "foo")
+	defer foo.Close()
+	bar := listenNameServer(c, "127.0.0.1:0", "bar")
+	defer bar.Close()
+
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewBalancedPassage(NewBalancer(BalancePolicyRoundRobin, 0,
+		Backend{conn, NewRemote("tcp", foo.Addr().String())},
+		Backend{conn, NewRemote("tcp", bar.Addr().String())},
+	))
+
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	c.Assert(p.String(), Matches, `<round-robin>{\(foo@.*\)-\[.*/tcp\], \(foo@.*\)-\[.*/tcp\]}`)
+	c.Assert(readName(c, p.Addr()), Equals, "foo")
+	c.Assert(readName(c, p.Addr()), Equals, "bar")
+	c.Assert(readName(c, p.Addr()), Equals, "foo")
+}
+
+func (s *BalancerSuite) TestUnhealthy(c *C) {
+	foo := listenNameServer(c, "127.0.0.1:0", "foo")
+	defer foo.Close()
+	bar := listenNameServer(c, "127.0.0.1:0", "bar")
+	barAddr := bar.Addr().String()
+	bar.Close()
+
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	b := NewBalancer(BalancePolicyRoundRobin, 50*time.Millisecond,
+		Backend{conn, NewRemote("tcp", barAddr)},
+		Backend{conn, NewRemote("tcp", foo.Addr().String())},
+	)
+
+	p := NewBalancedPassage(b)
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	c.Assert(readName(c, p.Addr()), Equals, "foo")
+	c.Assert(b.backends[0].healthy(), Equals, false)
+	c.Assert(readName(c, p.Addr()), Equals, "foo")
+	c.Assert(readName(c, p.Addr()), Equals, "foo")
+	c.Assert(p.Err(), IsNil)
+
+	bar = listenNameServer(c, barAddr, "bar")
+	defer bar.Close()
+
+	for i := 0; i < 100 && !b.backends[0].healthy(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(b.backends[0].healthy(), Equals, true)
+}
+
+func (s *BalancerSuite) TestUnhealthyRetries(c *C) {
+	foo := listenNameServer(c, "127.0.0.1:0", "foo")
+	defer foo.Close()
+	bar := listenNameServer(c, "127.0.0.1:0", "bar")
+	barAddr := bar.Addr().String()
+	bar.Close()
+
+	down := newSSHServerFixture(c)
+	down.Close()
+
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 3)
+	b := NewBalancer(BalancePolicyRoundRobin, time.Hour,
+		Backend{NewSSHConnection(down.Addr(), down.ClientConfig(), 3), NewRemote("tcp", foo.Addr().String())},
+		Backend{conn, NewRemote("tcp", barAddr)},
+		Backend{conn, NewRemote("tcp", foo.Addr().String())},
+	)
+
+	p := NewBalancedPassage(b)
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	// the failing backends are skipped without waiting for the backoff
+	start := time.Now()
+	c.Assert(readName(c, p.Addr()), Equals, "foo")
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	c.Assert(b.backends[0].healthy(), Equals, false)
+	c.Assert(b.backends[1].healthy(), Equals, false)
+}
+
+func (s *BalancerSuite) TestNoHealthyBackends(c *C) {
+	foo := listenNameServer(c, "127.0.0.1:0", "foo")
+	fooAddr := foo.Addr().String()
+	foo.Close()
+
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	b := NewBalancer(BalancePolicyRoundRobin, time.Hour, Backend{conn, NewRemote("tcp", fooAddr)})
+	defer b.Close()
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	err := b.Handle(server)
+	c.Assert(err, ErrorMatches, "all backends failed, last error: .*")
+	c.Assert(b.Err(), ErrorMatches, "no healthy backends")
+
+	err = b.Handle(server)
+	c.Assert(err, ErrorMatches, "no healthy backends")
+}
+
+func (s *BalancerSuite) TestCandidates(c *C) {
+	b := NewBalancer(BalancePolicyLeastConn, 0,
+		Backend{Remote: NewRemote("tcp", "foo:1")},
+		Backend{Remote: NewRemote("tcp", "bar:1")},
+		Backend{Remote: NewRemote("tcp", "qux:1")},
+	)
+
+	b.backends[0].active = 2
+	b.backends[1].active = 1
+	b.backends[2].active = 1
+	c.Assert(b.candidates()[0], Equals, b.backends[1])
+	c.Assert(b.candidates()[0], Equals, b.backends[1])
+	c.Assert(b.candidates()[0], Equals, b.backends[2])
+
+	b.backends[1].unhealthy = 1
+	candidates := b.candidates()
+	c.Assert(candidates, HasLen, 2)
+	c.Assert(candidates[0], Equals, b.backends[2])
+	c.Assert(candidates[1], Equals, b.backends[0])
+}
+
+func listenNameServer(c *C, address, name string) net.Listener {
+	l, err := net.Listen("tcp", address)
+	c.Assert(err, IsNil)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Write([]byte(name))
+			conn.Close()
+		}
+	}()
+
+	return l
+}
+
+func readName(c *C, addr string) string {
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	content, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+
+	return string(content)
+}
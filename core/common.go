@@ -3,11 +3,7 @@ package core
 import (
 	"fmt"
 	"net"
-	"os"
 	"strings"
-
-	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 )
 
 type Addr struct {
@@ -50,11 +46,19 @@ func MustResolveAddr(network, address string) *Addr {
 	return &Addr{a}
 }
 
-func SSHAgent() (ssh.AuthMethod, error) {
-	sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
-	if err == nil {
-		return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers), nil
-	}
+func NewUnresolvedAddr(network, address string) net.Addr {
+	return &netAddr{network: network, address: address}
+}
+
+type netAddr struct {
+	network string
+	address string
+}
+
+func (a *netAddr) Network() string {
+	return a.network
+}
 
-	return nil, err
+func (a *netAddr) String() string {
+	return a.address
 }
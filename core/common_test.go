@@ -1,9 +1,384 @@
 package core
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 
+	"golang.org/x/crypto/ssh"
 	. "gopkg.in/check.v1"
 )
 
 func Test(t *testing.T) { TestingT(t) }
+
+type sshServerFixture struct {
+	User          string
+	Password      string
+	AuthorizedKey ssh.PublicKey
+	HostKey       ssh.Signer
+
+	l          net.Listener
+	wg         sync.WaitGroup
+	mu         sync.Mutex
+	conns      []net.Conn
+	handshakes int32
+	stalled    int32
+}
+
+func newSSHServerFixture(c *C) *sshServerFixture {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	c.Assert(err, IsNil)
+
+	s := &sshServerFixture{User: "foo", Password: "bar", HostKey: signer}
+	s.l, err = net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	go s.serve(s.l)
+	return s
+}
+
+func (s *sshServerFixture) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+func (s *sshServerFixture) ClientConfig(auth ...ssh.AuthMethod) *ssh.ClientConfig {
+	if len(auth) == 0 {
+		auth = []ssh.AuthMethod{ssh.Password(s.Password)}
+	}
+
+	return &ssh.ClientConfig{
+		User:            s.User,
+		Auth:            auth,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+}
+
+func (s *sshServerFixture) Handshakes() int {
+	return int(atomic.LoadInt32(&s.handshakes))
+}
+
+// SetStalled makes the server ignore the keepalives, like a dead link would
+func (s *sshServerFixture) SetStalled(stalled bool) {
+	var v int32
+	if stalled {
+		v = 1
+	}
+
+	atomic.StoreInt32(&s.stalled, v)
+}
+
+func (s *sshServerFixture) Close() {
+	s.l.Close()
+	s.CloseConnections()
+	s.wg.Wait()
+}
+
+// Restart listens again at the same address, after Close
+func (s *sshServerFixture) Restart(c *C) {
+	l, err := net.Listen("tcp", s.l.Addr().String())
+	c.Assert(err, IsNil)
+
+	s.l = l
+	go s.serve(l)
+}
+
+func (s *sshServerFixture) CloseConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+
+	s.conns = nil
+}
+
+func (s *sshServerFixture) config() *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(m ssh.ConnMetadata, p []byte) (*ssh.Permissions, error) {
+			if m.User() == s.User && string(p) == s.Password {
+				return nil, nil
+			}
+
+			return nil, io.EOF
+		},
+		KeyboardInteractiveCallback: func(
+			m ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge,
+		) (*ssh.Permissions, error) {
+			answers, err := challenge("", "", []string{"Password: "}, []bool{false})
+			if err != nil {
+				return nil, err
+			}
+
+			if len(answers) == 1 && answers[0] == s.Password {
+				return nil, nil
+			}
+
+			return nil, io.EOF
+		},
+		PublicKeyCallback: func(m ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			if s.AuthorizedKey != nil && string(k.Marshal()) == string(s.AuthorizedKey.Marshal()) {
+				return nil, nil
+			}
+
+			return nil, io.EOF
+		},
+	}
+
+	config.AddHostKey(s.HostKey)
+	return config
+}
+
+func (s *sshServerFixture) serve(l net.Listener) {
+	config := s.config()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn, config)
+		}()
+	}
+}
+
+func (s *sshServerFixture) handle(conn net.Conn, config *ssh.ServerConfig) {
+	sc, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	atomic.AddInt32(&s.handshakes, 1)
+
+	go s.handleRequests(sc, reqs)
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "direct-tcpip":
+			go s.handleDirectTCPIP(nc)
+		case "direct-streamlocal@openssh.com":
+			go s.handleDirectStreamLocal(nc)
+		default:
+			nc.Reject(ssh.UnknownChannelType, nc.ChannelType())
+		}
+	}
+}
+
+func (s *sshServerFixture) handleDirectTCPIP(nc ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+
+	if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	remote, err := net.Dial("tcp", net.JoinHostPort(payload.Host, fmt.Sprint(payload.Port)))
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		remote.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+	pipe(ch, remote.(*net.TCPConn))
+}
+
+func (s *sshServerFixture) handleDirectStreamLocal(nc ssh.NewChannel) {
+	var payload struct {
+		SocketPath string
+		Reserved0  string
+		Reserved1  uint32
+	}
+
+	if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	remote, err := net.Dial("unix", payload.SocketPath)
+	if err != nil {
+		nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		remote.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+	pipe(ch, remote.(*net.UnixConn))
+}
+
+type forwardMsg struct {
+	Addr string
+	Port uint32
+}
+
+type forwardedMsg struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+func (s *sshServerFixture) handleRequests(sc *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	forwards := map[string]net.Listener{}
+	defer func() {
+		for _, l := range forwards {
+			l.Close()
+		}
+	}()
+
+	for r := range reqs {
+		var msg forwardMsg
+		switch r.Type {
+		case "tcpip-forward":
+			ssh.Unmarshal(r.Payload, &msg)
+			l, err := net.Listen("tcp", net.JoinHostPort(msg.Addr, fmt.Sprint(msg.Port)))
+			if err != nil {
+				r.Reply(false, nil)
+				continue
+			}
+
+			port := uint32(l.Addr().(*net.TCPAddr).Port)
+			forwards[net.JoinHostPort(msg.Addr, fmt.Sprint(port))] = l
+			go s.serveForward(sc, l, msg.Addr, port)
+			r.Reply(true, ssh.Marshal(&struct{ Port uint32 }{port}))
+		case "cancel-tcpip-forward":
+			ssh.Unmarshal(r.Payload, &msg)
+			key := net.JoinHostPort(msg.Addr, fmt.Sprint(msg.Port))
+			if l, ok := forwards[key]; ok {
+				l.Close()
+				delete(forwards, key)
+			}
+
+			r.Reply(true, nil)
+		case "keepalive@openssh.com":
+			if atomic.LoadInt32(&s.stalled) == 0 {
+				r.Reply(false, nil)
+			}
+		default:
+			if r.WantReply {
+				r.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *sshServerFixture) serveForward(sc *ssh.ServerConn, l net.Listener, addr string, port uint32) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		origin := conn.RemoteAddr().(*net.TCPAddr)
+		ch, reqs, err := sc.OpenChannel("forwarded-tcpip", ssh.Marshal(&forwardedMsg{
+			Addr: addr, Port: port,
+			OriginAddr: origin.IP.String(), OriginPort: uint32(origin.Port),
+		}))
+
+		if err != nil {
+			conn.Close()
+			continue
+		}
+
+		go ssh.DiscardRequests(reqs)
+		go pipe(ch, conn.(*net.TCPConn))
+	}
+}
+
+type closeWriter interface {
+	io.ReadWriteCloser
+	CloseWrite() error
+}
+
+func pipe(a, b closeWriter) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { defer wg.Done(); io.Copy(a, b); a.CloseWrite() }()
+	go func() { defer wg.Done(); io.Copy(b, a); b.CloseWrite() }()
+	wg.Wait()
+
+	a.Close()
+	b.Close()
+}
+
+func newEchoServer(c *C) net.Listener {
+	return listenEchoServer(c, "tcp", "127.0.0.1:0")
+}
+
+func listenEchoServer(c *C, network, address string) net.Listener {
+	l, err := net.Listen(network, address)
+	c.Assert(err, IsNil)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	return l
+}
+
+func write(c *C, w io.Writer, b ...byte) {
+	_, err := w.Write(b)
+	c.Assert(err, IsNil)
+}
+
+func read(c *C, r io.Reader, n int) []byte {
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	c.Assert(err, IsNil)
+
+	return b
+}
+
+func assertEchoConn(c *C, conn net.Conn) {
+	defer conn.Close()
+
+	write(c, conn, []byte("foo")...)
+	conn.(interface {
+		CloseWrite() error
+	}).CloseWrite()
+
+	content, err := ioutil.ReadAll(conn)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "foo")
+}
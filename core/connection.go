@@ -1,113 +1,964 @@
 package core
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+	"gopkg.in/inconshreveable/log15.v2"
 )
 
 type SSHConnection interface {
 	Tunnel(c net.Conn, a net.Addr) error
+	TunnelContext(ctx context.Context, c net.Conn, a net.Addr) error
 	Conn(a net.Addr) (net.Conn, error)
+	DialContext(ctx context.Context, a net.Addr) (net.Conn, error)
+	Listen(a net.Addr) (net.Listener, error)
+	ListenContext(ctx context.Context, a net.Addr) (net.Listener, error)
 	Config() *ssh.ClientConfig
+	Err() error
 	fmt.Stringer
 }
 
+// OnceDialer is a SSHConnection able to dial without retrying, for the callers
+// with something else to try, as the next backend of a balancer
+type OnceDialer interface {
+	DialOnce(ctx context.Context, a net.Addr) (net.Conn, error)
+}
+
+// dialOnce dials a through c without retrying, if c supports it
+func dialOnce(ctx context.Context, c SSHConnection, a net.Addr) (net.Conn, error) {
+	if d, ok := c.(OnceDialer); ok {
+		return d.DialOnce(ctx, a)
+	}
+
+	return c.DialContext(ctx, a)
+}
+
+const defaultDialTimeout = 5 * time.Second
+
+// ConnectionModeLazy connects on the first use, ConnectionModeEager at load
+// time and keeps reconnecting until closed, and ConnectionModeOnDemand
+// connects on use, closing the connection once idle
+const (
+	ConnectionModeLazy     = "lazy"
+	ConnectionModeEager    = "eager"
+	ConnectionModeOnDemand = "on-demand"
+)
+
+type SSHConnectionOptions struct {
+	Retries int
+	Backoff Backoff
+	// KeepAliveInterval is the interval between keepalive@openssh.com requests,
+	// zero or negative disables the keepalives
+	KeepAliveInterval time.Duration
+	// KeepAliveMaxMissed is the number of consecutive unanswered keepalives
+	// after which the connection is closed
+	KeepAliveMaxMissed int
+	// Mode is one of the ConnectionMode constants, lazy by default
+	Mode string
+	// IdleTimeout is the time without tunnels after which the connection is
+	// closed in the on-demand mode
+	IdleTimeout time.Duration
+}
+
 type sshConnection struct {
-	a          net.Addr
-	c          *ssh.ClientConfig
-	maxRetries int
+	a   net.Addr
+	c   *ssh.ClientConfig
+	via SSHConnection
+	o   SSHConnectionOptions
+
+	// m guards the client and the dialing state, dialing is the dial in
+	// progress if any
+	m       sync.Mutex
+	client  *ssh.Client
+	dialing *dialCall
+	// err is the error of the last dial, and lostErr the reason the last
+	// client was lost, until dialed again
+	err     error
+	lostErr error
+	// openUntil is set when the retries are exhausted, until then the new
+	// connections fail fast with tripErr
+	openUntil time.Time
+	tripErr   error
+	// active is the number of tunnels and listeners using the client, idle
+	// closes it once unused in the on-demand mode
+	active int
+	idle   *time.Timer
+	// retries are the failed dials in a row in the eager mode
+	retries int
+	closed  bool
 
-	connected bool
-	client    *ssh.Client
+	connects       uint64
+	disconnects    uint64
+	idleTimeouts   uint64
+	dialErrors     uint64
+	connectLatency *Histogram
+	connectedSince time.Time
 }
 
 func NewSSHConnection(a net.Addr, c *ssh.ClientConfig, retries int) SSHConnection {
-	return &sshConnection{a: a, c: c, maxRetries: retries}
+	return NewSSHConnectionVia(nil, a, c, retries)
+}
+
+func NewSSHConnectionVia(via SSHConnection, a net.Addr, c *ssh.ClientConfig, retries int) SSHConnection {
+	return NewSSHConnectionWithOptions(via, a, c, SSHConnectionOptions{Retries: retries})
+}
+
+func NewSSHConnectionWithOptions(
+	via SSHConnection, a net.Addr, c *ssh.ClientConfig, o SSHConnectionOptions,
+) SSHConnection {
+	if c.Timeout == 0 {
+		c.Timeout = defaultDialTimeout
+	}
+
+	if o.Backoff == (Backoff{}) {
+		o.Backoff = DefaultBackoff
+	}
+
+	if o.Mode == "" {
+		o.Mode = ConnectionModeLazy
+	}
+
+	return &sshConnection{
+		a:              a,
+		c:              c,
+		via:            via,
+		o:              o,
+		connectLatency: NewHistogram(DialLatencyBuckets),
+	}
 }
 
 func (s *sshConnection) Config() *ssh.ClientConfig {
 	return s.c
 }
 
+func (c *sshConnection) Err() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+
+	return c.lostErr
+}
+
 func (s *sshConnection) Tunnel(c net.Conn, a net.Addr) error {
-	r, err := s.Conn(a)
+	return s.TunnelContext(context.Background(), c, a)
+}
+
+func (s *sshConnection) TunnelContext(ctx context.Context, c net.Conn, a net.Addr) error {
+	start := time.Now()
+	var r net.Conn
+	dial := func() (err error) {
+		r, err = s.dialRemoteConnection(ctx, a)
+		return
+	}
+
+	err := s.attempt(dial)
+	if s.retryable(err) {
+		// while waiting to reconnect, the client may give up
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		w := watchClose(c, cancel)
+		err = s.backoff(ctx, err, dial)
+		c = w.Stop()
+		cancel()
+
+		if err != nil && w.IsClosed() {
+			return fmt.Errorf("canceled, client connection closed: %s", err)
+		}
+	}
+
 	if err != nil {
 		return err
 	}
 
+	observeDial(ctx, start)
+	tunnel(c, r)
+	return nil
+}
+
+func tunnel(c, r net.Conn) {
+	defer r.Close()
+
 	var wg sync.WaitGroup
 	copyConn := func(writer, reader net.Conn) {
 		defer wg.Done()
 		if _, err := io.Copy(writer, reader); err != nil {
-			fmt.Printf("io.Copy error: %s", err)
+			// one of the sides was closed, like when a passage is drained
+			log15.Debug("io.Copy error", "error", err)
+			c.Close()
+			r.Close()
+			return
 		}
+
+		closeWrite(writer)
 	}
 
 	wg.Add(2)
 	go copyConn(c, r)
 	go copyConn(r, c)
 	wg.Wait()
+}
 
-	return nil
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface {
+		CloseWrite() error
+	}); ok {
+		cw.CloseWrite()
+		return
+	}
+
+	c.Close()
 }
 
 func (c *sshConnection) Conn(a net.Addr) (net.Conn, error) {
-	conn, err := c.dialRemoteConnection(a)
+	return c.DialContext(context.Background(), a)
+}
+
+func (c *sshConnection) DialContext(ctx context.Context, a net.Addr) (net.Conn, error) {
+	start := time.Now()
+	var conn net.Conn
+	err := c.retry(ctx, func() (err error) {
+		conn, err = c.dialRemoteConnection(ctx, a)
+		return
+	})
+
 	if err == nil {
-		return conn, nil
+		observeDial(ctx, start)
+	}
+
+	return conn, err
+}
+
+// DialOnce is like DialContext without the retries and the backoff, a lost
+// connection is still reconnected
+func (c *sshConnection) DialOnce(ctx context.Context, a net.Addr) (net.Conn, error) {
+	start := time.Now()
+	var conn net.Conn
+	err := c.attempt(func() (err error) {
+		conn, err = c.dialRemoteConnection(ctx, a)
+		return
+	})
+
+	if err == nil {
+		observeDial(ctx, start)
+	}
+
+	return conn, err
+}
+
+func (c *sshConnection) Listen(a net.Addr) (net.Listener, error) {
+	return c.ListenContext(context.Background(), a)
+}
+
+func (c *sshConnection) ListenContext(ctx context.Context, a net.Addr) (net.Listener, error) {
+	var l net.Listener
+	err := c.retry(ctx, func() (err error) {
+		l, err = c.listenRemote(ctx, a)
+		return
+	})
+
+	return l, err
+}
+
+func (c *sshConnection) retry(ctx context.Context, f func() error) error {
+	err := c.attempt(f)
+	if !c.retryable(err) {
+		return err
+	}
+
+	return c.backoff(ctx, err, f)
+}
+
+// attempt calls f unless the circuit breaker is open, once the breaker timeout
+// expires a single attempt is made, opening it again if it fails.
+func (c *sshConnection) attempt(f func() error) error {
+	c.m.Lock()
+	until, err := c.openUntil, c.tripErr
+	c.m.Unlock()
+
+	if until.IsZero() {
+		return f()
+	}
+
+	if time.Now().Before(until) {
+		return &ServerDownError{Server: c.String(), Until: until, Err: err}
+	}
+
+	if err := f(); err != nil {
+		return c.trip(err)
 	}
 
-	c.connected = false
-	var retries int
-	for range time.Tick(5 * time.Second) {
-		conn, err := c.dialRemoteConnection(a)
-		if err == nil {
-			return conn, nil
+	return nil
+}
+
+func (c *sshConnection) retryable(err error) bool {
+	switch err.(type) {
+	case nil, *HostKeyError, *ServerDownError, *RemoteError:
+		return false
+	}
+
+	return err != context.Canceled && err != context.DeadlineExceeded && err != errIdle
+}
+
+func (c *sshConnection) backoff(ctx context.Context, err error, f func() error) error {
+	start := time.Now()
+	for retry := 0; ; retry++ {
+		elapsed := c.o.Backoff.MaxElapsed > 0 && time.Since(start) >= c.o.Backoff.MaxElapsed
+		if retry >= c.o.Retries || elapsed {
+			return c.trip(fmt.Errorf("%s, after %d retries", err, retry))
 		}
 
-		retries++
-		if retries > c.maxRetries {
-			return nil, fmt.Errorf("%s, after %d retries", err, retries-1)
+		t := time.NewTimer(c.o.Backoff.Delay(retry))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("%s: %s", ctx.Err(), err)
+		case <-t.C:
+		}
+
+		if err = f(); !c.retryable(err) {
+			return err
 		}
 	}
+}
 
-	panic("unrechable")
+// trip opens the circuit breaker if the last dial to the server failed, the
+// errors dialing through a connected server don't mean the server is down.
+func (c *sshConnection) trip(err error) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.client != nil || c.err == nil {
+		return err
+	}
+
+	c.openUntil = time.Now().Add(c.o.Backoff.MaxDelay)
+	c.tripErr = err
+	log15.Warn("ssh server down, failing fast", "server", c, "until", c.openUntil, "error", err)
+	return err
 }
 
-func (c *sshConnection) dialRemoteConnection(a net.Addr) (net.Conn, error) {
-	if err := c.dialServerConnection(); err != nil {
+func (c *sshConnection) dialRemoteConnection(ctx context.Context, a net.Addr) (net.Conn, error) {
+	getClient, release := c.getClient, c.release
+	if c.o.Mode == ConnectionModeOnDemand && ctx.Value(backgroundKey{}) != nil {
+		getClient, release = c.connectedClient, func() {}
+	} else {
+		c.acquire()
+	}
+
+	client, err := getClient(ctx)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	conn, err := dialContext(ctx, client, a)
+	if err != nil && err == ctx.Err() {
+		release()
 		return nil, err
 	}
 
-	conn, err := c.client.Dial(a.Network(), a.String())
 	if err != nil {
+		c.checkClient(client, err)
+		release()
+		if oerr, ok := err.(*ssh.OpenChannelError); ok {
+			return nil, &RemoteError{Err: oerr}
+		}
+
 		return nil, fmt.Errorf("error dialing remote: %s", err)
 	}
 
-	return conn, nil
+	return &usedConn{Conn: conn, release: release}, nil
+}
+
+// errIdle is returned by the background dials of an on-demand connection while
+// it's not connected
+var errIdle = errors.New("ssh server not connected, the connection is idle")
+
+type backgroundKey struct{}
+
+// withBackground marks the dials of ctx as background work, as following the
+// Docker events. In the on-demand mode they don't connect to the server nor
+// keep the client in use, so it's still closed once idle.
+func withBackground(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, true)
+}
+
+// connectedClient returns the client if connected, without dialing the server
+func (c *sshConnection) connectedClient(context.Context) (*ssh.Client, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.client == nil {
+		return nil, errIdle
+	}
+
+	return c.client, nil
+}
+
+// RemoteError is returned when the SSH server refuses to reach the remote, as
+// when nothing listens at it, the connection with the server is fine so it's
+// not retried.
+type RemoteError struct {
+	Err *ssh.OpenChannelError
 }
 
-func (c *sshConnection) dialServerConnection() error {
-	if c.connected {
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("error dialing remote: %s", e.Err)
+}
+
+// dialContext opens a channel with the client, if ctx is done before, the
+// channel is closed once opened
+func dialContext(ctx context.Context, client *ssh.Client, a net.Addr) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	dial := make(chan result, 1)
+	go func() {
+		conn, err := client.Dial(a.Network(), a.String())
+		dial <- result{conn, err}
+	}()
+
+	select {
+	case r := <-dial:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-dial; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+
+		return nil, ctx.Err()
+	}
+}
+
+// listenContext listens on the remote, if ctx is done before, the listener is
+// closed once opened
+func listenContext(ctx context.Context, client *ssh.Client, a net.Addr) (net.Listener, error) {
+	type result struct {
+		l   net.Listener
+		err error
+	}
+
+	listen := make(chan result, 1)
+	go func() {
+		l, err := client.Listen(a.Network(), a.String())
+		listen <- result{l, err}
+	}()
+
+	select {
+	case r := <-listen:
+		return r.l, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-listen; r.l != nil {
+				r.l.Close()
+			}
+		}()
+
+		return nil, ctx.Err()
+	}
+}
+
+func (c *sshConnection) listenRemote(ctx context.Context, a net.Addr) (net.Listener, error) {
+	c.acquire()
+	client, err := c.getClient(ctx)
+	if err != nil {
+		c.release()
+		return nil, err
+	}
+
+	l, err := listenContext(ctx, client, a)
+	if err != nil && err == ctx.Err() {
+		c.release()
+		return nil, err
+	}
+
+	if err != nil {
+		c.checkClient(client, err)
+		c.release()
+		return nil, fmt.Errorf("error listening on remote: %s", err)
+	}
+
+	return &remoteListener{Listener: l, release: c.release}, nil
+}
+
+// acquire marks the client as in use, until release is called
+func (c *sshConnection) acquire() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.active++
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
+	}
+}
+
+func (c *sshConnection) release() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.active--
+	c.checkIdle()
+}
+
+// checkIdle closes the client once unused if the connection is closed, or
+// arms the idle timer in the on-demand mode, c.m must be held
+func (c *sshConnection) checkIdle() {
+	if c.active != 0 || c.client == nil {
+		return
+	}
+
+	if c.closed {
+		c.client.Close()
+		c.client = nil
+		return
+	}
+
+	if c.o.Mode != ConnectionModeOnDemand || c.idle != nil {
+		return
+	}
+
+	client := c.client
+	c.idle = time.AfterFunc(c.o.IdleTimeout, func() { c.closeIdle(client) })
+}
+
+func (c *sshConnection) closeIdle(client *ssh.Client) {
+	c.m.Lock()
+	if c.client != client || c.active != 0 {
+		c.m.Unlock()
+		return
+	}
+
+	c.client = nil
+	c.idle = nil
+	c.idleTimeouts++
+	c.m.Unlock()
+
+	log15.Info("ssh connection idle, closing", "server", c, "idle_timeout", c.o.IdleTimeout)
+	client.Close()
+}
+
+// Close stops using the connection, the client is closed once its tunnels
+// finish, and it's no longer reconnected
+func (c *sshConnection) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.closed = true
+	if c.idle != nil {
+		c.idle.Stop()
+		c.idle = nil
+	}
+
+	c.checkIdle()
+	return nil
+}
+
+type dialCall struct {
+	done   chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+// Connect dials the SSH server, if not connected yet, without retrying
+func (c *sshConnection) Connect(ctx context.Context) error {
+	_, err := c.getClient(ctx)
+	return err
+}
+
+// Disconnect closes the connection to the server, if connected, cutting its
+// tunnels. The server is dialed again on the next use.
+func (c *sshConnection) Disconnect() error {
+	c.m.Lock()
+	client := c.client
+	c.client = nil
+	if client != nil {
+		c.disconnects++
+	}
+
+	c.m.Unlock()
+	if client == nil {
 		return nil
 	}
 
-	c.c.Timeout = time.Second * 5
-	var err error
-	c.client, err = ssh.Dial(c.a.Network(), c.a.String(), c.c)
+	log15.Info("ssh connection closed", "server", c)
+	return client.Close()
+}
+
+// getClient returns the current client, if none is connected a new one is
+// dialed. Concurrent callers wait for the dial in progress and share its
+// result, the dial is not canceled with ctx since it may be shared.
+func (c *sshConnection) getClient(ctx context.Context) (*ssh.Client, error) {
+	c.m.Lock()
+	if c.client != nil {
+		defer c.m.Unlock()
+		return c.client, nil
+	}
+
+	call := c.dialing
+	if call == nil {
+		call = &dialCall{done: make(chan struct{})}
+		c.dialing = call
+		go c.dialClient(call)
+	}
+
+	c.m.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-call.done:
+		return call.client, call.err
+	}
+}
+
+func (c *sshConnection) dialClient(call *dialCall) {
+	start := time.Now()
+	call.client, call.err = c.dialServerConnection()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.client, c.err = call.client, call.err
+	c.dialing = nil
+	close(call.done)
+
+	if call.client == nil {
+		c.dialErrors++
+		c.retryEager(call.err)
+		return
+	}
+
+	c.connects++
+	c.connectLatency.Observe(time.Since(start))
+	c.connectedSince = time.Now()
+	c.openUntil, c.tripErr = time.Time{}, nil
+	c.lostErr = nil
+	c.retries = 0
+	go c.monitor(call.client)
+	c.checkIdle()
+}
+
+// retryEager dials again after the backoff delay in the eager mode, c.m must be
+// held
+func (c *sshConnection) retryEager(err error) {
+	if c.o.Mode != ConnectionModeEager || c.closed {
+		return
+	}
+
+	delay := c.o.Backoff.Delay(c.retries)
+	c.retries++
+	log15.Warn("error connecting, retrying", "server", c, "delay", delay, "error", err)
+	time.AfterFunc(delay, c.reconnect)
+}
+
+// reconnect dials the server in background, unless the connection is closed
+func (c *sshConnection) reconnect() {
+	c.m.Lock()
+	closed := c.closed
+	c.m.Unlock()
+	if closed {
+		return
+	}
+
+	if _, err := c.getClient(context.Background()); err != nil {
+		log15.Error("error reconnecting", "server", c, "error", err)
+	}
+}
+
+// Stats returns the metrics of the connection to the server
+func (c *sshConnection) Stats() ConnectionStats {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	s := ConnectionStats{
+		Connected:      c.client != nil,
+		Connecting:     c.client == nil && c.dialing != nil,
+		Connects:       c.connects,
+		Disconnects:    c.disconnects,
+		IdleTimeouts:   c.idleTimeouts,
+		DialErrors:     c.dialErrors,
+		ConnectLatency: c.connectLatency.Snapshot(),
+	}
+
+	if c.connects > 1 {
+		s.Reconnects = c.connects - 1
+	}
+
+	if s.Connected {
+		s.ConnectedSince = c.connectedSince
+	}
+
+	return s
+}
+
+// monitor waits until the client is closed, sending keepalives meanwhile. If
+// the client was lost, a new one is dialed in background, so the next tunnel
+// doesn't pay the reconnection, except in the on-demand mode.
+func (c *sshConnection) monitor(client *ssh.Client) {
+	done := make(chan struct{})
+	if c.o.KeepAliveInterval > 0 {
+		go c.keepAlive(client, done)
+	}
+
+	err := client.Wait()
+	close(done)
+
+	c.m.Lock()
+	lost := c.client == client
+	if lost {
+		c.client = nil
+		c.lostErr = fmt.Errorf("connection lost: %s", err)
+	}
+
+	onDemand := c.o.Mode == ConnectionModeOnDemand
+	c.m.Unlock()
+	if !lost {
+		return
+	}
+
+	if onDemand {
+		log15.Warn("ssh connection lost", "server", c, "error", err)
+		return
+	}
+
+	log15.Warn("ssh connection lost, reconnecting", "server", c, "error", err)
+	c.reconnect()
+}
+
+func (c *sshConnection) keepAlive(client *ssh.Client, done <-chan struct{}) {
+	t := time.NewTicker(c.o.KeepAliveInterval)
+	defer t.Stop()
+
+	replies := make(chan error, 1)
+	var missed int
+	var pending bool
+	for {
+		select {
+		case <-done:
+			return
+		case err := <-replies:
+			pending = false
+			if err == nil {
+				missed = 0
+			}
+
+			continue
+		case <-t.C:
+		}
+
+		if !pending {
+			pending = true
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				replies <- err
+			}()
+
+			continue
+		}
+
+		missed++
+		if missed >= c.o.KeepAliveMaxMissed {
+			log15.Warn("ssh keepalive timeout, closing connection", "server", c, "missed", missed)
+			client.Close()
+			return
+		}
+	}
+}
+
+// checkClient closes and discards the client if err is not a rejection from
+// the server, like a connection refused by the remote, since in this case the
+// client is still healthy.
+func (c *sshConnection) checkClient(client *ssh.Client, err error) {
+	if _, ok := err.(*ssh.OpenChannelError); ok {
+		return
+	}
+
+	c.m.Lock()
+	if c.client == client {
+		c.client = nil
+	}
+
+	c.m.Unlock()
+	client.Close()
+}
+
+func (c *sshConnection) dialServerConnection() (*ssh.Client, error) {
+	config, hostKeyErr := c.captureHostKeyError()
+	client, err := c.dial(config)
+	if *hostKeyErr != nil {
+		err = *hostKeyErr
+	}
+
+	if _, ok := err.(*HostKeyError); ok {
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error dialing server: %s", err)
+	}
+
+	return client, nil
+}
+
+func (c *sshConnection) dial(config *ssh.ClientConfig) (*ssh.Client, error) {
+	if c.via == nil {
+		return ssh.Dial(c.a.Network(), c.a.String(), config)
+	}
+
+	conn, err := c.via.Conn(c.a)
+	if _, ok := err.(*HostKeyError); ok {
+		return nil, err
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("via %s: %s", c.via, err)
+	}
+
+	sc, chans, reqs, err := ssh.NewClientConn(conn, c.a.String(), config)
 	if err != nil {
-		return fmt.Errorf("error dialing server: %s", err)
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(sc, chans, reqs), nil
+}
+
+// ssh.Dial doesn't preserve the error returned by the HostKeyCallback, so the
+// callback is wrapped to keep the *HostKeyError
+func (c *sshConnection) captureHostKeyError() (*ssh.ClientConfig, *error) {
+	var hostKeyErr error
+	config := *c.c
+	if cb := c.c.HostKeyCallback; cb != nil {
+		config.HostKeyCallback = func(h string, r net.Addr, k ssh.PublicKey) error {
+			err := cb(h, r, k)
+			if _, ok := err.(*HostKeyError); ok {
+				hostKeyErr = err
+			}
+
+			return err
+		}
+	}
+
+	return &config, &hostKeyErr
+}
+
+type closeWatcher struct {
+	c      net.Conn
+	buf    []byte
+	cancel context.CancelFunc
+	closed int32
+	done   chan struct{}
+}
+
+// watchClose reads from c in background to notice when the client closes the
+// connection, calling cancel. The data read, if any, is returned back by Stop
+func watchClose(c net.Conn, cancel context.CancelFunc) *closeWatcher {
+	w := &closeWatcher{
+		c:      c,
+		buf:    make([]byte, 4096),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go w.watch()
+	return w
+}
+
+func (w *closeWatcher) watch() {
+	defer close(w.done)
+
+	n, err := w.c.Read(w.buf)
+	w.buf = w.buf[:n]
+	if err == nil {
+		return
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return
+	}
+
+	atomic.StoreInt32(&w.closed, 1)
+	w.cancel()
+}
+
+func (w *closeWatcher) IsClosed() bool {
+	return atomic.LoadInt32(&w.closed) == 1
+}
+
+func (w *closeWatcher) Stop() net.Conn {
+	w.c.SetReadDeadline(time.Now())
+	<-w.done
+	w.c.SetReadDeadline(time.Time{})
+
+	if len(w.buf) == 0 {
+		return w.c
+	}
+
+	return &bufferedConn{w.c, bufio.NewReader(io.MultiReader(bytes.NewReader(w.buf), w.c))}
+}
+
+type remoteListener struct {
+	net.Listener
+	once    sync.Once
+	release func()
+}
+
+// closing a forward over a lost ssh connection returns io.EOF, the forward is
+// already gone so this is not an error
+func (l *remoteListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(l.release)
+	if err != nil && err != io.EOF {
+		return err
 	}
 
-	c.connected = true
 	return nil
 }
 
+// usedConn is a connection through the client, releasing it once closed
+type usedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *usedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+func (c *usedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Close()
+}
+
 func (c *sshConnection) String() string {
+	if c.via != nil {
+		return fmt.Sprintf("%s@%s via %s", c.c.User, c.a, c.via)
+	}
+
 	return fmt.Sprintf("%s@%s", c.c.User, c.a)
 }
@@ -1,6 +1,11 @@
 package core
 
 import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
 	"golang.org/x/crypto/ssh"
 	. "gopkg.in/check.v1"
 )
@@ -19,3 +24,495 @@ func (s *TunnelSuite) TestString(c *C) {
 
 	c.Assert(ssh.String(), Equals, "root@127.0.0.1:22")
 }
+
+func (s *TunnelSuite) TestStringVia(c *C) {
+	via := NewSSHConnection(
+		MustResolveAddr("tcp", "localhost:22"),
+		&ssh.ClientConfig{User: "root"}, 1,
+	)
+
+	conn := NewSSHConnectionVia(
+		via, NewUnresolvedAddr("tcp", "foo:22"),
+		&ssh.ClientConfig{User: "qux"}, 1,
+	)
+
+	c.Assert(conn.String(), Equals, "qux@foo:22 via root@127.0.0.1:22")
+}
+
+func (s *TunnelSuite) TestConnVia(c *C) {
+	echo := newEchoServer(c)
+	defer echo.Close()
+
+	bastion := newSSHServerFixture(c)
+	defer bastion.Close()
+
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	via := NewSSHConnection(bastion.Addr(), bastion.ClientConfig(), 1)
+	conn := NewSSHConnectionVia(via, server.Addr(), server.ClientConfig(), 1)
+
+	r, err := conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+	assertEchoConn(c, r)
+
+	bastion.CloseConnections()
+
+	r, err = conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+	assertEchoConn(c, r)
+}
+
+func (s *TunnelSuite) TestConnConcurrent(c *C) {
+	echo := newEchoServer(c)
+	defer echo.Close()
+
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	conn := NewSSHConnection(server.Addr(), server.ClientConfig(), 1)
+	burst := func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				r, err := conn.Conn(echo.Addr())
+				c.Check(err, IsNil)
+				if r != nil {
+					r.Close()
+				}
+			}()
+		}
+
+		wg.Wait()
+	}
+
+	burst()
+	c.Assert(server.Handshakes(), Equals, 1)
+
+	server.CloseConnections()
+	burst()
+	c.Assert(server.Handshakes(), Equals, 2)
+}
+
+func (s *TunnelSuite) TestConnRemoteRefusedKeepsClient(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	closed := newEchoServer(c)
+	closed.Close()
+
+	conn := NewSSHConnection(server.Addr(), server.ClientConfig(), 0)
+	echo := newEchoServer(c)
+	defer echo.Close()
+
+	r, err := conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	_, err = conn.(*sshConnection).dialRemoteConnection(context.Background(), closed.Addr())
+	c.Assert(err, NotNil)
+
+	assertEchoConn(c, r)
+	c.Assert(server.Handshakes(), Equals, 1)
+}
+
+func (s *TunnelSuite) TestConnRemoteRefusedNoRetry(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	closed := newEchoServer(c)
+	closed.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		Retries: 3,
+		Backoff: Backoff{InitialDelay: time.Second, MaxDelay: time.Second},
+	})
+
+	start := time.Now()
+	_, err := conn.Conn(closed.Addr())
+	c.Assert(err, FitsTypeOf, &RemoteError{})
+	c.Assert(err, ErrorMatches, "error dialing remote: .*connection refused.*")
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	c.Assert(conn.Err(), IsNil)
+}
+
+func (s *TunnelSuite) TestReconnectInBackground(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	echo := newEchoServer(c)
+	defer echo.Close()
+
+	conn := NewSSHConnection(server.Addr(), server.ClientConfig(), 0)
+	r, err := conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+	r.Close()
+
+	server.CloseConnections()
+	waitHandshakes(c, server, 2)
+
+	r, err = conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+	assertEchoConn(c, r)
+	c.Assert(server.Handshakes(), Equals, 2)
+}
+
+func (s *TunnelSuite) TestConnectDisconnect(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	echo := newEchoServer(c)
+	defer echo.Close()
+
+	conn := NewSSHConnection(server.Addr(), server.ClientConfig(), 0).(*sshConnection)
+	err := conn.Connect(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(server.Handshakes(), Equals, 1)
+	c.Assert(conn.Stats().Connected, Equals, true)
+
+	err = conn.Disconnect()
+	c.Assert(err, IsNil)
+
+	// the connection closed on demand is not dialed again in background
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(server.Handshakes(), Equals, 1)
+
+	stats := conn.Stats()
+	c.Assert(stats.Connected, Equals, false)
+	c.Assert(stats.Disconnects, Equals, uint64(1))
+
+	err = conn.Disconnect()
+	c.Assert(err, IsNil)
+	c.Assert(conn.Stats().Disconnects, Equals, uint64(1))
+
+	r, err := conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+	assertEchoConn(c, r)
+	c.Assert(server.Handshakes(), Equals, 2)
+	c.Assert(conn.Stats().Reconnects, Equals, uint64(1))
+}
+
+func (s *TunnelSuite) TestIdleTimeout(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	echo := newEchoServer(c)
+	defer echo.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		Mode:        ConnectionModeOnDemand,
+		IdleTimeout: 100 * time.Millisecond,
+	}).(*sshConnection)
+
+	r, err := conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+
+	// the client is kept while in use
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(conn.Stats().Connected, Equals, true)
+
+	assertEchoConn(c, r)
+	waitDisconnected(c, conn)
+	c.Assert(conn.Stats().IdleTimeouts, Equals, uint64(1))
+
+	// and not dialed again in background
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(server.Handshakes(), Equals, 1)
+
+	r, err = conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+	assertEchoConn(c, r)
+	c.Assert(server.Handshakes(), Equals, 2)
+}
+
+func (s *TunnelSuite) TestIdleTimeoutConnect(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		Mode:        ConnectionModeOnDemand,
+		IdleTimeout: 100 * time.Millisecond,
+	}).(*sshConnection)
+
+	err := conn.Connect(context.Background())
+	c.Assert(err, IsNil)
+	waitDisconnected(c, conn)
+}
+
+func (s *TunnelSuite) TestIdleTimeoutContainerPassage(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	echo := newEchoServer(c)
+	defer echo.Close()
+
+	docker, socket := newDockerSocketFixture(c, "127.0.0.1")
+	defer docker.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		Mode:        ConnectionModeOnDemand,
+		IdleTimeout: 100 * time.Millisecond,
+	}).(*sshConnection)
+
+	_, port, err := net.SplitHostPort(echo.Addr().String())
+	c.Assert(err, IsNil)
+
+	p := NewPassage(conn, NewContainerRemoteWithEndpoint("tcp", "foo", port, &DockerEndpoint{
+		Address:    "unix://" + socket,
+		APIVersion: "1.40",
+	}))
+
+	err = p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	assertEcho(c, p.Addr())
+	waitDisconnected(c, conn)
+	c.Assert(conn.Stats().IdleTimeouts, Equals, uint64(1))
+}
+
+func (s *TunnelSuite) TestEager(c *C) {
+	server := newSSHServerFixture(c)
+	server.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		Mode:    ConnectionModeEager,
+		Backoff: Backoff{InitialDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond, Multiplier: 2},
+	}).(*sshConnection)
+
+	err := conn.Connect(context.Background())
+	c.Assert(err, NotNil)
+
+	server.Restart(c)
+	defer server.Close()
+	waitHandshakes(c, server, 1)
+
+	server.CloseConnections()
+	waitHandshakes(c, server, 2)
+
+	conn.Close()
+	waitDisconnected(c, conn)
+
+	server.CloseConnections()
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(server.Handshakes(), Equals, 2)
+}
+
+func (s *TunnelSuite) TestClose(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	echo := newEchoServer(c)
+	defer echo.Close()
+
+	conn := NewSSHConnection(server.Addr(), server.ClientConfig(), 0).(*sshConnection)
+	r, err := conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+
+	// the tunnels in use finish before closing the client
+	conn.Close()
+	c.Assert(conn.Stats().Connected, Equals, true)
+
+	assertEchoConn(c, r)
+	c.Assert(conn.Stats().Connected, Equals, false)
+}
+
+func (s *TunnelSuite) TestKeepAlive(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	echo := newEchoServer(c)
+	defer echo.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		KeepAliveInterval:  100 * time.Millisecond,
+		KeepAliveMaxMissed: 3,
+	})
+
+	r, err := conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+	r.Close()
+
+	time.Sleep(500 * time.Millisecond)
+	c.Assert(server.Handshakes(), Equals, 1)
+
+	server.SetStalled(true)
+	waitHandshakes(c, server, 2)
+	server.SetStalled(false)
+
+	r, err = conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+	assertEchoConn(c, r)
+	c.Assert(server.Handshakes(), Equals, 2)
+}
+
+func (s *TunnelSuite) TestKeepAliveDisabled(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	echo := newEchoServer(c)
+	defer echo.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		KeepAliveInterval:  -1,
+		KeepAliveMaxMissed: 3,
+	})
+
+	server.SetStalled(true)
+	r, err := conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+	r.Close()
+
+	time.Sleep(300 * time.Millisecond)
+	c.Assert(server.Handshakes(), Equals, 1)
+	c.Assert(conn.Err(), IsNil)
+}
+
+func (s *TunnelSuite) TestConnServerDown(c *C) {
+	server := newSSHServerFixture(c)
+	server.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		Retries: 2,
+		Backoff: Backoff{InitialDelay: 10 * time.Millisecond, MaxDelay: time.Minute},
+	})
+
+	echo := newEchoServer(c)
+	defer echo.Close()
+
+	_, err := conn.Conn(echo.Addr())
+	c.Assert(err, ErrorMatches, ".*after 2 retries")
+
+	_, err = conn.Conn(echo.Addr())
+	c.Assert(err, FitsTypeOf, &ServerDownError{})
+	c.Assert(err, ErrorMatches, ".*failing fast until .*: .*after 2 retries")
+}
+
+func (s *TunnelSuite) TestListenContextCanceled(c *C) {
+	server := newSSHServerFixture(c)
+	server.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		Retries: 10,
+		Backoff: Backoff{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 2},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := conn.ListenContext(ctx, MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, ErrorMatches, "context deadline exceeded: .*")
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+func (s *TunnelSuite) TestConnLostErr(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	echo := newEchoServer(c)
+	defer echo.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		Mode: ConnectionModeOnDemand,
+	}).(*sshConnection)
+
+	r, err := conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+	defer r.Close()
+	c.Assert(conn.Err(), IsNil)
+
+	server.CloseConnections()
+	waitDisconnected(c, conn)
+	c.Assert(conn.Err(), ErrorMatches, "connection lost: .*")
+
+	r2, err := conn.Conn(echo.Addr())
+	c.Assert(err, IsNil)
+	r2.Close()
+	c.Assert(conn.Err(), IsNil)
+}
+
+func (s *TunnelSuite) TestTunnelClientClosed(c *C) {
+	server := newSSHServerFixture(c)
+	server.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		Retries: 100,
+		Backoff: Backoff{InitialDelay: time.Minute},
+	})
+
+	client, local := net.Pipe()
+	errs := make(chan error)
+	go func() {
+		errs <- conn.Tunnel(local, MustResolveAddr("tcp", "127.0.0.1:80"))
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+
+	select {
+	case err := <-errs:
+		c.Assert(err, ErrorMatches, "canceled, client connection closed: .*")
+	case <-time.After(5 * time.Second):
+		c.Fatalf("tunnel not canceled")
+	}
+}
+
+func (s *TunnelSuite) TestDialContext(c *C) {
+	server := newSSHServerFixture(c)
+	server.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		Retries: 100,
+		Backoff: Backoff{InitialDelay: time.Minute},
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := conn.DialContext(ctx, MustResolveAddr("tcp", "127.0.0.1:80"))
+	c.Assert(err, ErrorMatches, "context deadline exceeded: .*")
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+}
+
+func (s *TunnelSuite) TestWatchCloseKeepsData(c *C) {
+	w := watchClose(newPipeConn(c, []byte("foo")), func() {})
+	time.Sleep(50 * time.Millisecond)
+	r := w.Stop()
+
+	c.Assert(w.IsClosed(), Equals, false)
+	c.Assert(read(c, r, 3), DeepEquals, []byte("foo"))
+}
+
+func newPipeConn(c *C, data []byte) net.Conn {
+	client, local := net.Pipe()
+	go func() {
+		_, err := client.Write(data)
+		c.Check(err, IsNil)
+	}()
+
+	return local
+}
+
+func waitDisconnected(c *C, conn *sshConnection) {
+	for i := 0; i < 300 && conn.Stats().Connected; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(conn.Stats().Connected, Equals, false)
+}
+
+func waitHandshakes(c *C, server *sshServerFixture, n int) {
+	for i := 0; i < 300; i++ {
+		if server.Handshakes() >= n {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Fatalf("expected %d handshakes, got %d", n, server.Handshakes())
+}
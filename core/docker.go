@@ -0,0 +1,226 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultDockerEndpoint = "unix:///var/run/docker.sock"
+	// DockerAPIVersion is the maximum API version used, lower versions are
+	// negotiated with the daemon
+	DockerAPIVersion = "1.41"
+)
+
+// DockerEndpoint is the Docker API as seen from the SSH server
+type DockerEndpoint struct {
+	// Address is `unix://<path>` or `tcp://<host:port>`
+	Address string
+	// APIVersion, if empty is negotiated with the daemon
+	APIVersion string
+	// TLS is used for the tcp endpoints, if not nil
+	TLS *tls.Config
+	// CacheTTL is the time the containers resolved are cached, zero disables
+	// the cache
+	CacheTTL time.Duration
+	// WatchEvents invalidates the cache when the containers are started,
+	// stopped or connected to networks, following the Docker events. They don't
+	// keep an on-demand connection in use.
+	WatchEvents bool
+}
+
+// ParseDockerEndpoint returns the network and address of a Docker endpoint
+func ParseDockerEndpoint(endpoint string) (network, address string, err error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid docker endpoint %q: %s", endpoint, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("invalid docker endpoint %q: missing socket path", endpoint)
+		}
+
+		return "unix", u.Path, nil
+	case "tcp":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return "", "", fmt.Errorf("invalid docker endpoint %q: %s", endpoint, err)
+		}
+
+		return "tcp", u.Host, nil
+	}
+
+	return "", "", fmt.Errorf("invalid docker endpoint %q: unsupported scheme %q", endpoint, u.Scheme)
+}
+
+type dockerClient struct {
+	c       *http.Client
+	base    string
+	version string
+}
+
+func newDockerClient(s SSHConnection, e *DockerEndpoint) (*dockerClient, error) {
+	address := e.Address
+	if address == "" {
+		address = DefaultDockerEndpoint
+	}
+
+	network, address, err := ParseDockerEndpoint(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// the host of the urls is ignored, every request is dialed to the endpoint
+	base := "http://docker"
+	if network == "tcp" && e.TLS != nil {
+		base = "https://" + address
+	}
+
+	return &dockerClient{
+		base:    base,
+		version: e.APIVersion,
+		c: &http.Client{
+			Transport: newSSHTransport(s, NewUnresolvedAddr(network, address), e.TLS, time.Second*2),
+		},
+	}, nil
+}
+
+// newSSHTransport returns a http.Transport dialing a through the SSH connection.
+// The connections are channels of the SSH client, kept alive they would hold it
+// in use after the request, so they are closed once the response is read.
+func newSSHTransport(s SSHConnection, a net.Addr, config *tls.Config, timeout time.Duration) *http.Transport {
+	return &http.Transport{
+		DisableKeepAlives:     true,
+		ResponseHeaderTimeout: timeout,
+		TLSClientConfig:       config,
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return s.DialContext(ctx, a)
+		},
+	}
+}
+
+// negotiate sets the API version to the one of the daemon, if it's lower than
+// DockerAPIVersion
+func (c *dockerClient) negotiate(ctx context.Context) error {
+	if c.version != "" {
+		return nil
+	}
+
+	res, err := c.do(ctx, "/_ping")
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	c.version = DockerAPIVersion
+	if v := res.Header.Get("API-Version"); v != "" && compareVersions(v, DockerAPIVersion) < 0 {
+		c.version = v
+	}
+
+	return nil
+}
+
+func (c *dockerClient) get(ctx context.Context, path string, v interface{}) error {
+	res, err := c.request(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// dockerEventsFilter are the events that may change the IP of a container
+const dockerEventsFilter = `{"type":["container","network"],` +
+	`"event":["start","die","destroy","rename","connect","disconnect"]}`
+
+// events follows the events stream calling f on every event, until ctx is done
+// or the stream fails
+func (c *dockerClient) events(ctx context.Context, f func()) error {
+	res, err := c.request(ctx, "/events?filters="+url.QueryEscape(dockerEventsFilter))
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	d := json.NewDecoder(res.Body)
+	for {
+		var e struct{ Type, Action string }
+		if err := d.Decode(&e); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return fmt.Errorf("docker: %s", err)
+		}
+
+		f()
+	}
+}
+
+func (c *dockerClient) request(ctx context.Context, path string) (*http.Response, error) {
+	if err := c.negotiate(ctx); err != nil {
+		return nil, err
+	}
+
+	res, err := c.do(ctx, fmt.Sprintf("/v%s%s", c.version, path))
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("docker: unexpected status %q from %s", res.Status, path)
+	}
+
+	return res, nil
+}
+
+func (c *dockerClient) do(ctx context.Context, path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("docker: %s", err)
+	}
+
+	return res, nil
+}
+
+// compareVersions compares two API versions, like 1.24 and 1.41
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+
+		if x != y {
+			if x < y {
+				return -1
+			}
+
+			return 1
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,203 @@
+package core
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const DefaultFailbackInterval = 30 * time.Second
+
+// Connector is a SSHConnection able to connect to its server on demand
+type Connector interface {
+	Connect(ctx context.Context) error
+}
+
+// Disconnector is a SSHConnection able to close its connection on demand
+type Disconnector interface {
+	Disconnect() error
+}
+
+// FailoverConnection is a SSHConnection using the first of several connections,
+// the primary, while its server is up. When the server of the active connection
+// fails, after its retries, the next one is used, for the current operation and
+// the following ones. While not using the primary it's checked every interval,
+// failing back to it once it's up again.
+type FailoverConnection struct {
+	conns    []SSHConnection
+	interval time.Duration
+	active   int32
+	checking int32
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewFailoverConnection returns a FailoverConnection, conns[0] is the primary
+// connection and the rest the fallbacks in order
+func NewFailoverConnection(interval time.Duration, conns ...SSHConnection) *FailoverConnection {
+	if interval == 0 {
+		interval = DefaultFailbackInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &FailoverConnection{
+		conns:    conns,
+		interval: interval,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Active returns the index of the connection in use, zero being the primary
+func (f *FailoverConnection) Active() int {
+	return int(atomic.LoadInt32(&f.active))
+}
+
+// ActiveConn returns the connection in use
+func (f *FailoverConnection) ActiveConn() SSHConnection {
+	return f.conns[f.Active()]
+}
+
+func (f *FailoverConnection) Tunnel(c net.Conn, a net.Addr) error {
+	return f.TunnelContext(context.Background(), c, a)
+}
+
+func (f *FailoverConnection) TunnelContext(ctx context.Context, c net.Conn, a net.Addr) error {
+	r, err := f.DialContext(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	tunnel(c, r)
+	return nil
+}
+
+func (f *FailoverConnection) Conn(a net.Addr) (net.Conn, error) {
+	return f.DialContext(context.Background(), a)
+}
+
+func (f *FailoverConnection) DialContext(ctx context.Context, a net.Addr) (net.Conn, error) {
+	var conn net.Conn
+	err := f.try(func(c SSHConnection) (err error) {
+		conn, err = c.DialContext(ctx, a)
+		return
+	})
+
+	return conn, err
+}
+
+func (f *FailoverConnection) Listen(a net.Addr) (net.Listener, error) {
+	return f.ListenContext(context.Background(), a)
+}
+
+func (f *FailoverConnection) ListenContext(ctx context.Context, a net.Addr) (net.Listener, error) {
+	var l net.Listener
+	err := f.try(func(c SSHConnection) (err error) {
+		l, err = c.ListenContext(ctx, a)
+		return
+	})
+
+	return l, err
+}
+
+// try runs op with the active connection, if its server is down the next
+// connections are tried in order, wrapping around
+func (f *FailoverConnection) try(op func(SSHConnection) error) error {
+	active := f.Active()
+
+	var err error
+	for i := 0; i < len(f.conns); i++ {
+		idx := (active + i) % len(f.conns)
+		c := f.conns[idx]
+		err = op(c)
+		if err == nil {
+			f.activate(idx)
+			return nil
+		}
+
+		// the server is up, the error is about the operation
+		if c.Err() == nil {
+			return err
+		}
+
+		log15.Warn("ssh server down, failing over", "server", c, "error", err)
+	}
+
+	return err
+}
+
+func (f *FailoverConnection) activate(idx int) {
+	prev := int(atomic.SwapInt32(&f.active, int32(idx)))
+	if prev == idx {
+		return
+	}
+
+	log15.Info("ssh server switched", "from", f.conns[prev], "to", f.conns[idx])
+	if idx != 0 && atomic.CompareAndSwapInt32(&f.checking, 0, 1) {
+		go f.checkPrimary()
+	}
+}
+
+// checkPrimary connects to the primary every interval, failing back to it
+// once the connection succeeds
+func (f *FailoverConnection) checkPrimary() {
+	defer func() {
+		atomic.StoreInt32(&f.checking, 0)
+
+		// a failover may have happened while finishing
+		if f.Active() != 0 && f.ctx.Err() == nil && atomic.CompareAndSwapInt32(&f.checking, 0, 1) {
+			go f.checkPrimary()
+		}
+	}()
+
+	primary, ok := f.conns[0].(Connector)
+	if !ok {
+		return
+	}
+
+	t := time.NewTicker(f.interval)
+	defer t.Stop()
+
+	for f.Active() != 0 {
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(f.ctx, f.interval)
+		err := primary.Connect(ctx)
+		cancel()
+
+		if err != nil {
+			log15.Debug("primary ssh server still down", "server", f.conns[0], "error", err)
+			continue
+		}
+
+		atomic.StoreInt32(&f.active, 0)
+		log15.Info("ssh server failed back to primary", "server", f.conns[0])
+	}
+}
+
+// Close stops checking the primary connection, the connections are not closed
+func (f *FailoverConnection) Close() error {
+	f.cancel()
+	return nil
+}
+
+func (f *FailoverConnection) Config() *ssh.ClientConfig {
+	return f.ActiveConn().Config()
+}
+
+func (f *FailoverConnection) Err() error {
+	return f.ActiveConn().Err()
+}
+
+func (f *FailoverConnection) String() string {
+	return f.ActiveConn().String()
+}
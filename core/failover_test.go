@@ -0,0 +1,97 @@
+package core
+
+import (
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type FailoverSuite struct {
+	echo     net.Listener
+	primary  *sshServerFixture
+	fallback *sshServerFixture
+}
+
+var _ = Suite(&FailoverSuite{})
+
+func (s *FailoverSuite) SetUpTest(c *C) {
+	s.echo = newEchoServer(c)
+	s.primary = newSSHServerFixture(c)
+	s.fallback = newSSHServerFixture(c)
+}
+
+func (s *FailoverSuite) TearDownTest(c *C) {
+	s.primary.Close()
+	s.fallback.Close()
+	s.echo.Close()
+}
+
+func (s *FailoverSuite) TestFailoverAndFailback(c *C) {
+	f := NewFailoverConnection(50*time.Millisecond, s.newConn(s.primary), s.newConn(s.fallback))
+	defer f.Close()
+
+	s.assertDialEcho(c, f)
+	c.Assert(f.Active(), Equals, 0)
+	c.Assert(s.fallback.Handshakes(), Equals, 0)
+
+	s.primary.Close()
+	s.assertDialEcho(c, f)
+	c.Assert(f.Active(), Equals, 1)
+	c.Assert(f.String(), Equals, f.conns[1].String())
+	c.Assert(s.fallback.Handshakes(), Equals, 1)
+
+	s.assertDialEcho(c, f)
+	c.Assert(f.Active(), Equals, 1)
+
+	s.primary.Restart(c)
+	for i := 0; i < 100 && f.Active() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(f.Active(), Equals, 0)
+	s.assertDialEcho(c, f)
+}
+
+func (s *FailoverSuite) TestDialErrorServerUp(c *C) {
+	f := NewFailoverConnection(0, s.newConn(s.primary), s.newConn(s.fallback))
+	defer f.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	l.Close()
+
+	_, err = f.Conn(MustResolveAddr("tcp", l.Addr().String()))
+	c.Assert(err, NotNil)
+	c.Assert(f.Active(), Equals, 0)
+	c.Assert(s.fallback.Handshakes(), Equals, 0)
+}
+
+func (s *FailoverSuite) TestPassage(c *C) {
+	f := NewFailoverConnection(time.Hour, s.newConn(s.primary), s.newConn(s.fallback))
+
+	p := NewPassage(f, NewRemote("tcp", s.echo.Addr().String()))
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	s.primary.Close()
+	assertEcho(c, p.Addr())
+	c.Assert(f.Active(), Equals, 1)
+}
+
+// newConn returns a connection retrying once, the first dial after the server
+// is closed may use the client not yet noticed as lost
+func (s *FailoverSuite) newConn(ssh *sshServerFixture) SSHConnection {
+	return NewSSHConnectionWithOptions(nil, ssh.Addr(), ssh.ClientConfig(), SSHConnectionOptions{
+		Retries: 1,
+		Backoff: Backoff{InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond},
+	})
+}
+
+func (s *FailoverSuite) assertDialEcho(c *C, f *FailoverConnection) {
+	conn, err := f.Conn(MustResolveAddr("tcp", s.echo.Addr().String()))
+	c.Assert(err, IsNil)
+
+	assertEchoConn(c, conn)
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type DestinationFilter struct {
+	allow []*destinationRule
+	deny  []*destinationRule
+	// networks is set when any rule has a network, the hostnames are
+	// resolved at the SSH server, so they can't be checked against them
+	networks bool
+}
+
+func NewDestinationFilter(allow, deny []string) (*DestinationFilter, error) {
+	f := &DestinationFilter{}
+
+	var err error
+	if f.allow, err = parseDestinationRules(allow); err != nil {
+		return nil, err
+	}
+
+	if f.deny, err = parseDestinationRules(deny); err != nil {
+		return nil, err
+	}
+
+	for _, r := range append(f.allow, f.deny...) {
+		if r.network != nil {
+			f.networks = true
+		}
+	}
+
+	return f, nil
+}
+
+// Allowed returns if the destination is allowed. A hostname may resolve to a
+// denied network, so when there are network rules, a hostname is only allowed
+// by a hostname rule.
+func (f *DestinationFilter) Allowed(host string, port int) bool {
+	if f == nil {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	name := normalizeHostname(host)
+	for _, r := range f.deny {
+		if r.match(ip, name, port) {
+			return false
+		}
+	}
+
+	if ip == nil && f.networks {
+		for _, r := range f.allow {
+			if r.host != "" && r.match(ip, name, port) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	for _, r := range f.allow {
+		if r.match(ip, name, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type destinationRule struct {
+	network *net.IPNet
+	// host is an exact hostname, or a domain and its subdomains if it starts
+	// with `*.`
+	host     string
+	from, to int
+}
+
+func parseDestinationRules(rules []string) ([]*destinationRule, error) {
+	var result []*destinationRule
+	for _, rule := range rules {
+		r, err := parseDestinationRule(rule)
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, r)
+	}
+
+	return result, nil
+}
+
+// the format of a rule is `<cidr|ip|hostname|*.domain|*>[:<port>[-<port>]]`
+func parseDestinationRule(rule string) (*destinationRule, error) {
+	host, ports := rule, ""
+	if slash := strings.Index(rule, "/"); slash != -1 {
+		if colon := strings.Index(rule[slash:], ":"); colon != -1 {
+			host, ports = rule[:slash+colon], rule[slash+colon+1:]
+		}
+	} else if colon := strings.LastIndex(rule, ":"); colon != -1 && strings.Count(rule, ":") == 1 {
+		host, ports = rule[:colon], rule[colon+1:]
+	}
+
+	r := &destinationRule{}
+	if err := r.parsePorts(ports); err != nil {
+		return nil, fmt.Errorf("invalid destination rule %q: %s", rule, err)
+	}
+
+	if host == "*" {
+		return r, nil
+	}
+
+	if !strings.Contains(host, "/") && net.ParseIP(host) == nil {
+		if !validHostname(strings.TrimPrefix(host, "*.")) {
+			return nil, fmt.Errorf("invalid destination rule %q: invalid hostname %q", rule, host)
+		}
+
+		r.host = normalizeHostname(host)
+		return r, nil
+	}
+
+	if !strings.Contains(host, "/") {
+		if ip := net.ParseIP(host); ip.To4() != nil {
+			host += "/32"
+		} else {
+			host += "/128"
+		}
+	}
+
+	var err error
+	if _, r.network, err = net.ParseCIDR(host); err != nil {
+		return nil, fmt.Errorf("invalid destination rule %q: %s", rule, err)
+	}
+
+	return r, nil
+}
+
+func (r *destinationRule) parsePorts(ports string) error {
+	if ports == "" || ports == "*" {
+		return nil
+	}
+
+	from, to := ports, ports
+	if dash := strings.Index(ports, "-"); dash != -1 {
+		from, to = ports[:dash], ports[dash+1:]
+	}
+
+	var err error
+	if r.from, err = strconv.Atoi(from); err != nil {
+		return err
+	}
+
+	if r.to, err = strconv.Atoi(to); err != nil {
+		return err
+	}
+
+	if r.from > r.to {
+		return fmt.Errorf("invalid port range %q", ports)
+	}
+
+	return nil
+}
+
+// hostnames are never matched by rules with network, since they are resolved
+// at the SSH server
+func (r *destinationRule) match(ip net.IP, name string, port int) bool {
+	if r.from != 0 && (port < r.from || port > r.to) {
+		return false
+	}
+
+	switch {
+	case r.network != nil:
+		return ip != nil && r.network.Contains(ip)
+	case r.host != "":
+		return ip == nil && matchHostname(r.host, name)
+	default:
+		return true
+	}
+}
+
+func matchHostname(pattern, name string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(name, pattern[1:])
+	}
+
+	return name == pattern
+}
+
+func normalizeHostname(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func validHostname(host string) bool {
+	if host == "" {
+		return false
+	}
+
+	for _, r := range host {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '.', r == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
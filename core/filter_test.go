@@ -0,0 +1,86 @@
+package core
+
+import . "gopkg.in/check.v1"
+
+type FilterSuite struct{}
+
+var _ = Suite(&FilterSuite{})
+
+func (s *FilterSuite) TestAllowedNil(c *C) {
+	var f *DestinationFilter
+	c.Assert(f.Allowed("10.0.0.1", 22), Equals, true)
+}
+
+func (s *FilterSuite) TestAllowed(c *C) {
+	f, err := NewDestinationFilter(
+		[]string{"10.0.0.0/8", "192.168.1.1:22", "*:443", "example.com:443", "fd00::/8:80-90"},
+		[]string{"10.0.0.1", "10.0.0.0/8:25"},
+	)
+
+	c.Assert(err, IsNil)
+	c.Assert(f.Allowed("10.1.2.3", 80), Equals, true)
+	c.Assert(f.Allowed("10.0.0.1", 80), Equals, false)
+	c.Assert(f.Allowed("10.1.2.3", 25), Equals, false)
+	c.Assert(f.Allowed("192.168.1.1", 22), Equals, true)
+	c.Assert(f.Allowed("192.168.1.1", 23), Equals, false)
+	c.Assert(f.Allowed("example.com", 443), Equals, true)
+	c.Assert(f.Allowed("example.com", 80), Equals, false)
+	c.Assert(f.Allowed("example.org", 443), Equals, false)
+	c.Assert(f.Allowed("fd00::1", 85), Equals, true)
+	c.Assert(f.Allowed("fd00::1", 91), Equals, false)
+}
+
+func (s *FilterSuite) TestAllowedDenyOnly(c *C) {
+	f, err := NewDestinationFilter(nil, []string{"*:25"})
+	c.Assert(err, IsNil)
+	c.Assert(f.Allowed("10.1.2.3", 80), Equals, true)
+	c.Assert(f.Allowed("example.com", 25), Equals, false)
+}
+
+func (s *FilterSuite) TestAllowedHostnameDeniedNetwork(c *C) {
+	f, err := NewDestinationFilter(nil, []string{"10.0.0.0/8"})
+	c.Assert(err, IsNil)
+	c.Assert(f.Allowed("10.1.2.3", 80), Equals, false)
+	c.Assert(f.Allowed("192.168.1.1", 80), Equals, true)
+	c.Assert(f.Allowed("internal.example.com", 80), Equals, false)
+	c.Assert(f.Allowed("localhost", 80), Equals, false)
+}
+
+func (s *FilterSuite) TestAllowedHostname(c *C) {
+	f, err := NewDestinationFilter(
+		[]string{"*", "example.com:443", "*.example.org"},
+		[]string{"10.0.0.0/8", "admin.example.org"},
+	)
+
+	c.Assert(err, IsNil)
+	c.Assert(f.Allowed("192.168.1.1", 80), Equals, true)
+	c.Assert(f.Allowed("10.1.2.3", 80), Equals, false)
+	c.Assert(f.Allowed("Example.com.", 443), Equals, true)
+	c.Assert(f.Allowed("example.com", 80), Equals, false)
+	c.Assert(f.Allowed("www.example.org", 80), Equals, true)
+	c.Assert(f.Allowed("example.org", 80), Equals, false)
+	c.Assert(f.Allowed("admin.example.org", 80), Equals, false)
+	c.Assert(f.Allowed("internal.corp", 80), Equals, false)
+}
+
+func (s *FilterSuite) TestAllowedHostnameOnly(c *C) {
+	f, err := NewDestinationFilter([]string{"*:443"}, []string{"*.internal"})
+	c.Assert(err, IsNil)
+	c.Assert(f.Allowed("example.com", 443), Equals, true)
+	c.Assert(f.Allowed("foo.internal", 443), Equals, false)
+	c.Assert(f.Allowed("10.1.2.3", 443), Equals, true)
+}
+
+func (s *FilterSuite) TestNewDestinationFilterErrors(c *C) {
+	_, err := NewDestinationFilter([]string{"10.0.0.0/33"}, nil)
+	c.Assert(err, ErrorMatches, `invalid destination rule "10.0.0.0/33": .*`)
+
+	_, err = NewDestinationFilter(nil, []string{"*:foo"})
+	c.Assert(err, ErrorMatches, `invalid destination rule "\*:foo": .*`)
+
+	_, err = NewDestinationFilter(nil, []string{"*:90-80"})
+	c.Assert(err, ErrorMatches, `invalid destination rule "\*:90-80": .*`)
+
+	_, err = NewDestinationFilter(nil, []string{"foo bar"})
+	c.Assert(err, ErrorMatches, `invalid destination rule "foo bar": invalid hostname .*`)
+}
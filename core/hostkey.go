@@ -0,0 +1,161 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const (
+	HostKeyCheckingYes       = "yes"
+	HostKeyCheckingNo        = "no"
+	HostKeyCheckingAcceptNew = "accept-new"
+)
+
+type HostKeyError struct {
+	Address     string
+	Fingerprint string
+	Reason      string
+}
+
+func (err *HostKeyError) Error() string {
+	return fmt.Sprintf(
+		"host key verification failed for %s (%s): %s",
+		err.Address, err.Fingerprint, err.Reason,
+	)
+}
+
+type HostKeyVerifier struct {
+	address    string
+	knownHosts []string
+	pinned     []string
+	strict     string
+
+	sync.Mutex
+}
+
+func NewHostKeyVerifier(address string, knownHosts, pinned []string, strict string) *HostKeyVerifier {
+	return &HostKeyVerifier{
+		address:    address,
+		knownHosts: knownHosts,
+		pinned:     pinned,
+		strict:     strict,
+	}
+}
+
+func (v *HostKeyVerifier) Check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if v.strict == HostKeyCheckingNo {
+		return nil
+	}
+
+	if len(v.pinned) != 0 {
+		return v.checkPinned(key)
+	}
+
+	return v.checkKnownHosts(remote, key)
+}
+
+func (v *HostKeyVerifier) checkPinned(key ssh.PublicKey) error {
+	sha256 := ssh.FingerprintSHA256(key)
+	md5 := ssh.FingerprintLegacyMD5(key)
+	for _, fp := range v.pinned {
+		if fp == sha256 || strings.TrimPrefix(fp, "MD5:") == md5 {
+			return nil
+		}
+	}
+
+	return v.newError(key, "host key does not match any pinned host_key")
+}
+
+func (v *HostKeyVerifier) checkKnownHosts(remote net.Addr, key ssh.PublicKey) error {
+	v.Lock()
+	defer v.Unlock()
+
+	files := v.existingKnownHosts()
+	if len(files) != 0 {
+		cb, err := knownhosts.New(files...)
+		if err != nil {
+			return fmt.Errorf("error reading known_hosts: %s", err)
+		}
+
+		err = cb(v.address, remote, key)
+		switch e := err.(type) {
+		case nil:
+			return nil
+		case *knownhosts.RevokedError:
+			return v.newError(key, fmt.Sprintf(
+				"host key is revoked at %s:%d", e.Revoked.Filename, e.Revoked.Line,
+			))
+		case *knownhosts.KeyError:
+			if len(e.Want) != 0 {
+				return v.newError(key, fmt.Sprintf(
+					"host key mismatch, expected the key at %s:%d",
+					e.Want[0].Filename, e.Want[0].Line,
+				))
+			}
+		default:
+			return err
+		}
+	}
+
+	if v.strict != HostKeyCheckingAcceptNew {
+		return v.newError(key, "host is not in known_hosts")
+	}
+
+	return v.addKnownHost(key)
+}
+
+func (v *HostKeyVerifier) existingKnownHosts() []string {
+	var files []string
+	for _, f := range v.knownHosts {
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+
+	return files
+}
+
+func (v *HostKeyVerifier) addKnownHost(key ssh.PublicKey) error {
+	if len(v.knownHosts) == 0 {
+		return v.newError(key, "host is unknown and no known_hosts file is configured")
+	}
+
+	file := v.knownHosts[0]
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	line := knownhosts.Line([]string{knownhosts.Normalize(v.address)}, key)
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		return err
+	}
+
+	log15.Info(
+		"new host key added to known_hosts",
+		"address", v.address, "fingerprint", ssh.FingerprintSHA256(key), "file", file,
+	)
+
+	return nil
+}
+
+func (v *HostKeyVerifier) newError(key ssh.PublicKey, reason string) error {
+	return &HostKeyError{
+		Address:     v.address,
+		Fingerprint: ssh.FingerprintSHA256(key),
+		Reason:      reason,
+	}
+}
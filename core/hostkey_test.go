@@ -0,0 +1,117 @@
+package core
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	. "gopkg.in/check.v1"
+)
+
+type HostKeySuite struct {
+	dir    string
+	key    ssh.PublicKey
+	remote net.Addr
+}
+
+var _ = Suite(&HostKeySuite{})
+
+func (s *HostKeySuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.key = newPublicKey(c)
+	s.remote = MustResolveAddr("tcp", "127.0.0.1:22")
+}
+
+func (s *HostKeySuite) writeKnownHosts(c *C, key ssh.PublicKey) string {
+	file := filepath.Join(s.dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("foo:22")}, key)
+	err := ioutil.WriteFile(file, []byte(line+"\n"), 0600)
+	c.Assert(err, IsNil)
+
+	return file
+}
+
+func (s *HostKeySuite) TestCheckKnownHosts(c *C) {
+	file := s.writeKnownHosts(c, s.key)
+	v := NewHostKeyVerifier("foo:22", []string{file}, nil, HostKeyCheckingYes)
+	c.Assert(v.Check("", s.remote, s.key), IsNil)
+}
+
+func (s *HostKeySuite) TestCheckKnownHostsMismatch(c *C) {
+	file := s.writeKnownHosts(c, newPublicKey(c))
+	v := NewHostKeyVerifier("foo:22", []string{file}, nil, HostKeyCheckingAcceptNew)
+
+	err := v.Check("", s.remote, s.key)
+	c.Assert(err, FitsTypeOf, &HostKeyError{})
+	c.Assert(err, ErrorMatches, ".*host key mismatch, expected the key at .*known_hosts:1")
+}
+
+func (s *HostKeySuite) TestCheckKnownHostsUnknown(c *C) {
+	file := s.writeKnownHosts(c, s.key)
+	v := NewHostKeyVerifier("bar:22", []string{file}, nil, HostKeyCheckingYes)
+
+	err := v.Check("", s.remote, s.key)
+	c.Assert(err, FitsTypeOf, &HostKeyError{})
+	c.Assert(err, ErrorMatches, ".*host is not in known_hosts")
+}
+
+func (s *HostKeySuite) TestCheckKnownHostsAcceptNew(c *C) {
+	file := filepath.Join(s.dir, "ssh", "known_hosts")
+	v := NewHostKeyVerifier("foo:22", []string{file}, nil, HostKeyCheckingAcceptNew)
+	c.Assert(v.Check("", s.remote, s.key), IsNil)
+
+	v = NewHostKeyVerifier("foo:22", []string{file}, nil, HostKeyCheckingYes)
+	c.Assert(v.Check("", s.remote, s.key), IsNil)
+
+	err := v.Check("", s.remote, newPublicKey(c))
+	c.Assert(err, FitsTypeOf, &HostKeyError{})
+}
+
+func (s *HostKeySuite) TestCheckNo(c *C) {
+	v := NewHostKeyVerifier("foo:22", nil, []string{"SHA256:foo"}, HostKeyCheckingNo)
+	c.Assert(v.Check("", s.remote, s.key), IsNil)
+}
+
+func (s *HostKeySuite) TestCheckPinned(c *C) {
+	v := NewHostKeyVerifier("foo:22", nil, []string{ssh.FingerprintSHA256(s.key)}, HostKeyCheckingYes)
+	c.Assert(v.Check("", s.remote, s.key), IsNil)
+
+	v = NewHostKeyVerifier("foo:22", nil, []string{"MD5:" + ssh.FingerprintLegacyMD5(s.key)}, HostKeyCheckingYes)
+	c.Assert(v.Check("", s.remote, s.key), IsNil)
+
+	err := v.Check("", s.remote, newPublicKey(c))
+	c.Assert(err, ErrorMatches, ".*host key does not match any pinned host_key")
+}
+
+func (s *HostKeySuite) TestConnHostKeyError(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	config := server.ClientConfig()
+	config.HostKeyCallback = NewHostKeyVerifier(
+		"foo:22", nil, []string{"SHA256:foo"}, HostKeyCheckingYes,
+	).Check
+
+	conn := NewSSHConnection(server.Addr(), config, 3)
+
+	start := time.Now()
+	_, err := conn.Conn(server.Addr())
+	c.Assert(err, FitsTypeOf, &HostKeyError{})
+	c.Assert(conn.Err(), Equals, err)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+func newPublicKey(c *C) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+
+	key, err := ssh.NewPublicKey(pub)
+	c.Assert(err, IsNil)
+
+	return key
+}
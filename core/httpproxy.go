@@ -0,0 +1,223 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+type HTTPProxy struct {
+	users  map[string]string
+	filter *DestinationFilter
+}
+
+func NewHTTPProxy(users map[string]string, f *DestinationFilter) *HTTPProxy {
+	return &HTTPProxy{users: users, filter: f}
+}
+
+func (p *HTTPProxy) Handle(c net.Conn, s SSHConnection) error {
+	return p.HandleContext(context.Background(), c, s)
+}
+
+func (p *HTTPProxy) HandleContext(ctx context.Context, c net.Conn, s SSHConnection) error {
+	br := bufio.NewReader(c)
+	t := p.buildTransport(s)
+	defer t.CloseIdleConnections()
+
+	for {
+		req, err := http.ReadRequest(br)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !p.authorized(req) {
+			writeHTTPError(c, http.StatusProxyAuthRequired, "proxy authentication required")
+			return nil
+		}
+
+		if req.Method == "CONNECT" {
+			return p.handleConnect(ctx, &bufferedConn{c, br}, req, s)
+		}
+
+		keepAlive, err := p.handleRequest(ctx, c, req, t)
+		if err != nil || !keepAlive {
+			return err
+		}
+	}
+}
+
+func (p *HTTPProxy) handleConnect(ctx context.Context, c net.Conn, req *http.Request, s SSHConnection) error {
+	host, port, err := splitHostPort(req.Host, "443")
+	if err != nil {
+		writeHTTPError(c, http.StatusBadRequest, err.Error())
+		return err
+	}
+
+	if !p.filter.Allowed(host, port) {
+		writeHTTPError(c, http.StatusForbidden, "destination not allowed")
+		return fmt.Errorf("http-proxy: destination %s not allowed", req.Host)
+	}
+
+	r, err := dialOnce(ctx, s, &netAddr{"tcp", net.JoinHostPort(host, strconv.Itoa(port))})
+	if err != nil {
+		writeHTTPError(c, http.StatusBadGateway, err.Error())
+		return err
+	}
+
+	if _, err := io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		r.Close()
+		return err
+	}
+
+	tunnel(c, r)
+	return nil
+}
+
+func (p *HTTPProxy) handleRequest(ctx context.Context, c net.Conn, req *http.Request, t *http.Transport) (bool, error) {
+	if !req.URL.IsAbs() || req.URL.Scheme != "http" {
+		writeHTTPError(c, http.StatusBadRequest, "only absolute http URIs are supported")
+		return false, fmt.Errorf("http-proxy: invalid request URI %q", req.RequestURI)
+	}
+
+	host, port, err := splitHostPort(req.URL.Host, "80")
+	if err != nil {
+		writeHTTPError(c, http.StatusBadRequest, err.Error())
+		return false, err
+	}
+
+	if !p.filter.Allowed(host, port) {
+		writeHTTPError(c, http.StatusForbidden, "destination not allowed")
+		return false, fmt.Errorf("http-proxy: destination %s not allowed", req.URL.Host)
+	}
+
+	keepAlive := !req.Close
+	req.RequestURI = ""
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+
+	res, err := t.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		writeHTTPError(c, http.StatusBadGateway, err.Error())
+		return false, err
+	}
+
+	defer res.Body.Close()
+	for _, h := range hopHeaders {
+		res.Header.Del(h)
+	}
+
+	res.Close = !keepAlive
+	if err := res.Write(c); err != nil {
+		return false, err
+	}
+
+	return keepAlive, nil
+}
+
+// buildTransport returns the transport of the requests, the destinations are
+// dialed once, as CONNECT does, replying the failure to the client right away
+func (p *HTTPProxy) buildTransport(s SSHConnection) *http.Transport {
+	return &http.Transport{
+		ResponseHeaderTimeout: time.Second * 30,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialOnce(ctx, s, &netAddr{network, address})
+		},
+	}
+}
+
+func (p *HTTPProxy) authorized(req *http.Request) bool {
+	if len(p.users) == 0 {
+		return true
+	}
+
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(auth[len("Basic "):])
+	if err != nil {
+		return false
+	}
+
+	parts := strings.SplitN(string(payload), ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	expected, ok := p.users[parts[0]]
+	return ok && expected == parts[1]
+}
+
+func (p *HTTPProxy) String() string {
+	return "http-proxy"
+}
+
+func splitHostPort(hostport, defaultPort string) (string, int, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, defaultPort
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q", port)
+	}
+
+	return host, n, nil
+}
+
+func writeHTTPError(w io.Writer, code int, msg string) {
+	res := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain"}},
+		Body:          ioutil.NopCloser(strings.NewReader(msg + "\n")),
+		ContentLength: int64(len(msg) + 1),
+		Close:         true,
+	}
+
+	if code == http.StatusProxyAuthRequired {
+		res.Header.Set("Proxy-Authenticate", `Basic realm="passage"`)
+	}
+
+	res.Write(w)
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Conn.Close()
+}
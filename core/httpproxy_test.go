@@ -0,0 +1,206 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type HTTPProxySuite struct {
+	echo net.Listener
+	ssh  *sshServerFixture
+	web  *httptest.Server
+}
+
+var _ = Suite(&HTTPProxySuite{})
+
+func (s *HTTPProxySuite) SetUpTest(c *C) {
+	s.echo = newEchoServer(c)
+	s.ssh = newSSHServerFixture(c)
+	s.web = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}))
+}
+
+func (s *HTTPProxySuite) TearDownTest(c *C) {
+	s.web.Close()
+	s.ssh.Close()
+	s.echo.Close()
+}
+
+func (s *HTTPProxySuite) startPassage(c *C, proxy *HTTPProxy) *Passage {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewProxyPassage(conn, proxy)
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+
+	return p
+}
+
+func (s *HTTPProxySuite) client(p *Passage, user *url.Userinfo) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: p.Addr(), User: user}),
+	}}
+}
+
+func (s *HTTPProxySuite) TestRequest(c *C) {
+	p := s.startPassage(c, NewHTTPProxy(nil, nil))
+	defer p.Close()
+
+	client := s.client(p, nil)
+	for _, path := range []string{"/foo", "/bar"} {
+		res, err := client.Get(s.web.URL + path)
+		c.Assert(err, IsNil)
+
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, IsNil)
+		c.Assert(string(body), Equals, "GET "+path)
+	}
+}
+
+func (s *HTTPProxySuite) TestRequestAuth(c *C) {
+	p := s.startPassage(c, NewHTTPProxy(map[string]string{"foo": "bar"}, nil))
+	defer p.Close()
+
+	res, err := s.client(p, nil).Get(s.web.URL)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusProxyAuthRequired)
+	c.Assert(res.Header.Get("Proxy-Authenticate"), Equals, `Basic realm="passage"`)
+
+	res, err = s.client(p, url.UserPassword("foo", "bar")).Get(s.web.URL)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+}
+
+func (s *HTTPProxySuite) TestRequestNotAllowed(c *C) {
+	f, err := NewDestinationFilter(nil, []string{"127.0.0.1"})
+	c.Assert(err, IsNil)
+
+	p := s.startPassage(c, NewHTTPProxy(nil, f))
+	defer p.Close()
+
+	res, err := s.client(p, nil).Get(s.web.URL)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *HTTPProxySuite) TestRequestHostnameNotAllowed(c *C) {
+	f, err := NewDestinationFilter(nil, []string{"127.0.0.0/8"})
+	c.Assert(err, IsNil)
+
+	p := s.startPassage(c, NewHTTPProxy(nil, f))
+	defer p.Close()
+
+	u, err := url.Parse(s.web.URL)
+	c.Assert(err, IsNil)
+	u.Host = net.JoinHostPort("localhost", u.Port())
+
+	res, err := s.client(p, nil).Get(u.String())
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *HTTPProxySuite) TestConnectHostnameNotAllowed(c *C) {
+	f, err := NewDestinationFilter(nil, []string{"127.0.0.0/8"})
+	c.Assert(err, IsNil)
+
+	p := s.startPassage(c, NewHTTPProxy(nil, f))
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.Addr())
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	_, port, err := net.SplitHostPort(s.echo.Addr().String())
+	c.Assert(err, IsNil)
+
+	fmt.Fprintf(conn, "CONNECT localhost:%s HTTP/1.1\r\nHost: localhost:%[1]s\r\n\r\n", port)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusForbidden)
+}
+
+func (s *HTTPProxySuite) TestConnect(c *C) {
+	p := s.startPassage(c, NewHTTPProxy(nil, nil))
+	defer p.Close()
+
+	conn, err := net.Dial("tcp", p.Addr())
+	c.Assert(err, IsNil)
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", s.echo.Addr())
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	write(c, conn, []byte("foo")...)
+	conn.(*net.TCPConn).CloseWrite()
+
+	content, err := ioutil.ReadAll(br)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, "foo")
+	conn.Close()
+}
+
+func (s *HTTPProxySuite) TestConnectContextCanceled(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	client, server := net.Pipe()
+	defer client.Close()
+
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	go NewHTTPProxy(nil, nil).HandleContext(ctx, server, conn)
+
+	fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", s.echo.Addr())
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusBadGateway)
+
+	body, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Matches, "(?s).*context canceled.*")
+}
+
+func (s *HTTPProxySuite) TestServerDown(c *C) {
+	s.ssh.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, s.ssh.Addr(), s.ssh.ClientConfig(), SSHConnectionOptions{
+		Retries: 3,
+		Backoff: Backoff{InitialDelay: time.Second, MaxDelay: time.Second},
+	})
+
+	p := NewProxyPassage(conn, NewHTTPProxy(nil, nil))
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	// the failures are replied without waiting for the backoff
+	start := time.Now()
+	res, err := s.client(p, nil).Get(s.web.URL + "/foo")
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusBadGateway)
+
+	client, err := net.Dial("tcp", p.Addr())
+	c.Assert(err, IsNil)
+	defer client.Close()
+
+	fmt.Fprintf(client, "CONNECT %s HTTP/1.1\r\nHost: %[1]s\r\n\r\n", s.echo.Addr())
+	res, err = http.ReadResponse(bufio.NewReader(client), nil)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusBadGateway)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
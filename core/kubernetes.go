@@ -0,0 +1,458 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KubernetesEndpoint is the Kubernetes API server as seen from the SSH server
+type KubernetesEndpoint struct {
+	// Address of the API server, eg `https://10.0.0.1:6443`
+	Address string
+	// Token is the bearer token, if empty the client certificates of the TLS
+	// config are used
+	Token string
+	// TLS is used for the https addresses, if not nil
+	TLS *tls.Config
+	// CacheTTL is the time the pods and services resolved are cached, zero
+	// disables the cache
+	CacheTTL time.Duration
+}
+
+// KubernetesSelector selects a pod or a service, only one of Pod, Labels,
+// Deployment or Service must be set
+type KubernetesSelector struct {
+	// Namespace, by default `default`
+	Namespace string
+	// Pod is the name of the pod
+	Pod string
+	// Labels is a label selector of pods, eg `app=web,tier=frontend`
+	Labels string
+	// Deployment is the name of deployment owning the pods
+	Deployment string
+	// Service is the name of a service, its cluster IP is used
+	Service string
+	// Policy used when several pods match, like ContainerSelector.Policy
+	Policy string
+}
+
+func (s *KubernetesSelector) namespace() string {
+	if s.Namespace == "" {
+		return "default"
+	}
+
+	return s.Namespace
+}
+
+func (s *KubernetesSelector) String() string {
+	switch {
+	case s.Pod != "":
+		return fmt.Sprintf("pod/%s/%s", s.namespace(), s.Pod)
+	case s.Deployment != "":
+		return fmt.Sprintf("deployment/%s/%s", s.namespace(), s.Deployment)
+	case s.Service != "":
+		return fmt.Sprintf("service/%s/%s", s.namespace(), s.Service)
+	}
+
+	return fmt.Sprintf("pod/%s?%s", s.namespace(), s.Labels)
+}
+
+type kubernetesRemote struct {
+	selector KubernetesSelector
+	port     string
+	endpoint KubernetesEndpoint
+	next     uint32
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// m guards the client, the resolution cache and the last address
+	m         sync.Mutex
+	address   string
+	client    *kubernetesClient
+	conn      SSHConnection
+	addresses []string
+	expires   time.Time
+	lookup    *lookupCall
+}
+
+// NewKubernetesRemote returns a remote connecting to the port of a pod or a
+// service, the port can be a number or the name of a port of the pod or the
+// service
+func NewKubernetesRemote(s *KubernetesSelector, port string, e *KubernetesEndpoint) Remote {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &kubernetesRemote{
+		selector: *s,
+		port:     port,
+		endpoint: *e,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func (r *kubernetesRemote) Addr(s SSHConnection) (net.Addr, error) {
+	return r.AddrContext(context.Background(), s)
+}
+
+func (r *kubernetesRemote) AddrContext(ctx context.Context, s SSHConnection) (net.Addr, error) {
+	addresses, err := r.resolve(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	address := r.pick(addresses)
+
+	r.m.Lock()
+	r.address = address
+	r.m.Unlock()
+
+	return net.ResolveTCPAddr("tcp", address)
+}
+
+// resolve returns the addresses of the pods or the service from the cache, if
+// not expired, or from an in-flight lookup shared with the other callers
+func (r *kubernetesRemote) resolve(ctx context.Context, s SSHConnection) ([]string, error) {
+	r.m.Lock()
+	if r.addresses != nil && time.Now().Before(r.expires) {
+		addresses := r.addresses
+		r.m.Unlock()
+		return addresses, nil
+	}
+
+	call := r.lookup
+	if call == nil {
+		call = &lookupCall{done: make(chan struct{})}
+		r.lookup = call
+		go r.doLookup(s, call)
+	}
+	r.m.Unlock()
+
+	select {
+	case <-call.done:
+		return call.ips, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *kubernetesRemote) doLookup(s SSHConnection, call *lookupCall) {
+	defer close(call.done)
+
+	c, err := r.getClient(s)
+	if err == nil {
+		call.ips, call.err = r.getAddresses(r.ctx, c)
+	} else {
+		call.err = err
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.lookup = nil
+	if call.err == nil && r.endpoint.CacheTTL > 0 {
+		r.addresses, r.expires = call.ips, time.Now().Add(r.endpoint.CacheTTL)
+	}
+}
+
+// getClient returns the client of the API through s, built once per
+// connection
+func (r *kubernetesRemote) getClient(s SSHConnection) (*kubernetesClient, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.client != nil && r.conn == s {
+		return r.client, nil
+	}
+
+	c, err := newKubernetesClient(s, &r.endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	r.client, r.conn = c, s
+	return c, nil
+}
+
+func (r *kubernetesRemote) getAddresses(ctx context.Context, c *kubernetesClient) ([]string, error) {
+	if r.selector.Service != "" {
+		address, err := r.getServiceAddress(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+
+		return []string{address}, nil
+	}
+
+	return r.getPodAddresses(ctx, c)
+}
+
+// Close stops the in-flight lookups
+func (r *kubernetesRemote) Close() error {
+	r.cancel()
+	return nil
+}
+
+type kubernetesPort struct {
+	Name          string
+	Port          int
+	ContainerPort int
+}
+
+type kubernetesService struct {
+	Spec struct {
+		ClusterIP string
+		Ports     []kubernetesPort
+	}
+}
+
+func (r *kubernetesRemote) getServiceAddress(ctx context.Context, c *kubernetesClient) (string, error) {
+	var svc kubernetesService
+	path := fmt.Sprintf("/api/v1/namespaces/%s/services/%s", r.selector.namespace(), r.selector.Service)
+	if err := c.get(ctx, path, &svc); err != nil {
+		return "", err
+	}
+
+	if svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == "None" {
+		return "", fmt.Errorf("kubernetes: %s has no cluster IP", &r.selector)
+	}
+
+	port, err := r.resolvePort(svc.Spec.Ports, func(p kubernetesPort) int { return p.Port })
+	if err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(svc.Spec.ClusterIP, port), nil
+}
+
+type kubernetesPod struct {
+	Metadata struct {
+		Name string
+	}
+	Spec struct {
+		Containers []struct {
+			Ports []kubernetesPort
+		}
+	}
+	Status struct {
+		Phase string
+		PodIP string
+	}
+}
+
+func (p *kubernetesPod) ports() []kubernetesPort {
+	var ports []kubernetesPort
+	for _, c := range p.Spec.Containers {
+		ports = append(ports, c.Ports...)
+	}
+
+	return ports
+}
+
+// getPodAddresses returns the addresses of the running pods, sorted by name,
+// the pods without the port are skipped
+func (r *kubernetesRemote) getPodAddresses(ctx context.Context, c *kubernetesClient) ([]string, error) {
+	pods, err := r.getPods(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	var running []*kubernetesPod
+	for _, p := range pods {
+		if p.Status.Phase == "Running" && p.Status.PodIP != "" {
+			running = append(running, p)
+		}
+	}
+
+	if len(running) == 0 {
+		return nil, fmt.Errorf("kubernetes: %s has no running pods", &r.selector)
+	}
+
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].Metadata.Name < running[j].Metadata.Name
+	})
+
+	var addresses []string
+	for _, pod := range running {
+		port, perr := r.resolvePort(pod.ports(), func(p kubernetesPort) int { return p.ContainerPort })
+		if perr != nil {
+			err = perr
+			continue
+		}
+
+		addresses = append(addresses, net.JoinHostPort(pod.Status.PodIP, port))
+	}
+
+	if len(addresses) == 0 {
+		return nil, err
+	}
+
+	return addresses, nil
+}
+
+func (r *kubernetesRemote) getPods(ctx context.Context, c *kubernetesClient) ([]*kubernetesPod, error) {
+	ns := r.selector.namespace()
+	if r.selector.Pod != "" {
+		pod := &kubernetesPod{}
+		path := fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", ns, r.selector.Pod)
+		if err := c.get(ctx, path, pod); err != nil {
+			return nil, err
+		}
+
+		return []*kubernetesPod{pod}, nil
+	}
+
+	labels := r.selector.Labels
+	if r.selector.Deployment != "" {
+		var err error
+		if labels, err = r.getDeploymentSelector(ctx, c); err != nil {
+			return nil, err
+		}
+	}
+
+	var list struct {
+		Items []*kubernetesPod
+	}
+
+	path := fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=%s", ns, url.QueryEscape(labels))
+	if err := c.get(ctx, path, &list); err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+func (r *kubernetesRemote) getDeploymentSelector(ctx context.Context, c *kubernetesClient) (string, error) {
+	var deployment struct {
+		Spec struct {
+			Selector struct {
+				MatchLabels map[string]string
+			}
+		}
+	}
+
+	path := fmt.Sprintf("/apis/apps/v1/namespaces/%s/deployments/%s", r.selector.namespace(), r.selector.Deployment)
+	if err := c.get(ctx, path, &deployment); err != nil {
+		return "", err
+	}
+
+	var labels []string
+	for k, v := range deployment.Spec.Selector.MatchLabels {
+		labels = append(labels, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	if len(labels) == 0 {
+		return "", fmt.Errorf("kubernetes: %s has no matchLabels selector", &r.selector)
+	}
+
+	sort.Strings(labels)
+	return strings.Join(labels, ","), nil
+}
+
+func (r *kubernetesRemote) pick(addresses []string) string {
+	switch r.selector.Policy {
+	case ContainerPolicyRandom:
+		return addresses[rand.Intn(len(addresses))]
+	case ContainerPolicyRoundRobin:
+		return addresses[int(atomic.AddUint32(&r.next, 1)-1)%len(addresses)]
+	}
+
+	return addresses[0]
+}
+
+// resolvePort returns the port as is if it's a number, otherwise the number of
+// the port with that name
+func (r *kubernetesRemote) resolvePort(ports []kubernetesPort, number func(kubernetesPort) int) (string, error) {
+	if _, err := strconv.Atoi(r.port); err == nil {
+		return r.port, nil
+	}
+
+	for _, p := range ports {
+		if p.Name == r.port {
+			return strconv.Itoa(number(p)), nil
+		}
+	}
+
+	return "", fmt.Errorf("kubernetes: %s has no port %q", &r.selector, r.port)
+}
+
+func (r *kubernetesRemote) String() string {
+	r.m.Lock()
+	a := r.address
+	r.m.Unlock()
+
+	if a == "" {
+		a = ":" + r.port
+	}
+
+	return fmt.Sprintf("<kubernetes=%s>%s/tcp", &r.selector, a)
+}
+
+type kubernetesClient struct {
+	c     *http.Client
+	base  string
+	token string
+}
+
+func newKubernetesClient(s SSHConnection, e *KubernetesEndpoint) (*kubernetesClient, error) {
+	u, err := url.Parse(e.Address)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("kubernetes: invalid address %q", e.Address)
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), "443")
+		if u.Scheme == "http" {
+			address = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	return &kubernetesClient{
+		base:  strings.TrimSuffix(e.Address, "/"),
+		token: e.Token,
+		c: &http.Client{
+			Transport: newSSHTransport(s, NewUnresolvedAddr("tcp", address), e.TLS, time.Second*5),
+		},
+	}, nil
+}
+
+func (c *kubernetesClient) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", c.base+path, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.c.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("kubernetes: %s", err)
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var status struct{ Message string }
+		json.NewDecoder(res.Body).Decode(&status)
+		if status.Message != "" {
+			return fmt.Errorf("kubernetes: %s", status.Message)
+		}
+
+		return fmt.Errorf("kubernetes: unexpected status %q from %s", res.Status, path)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
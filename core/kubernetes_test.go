@@ -0,0 +1,197 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type KubernetesSuite struct {
+	ssh *SSHFixture
+}
+
+var _ = Suite(&KubernetesSuite{})
+
+func (s *KubernetesSuite) SetUpTest(c *C) {
+	s.ssh = &SSHFixture{Handler: newKubernetesAPIFixture("secret")}
+}
+
+func (s *KubernetesSuite) TestPod(c *C) {
+	r := NewKubernetesRemote(&KubernetesSelector{Pod: "web-1"}, "http", s.endpoint())
+	c.Assert(r.String(), Equals, "<kubernetes=pod/default/web-1>:http/tcp")
+
+	a, err := r.Addr(s.ssh)
+	c.Assert(err, IsNil)
+	c.Assert(a.String(), Equals, "10.1.0.11:8080")
+	c.Assert(r.String(), Equals, "<kubernetes=pod/default/web-1>10.1.0.11:8080/tcp")
+	c.Assert(s.ssh.dialed, DeepEquals, []string{"tcp:10.0.0.1:6443"})
+	c.Assert(s.ssh.requests, DeepEquals, []string{"/api/v1/namespaces/default/pods/web-1"})
+}
+
+func (s *KubernetesSuite) TestPodNotRunning(c *C) {
+	r := NewKubernetesRemote(&KubernetesSelector{Pod: "web-3"}, "8080", s.endpoint())
+	_, err := r.Addr(s.ssh)
+	c.Assert(err, ErrorMatches, "kubernetes: pod/default/web-3 has no running pods")
+}
+
+func (s *KubernetesSuite) TestPodNotFound(c *C) {
+	r := NewKubernetesRemote(&KubernetesSelector{Pod: "qux"}, "8080", s.endpoint())
+	_, err := r.Addr(s.ssh)
+	c.Assert(err, ErrorMatches, `kubernetes: pods "qux" not found`)
+}
+
+func (s *KubernetesSuite) TestLabels(c *C) {
+	r := NewKubernetesRemote(&KubernetesSelector{
+		Labels: "app=web",
+		Policy: ContainerPolicyRoundRobin,
+	}, "8080", s.endpoint())
+
+	for _, ip := range []string{"10.1.0.11", "10.1.0.12", "10.1.0.11"} {
+		a, err := r.Addr(s.ssh)
+		c.Assert(err, IsNil)
+		c.Assert(a.String(), Equals, ip+":8080")
+	}
+}
+
+func (s *KubernetesSuite) TestDeployment(c *C) {
+	r := NewKubernetesRemote(&KubernetesSelector{Deployment: "web"}, "http", s.endpoint())
+	a, err := r.Addr(s.ssh)
+	c.Assert(err, IsNil)
+	c.Assert(a.String(), Equals, "10.1.0.11:8080")
+	c.Assert(s.ssh.requests, DeepEquals, []string{
+		"/apis/apps/v1/namespaces/default/deployments/web",
+		"/api/v1/namespaces/default/pods",
+	})
+}
+
+func (s *KubernetesSuite) TestService(c *C) {
+	r := NewKubernetesRemote(&KubernetesSelector{Namespace: "prod", Service: "web"}, "http", s.endpoint())
+	a, err := r.Addr(s.ssh)
+	c.Assert(err, IsNil)
+	c.Assert(a.String(), Equals, "10.96.0.10:80")
+
+	r = NewKubernetesRemote(&KubernetesSelector{Namespace: "prod", Service: "web"}, "https", s.endpoint())
+	_, err = r.Addr(s.ssh)
+	c.Assert(err, ErrorMatches, `kubernetes: service/prod/web has no port "https"`)
+}
+
+func (s *KubernetesSuite) TestUnauthorized(c *C) {
+	e := s.endpoint()
+	e.Token = "foo"
+
+	r := NewKubernetesRemote(&KubernetesSelector{Pod: "web-1"}, "8080", e)
+	_, err := r.Addr(s.ssh)
+	c.Assert(err, ErrorMatches, "kubernetes: Unauthorized")
+}
+
+func (s *KubernetesSuite) TestCache(c *C) {
+	e := s.endpoint()
+	e.CacheTTL = 100 * time.Millisecond
+
+	r := NewKubernetesRemote(&KubernetesSelector{
+		Labels: "app=web",
+		Policy: ContainerPolicyRoundRobin,
+	}, "8080", e)
+
+	for _, ip := range []string{"10.1.0.11", "10.1.0.12", "10.1.0.11"} {
+		a, err := r.Addr(s.ssh)
+		c.Assert(err, IsNil)
+		c.Assert(a.String(), Equals, ip+":8080")
+	}
+
+	c.Assert(s.ssh.count("/api/v1/namespaces/default/pods"), Equals, 1)
+
+	time.Sleep(200 * time.Millisecond)
+	_, err := r.Addr(s.ssh)
+	c.Assert(err, IsNil)
+	c.Assert(s.ssh.count("/api/v1/namespaces/default/pods"), Equals, 2)
+}
+
+func (s *KubernetesSuite) TestReleasesConn(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	api := httptest.NewServer(newKubernetesAPIFixture("secret"))
+	defer api.Close()
+
+	conn := NewSSHConnection(server.Addr(), server.ClientConfig(), 0)
+	defer conn.(io.Closer).Close()
+
+	r := NewKubernetesRemote(&KubernetesSelector{Deployment: "web"}, "http", &KubernetesEndpoint{
+		Address: api.URL,
+		Token:   "secret",
+	})
+
+	for i := 0; i < 3; i++ {
+		a, err := r.Addr(conn)
+		c.Assert(err, IsNil)
+		c.Assert(a.String(), Equals, "10.1.0.11:8080")
+	}
+
+	for i := 0; activeConns(conn) != 0; i++ {
+		c.Assert(i < 100, Equals, true, Commentf("active: %d", activeConns(conn)))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *KubernetesSuite) endpoint() *KubernetesEndpoint {
+	return &KubernetesEndpoint{Address: "http://10.0.0.1:6443", Token: "secret"}
+}
+
+const kubernetesPodFixture = `{
+	"metadata": {"name": %q, "namespace": "default", "labels": {"app": "web"}},
+	"spec": {"containers": [{"name": "web", "ports": [{"name": "http", "containerPort": 8080}]}]},
+	"status": {"phase": %q, "podIP": %q}
+}`
+
+func newKubernetesAPIFixture(token string) http.Handler {
+	pods := map[string]string{
+		"web-1": fmt.Sprintf(kubernetesPodFixture, "web-1", "Running", "10.1.0.11"),
+		"web-2": fmt.Sprintf(kubernetesPodFixture, "web-2", "Running", "10.1.0.12"),
+		"web-3": fmt.Sprintf(kubernetesPodFixture, "web-3", "Pending", ""),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/default/pods", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("labelSelector") != "app=web" {
+			fmt.Fprint(w, `{"items": []}`)
+			return
+		}
+
+		fmt.Fprintf(w, `{"items": [%s, %s, %s]}`, pods["web-2"], pods["web-3"], pods["web-1"])
+	})
+
+	mux.HandleFunc("/api/v1/namespaces/default/pods/", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[len("/api/v1/namespaces/default/pods/"):]
+		pod, ok := pods[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"kind": "Status", "message": "pods \"%s\" not found", "code": 404}`, name)
+			return
+		}
+
+		fmt.Fprint(w, pod)
+	})
+
+	mux.HandleFunc("/apis/apps/v1/namespaces/default/deployments/web", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"spec": {"selector": {"matchLabels": {"app": "web"}}}}`)
+	})
+
+	mux.HandleFunc("/api/v1/namespaces/prod/services/web", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"spec": {"clusterIP": "10.96.0.10", "ports": [{"name": "http", "port": 80, "targetPort": 8080}]}}`)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"kind": "Status", "message": "Unauthorized", "code": 401}`)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
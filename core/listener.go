@@ -1,56 +1,146 @@
 package core
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"gopkg.in/inconshreveable/log15.v2"
 )
 
+const relistenDelay = 5 * time.Second
+
 type ListenerHandler func(net.Conn) error
 
 type Listener struct {
-	a      net.Addr
-	l      net.Listener
-	done   chan bool
-	closed int32
+	a       net.Addr
+	l       net.Listener
+	m       sync.Mutex
+	c       SSHConnection
+	done    chan bool
+	stopped chan bool
+	closing int32
+
+	cm    sync.Mutex
+	conns map[net.Conn]bool
 
 	Handler     ListenerHandler
 	Connections int32
+	// Socket is applied to the socket file of the local unix listeners
+	Socket *SocketOptions
 }
 
 func NewListener(a net.Addr) *Listener {
-	return &Listener{a: a, done: make(chan bool)}
+	return NewRemoteListener(a, nil)
+}
+
+func NewRemoteListener(a net.Addr, c SSHConnection) *Listener {
+	return &Listener{
+		a:       a,
+		c:       c,
+		done:    make(chan bool),
+		stopped: make(chan bool),
+		conns:   make(map[net.Conn]bool),
+	}
 }
 
 func (l *Listener) Start() error {
-	var err error
-	l.l, err = net.Listen(l.a.Network(), l.a.String())
-	if err != nil {
+	return l.StartContext(context.Background())
+}
+
+// StartContext starts the listener, it's closed when ctx is done
+func (l *Listener) StartContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := l.start(ctx); err != nil {
+		return err
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				l.Close()
+			case <-l.done:
+			}
+		}()
+	}
+
+	return nil
+}
+
+func (l *Listener) start(ctx context.Context) error {
+	ln, err := l.listen(ctx)
+	if err != nil && l.c == nil {
 		return fmt.Errorf("error creating listener: %s", err)
 	}
 
-	go l.listen()
+	if err != nil && ctx.Err() != nil {
+		return err
+	}
+
+	if err != nil {
+		log15.Warn("remote listener not available", "addr", l.a, "ssh", l.c, "error", err)
+		go func() {
+			if l.relisten() {
+				l.accept()
+			}
+		}()
+
+		return nil
+	}
+
+	l.m.Lock()
+	l.l = ln
+	l.m.Unlock()
+
+	go l.accept()
 	return nil
 }
 
-func (l *Listener) listen() {
+func (l *Listener) listen(ctx context.Context) (net.Listener, error) {
+	if l.c != nil {
+		return l.c.ListenContext(ctx, l.a)
+	}
+
+	if l.a.Network() == "unix" {
+		return listenUnix(l.a.String(), l.Socket)
+	}
+
+	var lc net.ListenConfig
+	return lc.Listen(ctx, l.a.Network(), l.a.String())
+}
+
+func (l *Listener) accept() {
+	defer close(l.stopped)
+
 	for {
-		conn, err := l.l.Accept()
+		conn, err := l.listener().Accept()
 		if err != nil {
-			if x, ok := err.(*net.OpError); ok && x.Op == "accept" { // We're done
-				atomic.StoreInt32(&l.closed, 1)
+			if atomic.LoadInt32(&l.closing) == 1 || l.c == nil && isAcceptError(err) { // We're done
 				log15.Debug("socket closed", "addr", l)
 				break
 			}
 
+			if l.c != nil {
+				log15.Warn("remote listener lost", "addr", l, "ssh", l.c, "error", err)
+				if !l.relisten() {
+					break
+				}
+
+				continue
+			}
+
 			log15.Error("accept failer", "addr", l, "error", err)
 			continue
 		}
 
-		atomic.AddInt32(&l.Connections, 1)
+		l.track(conn, true)
 		go func(c net.Conn) {
 			err := l.Handler(c)
 			if err != nil {
@@ -58,33 +148,130 @@ func (l *Listener) listen() {
 			}
 
 			c.Close()
-			atomic.AddInt32(&l.Connections, -1)
+			l.track(c, false)
 		}(conn)
 	}
 }
 
+func (l *Listener) track(c net.Conn, active bool) {
+	l.cm.Lock()
+	defer l.cm.Unlock()
+
+	if active {
+		l.conns[c] = true
+		atomic.AddInt32(&l.Connections, 1)
+		return
+	}
+
+	delete(l.conns, c)
+	atomic.AddInt32(&l.Connections, -1)
+}
+
+func (l *Listener) listener() net.Listener {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return l.l
+}
+
+func isAcceptError(err error) bool {
+	x, ok := err.(*net.OpError)
+	return ok && x.Op == "accept"
+}
+
+// relisten listens on the remote until it succeeds or the listener is closed
+func (l *Listener) relisten() bool {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-l.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for atomic.LoadInt32(&l.closing) == 0 {
+		ln, err := l.listen(ctx)
+		if err == nil {
+			l.m.Lock()
+			defer l.m.Unlock()
+			if atomic.LoadInt32(&l.closing) == 1 {
+				ln.Close()
+				return false
+			}
+
+			l.l = ln
+			log15.Info("remote listener restored", "addr", ln.Addr(), "ssh", l.c)
+			return true
+		}
+
+		if ctx.Err() != nil {
+			return false
+		}
+
+		log15.Error("error restoring remote listener", "addr", l.a, "ssh", l.c, "error", err)
+		select {
+		case <-time.After(relistenDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	return false
+}
+
+// Close stops accepting connections, the active connections are not closed
 func (l *Listener) Close() error {
+	if !atomic.CompareAndSwapInt32(&l.closing, 0, 1) {
+		return nil
+	}
+
+	close(l.done)
+
+	l.m.Lock()
 	if l.l == nil {
+		l.m.Unlock()
 		return nil
 	}
 
-	if err := l.l.Close(); err != nil {
+	err := l.l.Close()
+	l.m.Unlock()
+	if err != nil {
 		return err
 	}
 
-	for range time.Tick(time.Millisecond * 10) {
-		if l.closed == 1 {
-			return nil
-		}
+	<-l.stopped
+	return nil
+}
+
+// Drain closes the listener and waits up to timeout for the active
+// connections to finish, the remaining ones are closed and its number returned
+func (l *Listener) Drain(timeout time.Duration) (int, error) {
+	if err := l.Close(); err != nil {
+		return 0, err
 	}
 
-	return nil
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&l.Connections) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	l.cm.Lock()
+	defer l.cm.Unlock()
+
+	for c := range l.conns {
+		c.Close()
+	}
+
+	return len(l.conns), nil
 }
 
 func (l *Listener) String() string {
-	if l.l == nil {
+	ln := l.listener()
+	if ln == nil {
 		return "<nil>"
 	}
 
-	return l.l.Addr().String()
+	return ln.Addr().String()
 }
@@ -1,8 +1,12 @@
 package core
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -44,3 +48,104 @@ func (s *ListenerSuite) AATestStart(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(conn, Equals, 1)
 }
+
+func (s *ListenerSuite) TestStartContext(c *C) {
+	local, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := NewListener(local)
+	l.Handler = func(c net.Conn) error { return nil }
+
+	err := l.StartContext(ctx)
+	c.Assert(err, IsNil)
+
+	addr := l.String()
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	conn.Close()
+
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = net.Dial("tcp", addr)
+	c.Assert(err, NotNil)
+}
+
+func (s *ListenerSuite) TestStartContextCanceled(c *C) {
+	local, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	l := NewListener(local)
+	err := l.StartContext(ctx)
+	c.Assert(err, NotNil)
+}
+
+func (s *ListenerSuite) TestRemoteCloseWhileRelistening(c *C) {
+	server := newSSHServerFixture(c)
+	server.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		Retries: 10,
+		Backoff: Backoff{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 2},
+	})
+
+	l := NewRemoteListener(MustResolveAddr("tcp", "127.0.0.1:0"), conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := l.StartContext(ctx)
+	c.Assert(err, ErrorMatches, "context deadline exceeded: .*")
+
+	l = NewRemoteListener(MustResolveAddr("tcp", "127.0.0.1:0"), conn)
+	stopped := make(chan bool)
+	go func() {
+		l.relisten()
+		close(stopped)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(l.Close(), IsNil)
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		c.Fatal("relisten not stopped by Close")
+	}
+}
+
+func (s *ListenerSuite) TestDrain(c *C) {
+	local, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+
+	l := NewListener(local)
+	l.Handler = func(c net.Conn) error {
+		_, err := io.Copy(ioutil.Discard, c)
+		return err
+	}
+
+	err := l.Start()
+	c.Assert(err, IsNil)
+
+	idle, err := net.Dial("tcp", l.String())
+	c.Assert(err, IsNil)
+	defer idle.Close()
+
+	finished, err := net.Dial("tcp", l.String())
+	c.Assert(err, IsNil)
+
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&l.Connections), Equals, int32(2))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		finished.Close()
+	}()
+
+	cut, err := l.Drain(500 * time.Millisecond)
+	c.Assert(err, IsNil)
+	c.Assert(cut, Equals, 1)
+
+	_, err = idle.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+}
@@ -0,0 +1,331 @@
+package core
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// DialLatencyBuckets are the upper bounds of the dial latency histograms
+	DialLatencyBuckets = []time.Duration{
+		time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond,
+		25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+		250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+		2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+	}
+
+	// TunnelDurationBuckets are the upper bounds of the tunnel duration
+	// histograms
+	TunnelDurationBuckets = []time.Duration{
+		100 * time.Millisecond, 500 * time.Millisecond, time.Second,
+		5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute,
+		5 * time.Minute, 15 * time.Minute, time.Hour, 6 * time.Hour,
+	}
+)
+
+// Error kinds of PassageStats.Errors
+const (
+	ErrorKindResolve    = "resolve"
+	ErrorKindDial       = "dial"
+	ErrorKindServerDown = "server_down"
+	ErrorKindHostKey    = "host_key"
+	ErrorKindProxy      = "proxy"
+	ErrorKindNoBackend  = "no_backend"
+)
+
+// Histogram counts observations in buckets, like the Prometheus histograms
+type Histogram struct {
+	m       sync.Mutex
+	buckets []time.Duration
+	counts  []uint64
+	count   uint64
+	sum     time.Duration
+}
+
+func NewHistogram(buckets []time.Duration) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.count++
+	h.sum += d
+	for i, b := range h.buckets {
+		if d <= b {
+			h.counts[i]++
+			break
+		}
+	}
+}
+
+// Snapshot returns the current state, with cumulative counts
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	s := HistogramSnapshot{
+		Buckets: h.buckets,
+		Counts:  make([]uint64, len(h.counts)),
+		Count:   h.count,
+		Sum:     h.sum,
+	}
+
+	var total uint64
+	for i, c := range h.counts {
+		total += c
+		s.Counts[i] = total
+	}
+
+	return s
+}
+
+// HistogramSnapshot is the state of a Histogram, Counts[i] is the number of
+// observations less than or equal to Buckets[i]
+type HistogramSnapshot struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Count   uint64
+	Sum     time.Duration
+}
+
+// Mean returns the mean of the observations
+func (s HistogramSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+
+	return s.Sum / time.Duration(s.Count)
+}
+
+// Merge adds the observations of o, both must have the same buckets
+func (s HistogramSnapshot) Merge(o HistogramSnapshot) HistogramSnapshot {
+	if len(s.Buckets) == 0 {
+		s.Buckets = o.Buckets
+	}
+
+	counts := make([]uint64, len(s.Buckets))
+	for i := range counts {
+		if i < len(s.Counts) {
+			counts[i] += s.Counts[i]
+		}
+
+		if i < len(o.Counts) {
+			counts[i] += o.Counts[i]
+		}
+	}
+
+	return HistogramSnapshot{
+		Buckets: s.Buckets,
+		Counts:  counts,
+		Count:   s.Count + o.Count,
+		Sum:     s.Sum + o.Sum,
+	}
+}
+
+// PassageMetrics are the traffic metrics of a passage, updated while handling
+// its connections
+type PassageMetrics struct {
+	active   int64
+	total    uint64
+	bytesIn  uint64
+	bytesOut uint64
+
+	tunnelDuration *Histogram
+	dialLatency    *Histogram
+
+	m      sync.Mutex
+	errors map[string]uint64
+}
+
+func NewPassageMetrics() *PassageMetrics {
+	return &PassageMetrics{
+		tunnelDuration: NewHistogram(TunnelDurationBuckets),
+		dialLatency:    NewHistogram(DialLatencyBuckets),
+		errors:         make(map[string]uint64),
+	}
+}
+
+func (m *PassageMetrics) opened() {
+	atomic.AddInt64(&m.active, 1)
+	atomic.AddUint64(&m.total, 1)
+}
+
+// closed records the end of a connection opened at start, only the successful
+// tunnels are observed in the duration histogram
+func (m *PassageMetrics) closed(start time.Time, err error) {
+	atomic.AddInt64(&m.active, -1)
+	if err != nil {
+		m.error(err)
+		return
+	}
+
+	m.tunnelDuration.Observe(time.Since(start))
+}
+
+func (m *PassageMetrics) received(n int) {
+	atomic.AddUint64(&m.bytesIn, uint64(n))
+}
+
+func (m *PassageMetrics) sent(n int) {
+	atomic.AddUint64(&m.bytesOut, uint64(n))
+}
+
+// error counts err by its kind, the errors of the SSH server take precedence
+// over the step where they happened
+func (m *PassageMetrics) error(err error) {
+	kind := ErrorKindDial
+	if e, ok := err.(*passageError); ok {
+		kind, err = e.kind, e.err
+	}
+
+	switch err.(type) {
+	case *HostKeyError:
+		kind = ErrorKindHostKey
+	case *ServerDownError:
+		kind = ErrorKindServerDown
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.errors[kind]++
+}
+
+// Snapshot returns the current values of the metrics
+func (m *PassageMetrics) Snapshot() PassageStats {
+	s := PassageStats{
+		ActiveConnections: atomic.LoadInt64(&m.active),
+		TotalConnections:  atomic.LoadUint64(&m.total),
+		BytesIn:           atomic.LoadUint64(&m.bytesIn),
+		BytesOut:          atomic.LoadUint64(&m.bytesOut),
+		TunnelDuration:    m.tunnelDuration.Snapshot(),
+		DialLatency:       m.dialLatency.Snapshot(),
+		Errors:            make(map[string]uint64),
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+	for k, v := range m.errors {
+		s.Errors[k] = v
+	}
+
+	return s
+}
+
+// PassageStats are the values of the PassageMetrics. The bytes in are the ones
+// received from the accepted connections, the bytes out the ones sent to them.
+type PassageStats struct {
+	ActiveConnections int64
+	TotalConnections  uint64
+	BytesIn           uint64
+	BytesOut          uint64
+	TunnelDuration    HistogramSnapshot
+	DialLatency       HistogramSnapshot
+	Errors            map[string]uint64
+}
+
+// Merge returns the sum of the stats
+func (s PassageStats) Merge(o PassageStats) PassageStats {
+	errors := make(map[string]uint64)
+	for k, v := range s.Errors {
+		errors[k] += v
+	}
+
+	for k, v := range o.Errors {
+		errors[k] += v
+	}
+
+	return PassageStats{
+		ActiveConnections: s.ActiveConnections + o.ActiveConnections,
+		TotalConnections:  s.TotalConnections + o.TotalConnections,
+		BytesIn:           s.BytesIn + o.BytesIn,
+		BytesOut:          s.BytesOut + o.BytesOut,
+		TunnelDuration:    s.TunnelDuration.Merge(o.TunnelDuration),
+		DialLatency:       s.DialLatency.Merge(o.DialLatency),
+		Errors:            errors,
+	}
+}
+
+// ConnectionStats are the metrics of a SSH connection
+type ConnectionStats struct {
+	Connected bool
+	// Connecting is set while dialing the server
+	Connecting bool
+	// ConnectedSince is the time the current connection was established
+	ConnectedSince time.Time
+	// Connects is the number of successful connections to the server, and
+	// Reconnects the ones after the first one
+	Connects   uint64
+	Reconnects uint64
+	// Disconnects is the number of connections closed on demand, and
+	// IdleTimeouts the ones closed once idle
+	Disconnects  uint64
+	IdleTimeouts uint64
+	DialErrors   uint64
+	// ConnectLatency is the time dialing the server, including the handshake
+	ConnectLatency HistogramSnapshot
+}
+
+// passageError is an error handling a connection of a passage, with its kind
+type passageError struct {
+	kind string
+	err  error
+}
+
+func (e *passageError) Error() string {
+	return e.err.Error()
+}
+
+func newPassageError(kind string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &passageError{kind: kind, err: err}
+}
+
+// meteredConn counts the bytes read and written
+type meteredConn struct {
+	net.Conn
+	m *PassageMetrics
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.m.received(n)
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.m.sent(n)
+	return n, err
+}
+
+func (c *meteredConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+
+	return c.Conn.Close()
+}
+
+type dialObserverKey struct{}
+
+// withDialObserver returns a context where the successful dials are reported to
+// the histogram
+func withDialObserver(ctx context.Context, h *Histogram) context.Context {
+	return context.WithValue(ctx, dialObserverKey{}, h)
+}
+
+func observeDial(ctx context.Context, start time.Time) {
+	if h, ok := ctx.Value(dialObserverKey{}).(*Histogram); ok {
+		h.Observe(time.Since(start))
+	}
+}
@@ -0,0 +1,203 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type MetricsSuite struct {
+	echo net.Listener
+	ssh  *sshServerFixture
+}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) SetUpTest(c *C) {
+	s.echo = newEchoServer(c)
+	s.ssh = newSSHServerFixture(c)
+}
+
+func (s *MetricsSuite) TearDownTest(c *C) {
+	s.ssh.Close()
+	s.echo.Close()
+}
+
+func (s *MetricsSuite) TestHistogram(c *C) {
+	h := NewHistogram([]time.Duration{time.Millisecond, time.Second})
+	h.Observe(time.Microsecond)
+	h.Observe(10 * time.Millisecond)
+	h.Observe(time.Second)
+	h.Observe(time.Minute)
+
+	snapshot := h.Snapshot()
+	c.Assert(snapshot.Counts, DeepEquals, []uint64{1, 3})
+	c.Assert(snapshot.Count, Equals, uint64(4))
+	c.Assert(snapshot.Sum, Equals, time.Minute+time.Second+10*time.Millisecond+time.Microsecond)
+
+	merged := snapshot.Merge(snapshot)
+	c.Assert(merged.Counts, DeepEquals, []uint64{2, 6})
+	c.Assert(merged.Count, Equals, uint64(8))
+	c.Assert(merged.Mean(), Equals, snapshot.Mean())
+
+	c.Assert(HistogramSnapshot{}.Merge(snapshot), DeepEquals, snapshot)
+}
+
+func (s *MetricsSuite) TestPassage(c *C) {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewPassage(conn, NewRemote("tcp", s.echo.Addr().String()))
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	assertEcho(c, p.Addr())
+	assertEcho(c, p.Addr())
+	waitIdle(c, p)
+
+	stats := p.Stats()
+	c.Assert(stats.TotalConnections, Equals, uint64(2))
+	c.Assert(stats.BytesIn, Equals, uint64(6))
+	c.Assert(stats.BytesOut, Equals, uint64(6))
+	c.Assert(stats.DialLatency.Count, Equals, uint64(2))
+	c.Assert(stats.TunnelDuration.Count, Equals, uint64(2))
+	c.Assert(stats.Errors, HasLen, 0)
+
+	cs := conn.(*sshConnection).Stats()
+	c.Assert(cs.Connected, Equals, true)
+	c.Assert(cs.Connects, Equals, uint64(1))
+	c.Assert(cs.Reconnects, Equals, uint64(0))
+	c.Assert(cs.ConnectLatency.Count, Equals, uint64(1))
+	c.Assert(cs.ConnectedSince.IsZero(), Equals, false)
+}
+
+func (s *MetricsSuite) TestPassageActive(c *C) {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewPassage(conn, NewRemote("tcp", s.echo.Addr().String()))
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	client, err := net.Dial("tcp", p.Addr())
+	c.Assert(err, IsNil)
+	write(c, client, []byte("foo")...)
+	read(c, client, 3)
+
+	stats := p.Stats()
+	c.Assert(stats.ActiveConnections, Equals, int64(1))
+	c.Assert(stats.BytesIn, Equals, uint64(3))
+	c.Assert(stats.BytesOut, Equals, uint64(3))
+	c.Assert(stats.TunnelDuration.Count, Equals, uint64(0))
+
+	client.Close()
+	waitIdle(c, p)
+	c.Assert(p.Stats().TunnelDuration.Count, Equals, uint64(1))
+}
+
+func (s *MetricsSuite) TestPassageErrors(c *C) {
+	p := NewPassage(&SSHFixture{}, NewContainerRemote("", "qux", "80"))
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	assertClosed(c, p.Addr())
+
+	conn := NewSSHConnection(MustResolveAddr("tcp", "127.0.0.1:1"), s.ssh.ClientConfig(), 0)
+	q := NewPassage(conn, NewRemote("tcp", s.echo.Addr().String()))
+	err = q.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer q.Close()
+
+	assertClosed(c, q.Addr())
+	assertClosed(c, q.Addr())
+
+	waitIdle(c, p)
+	waitIdle(c, q)
+
+	stats := p.Stats()
+	c.Assert(stats.TotalConnections, Equals, uint64(1))
+	c.Assert(stats.Errors, DeepEquals, map[string]uint64{ErrorKindResolve: 1})
+	c.Assert(stats.TunnelDuration.Count, Equals, uint64(0))
+
+	stats = q.Stats()
+	c.Assert(stats.Errors, DeepEquals, map[string]uint64{ErrorKindDial: 1, ErrorKindServerDown: 1})
+	c.Assert(stats.DialLatency.Count, Equals, uint64(0))
+
+	cs := conn.(*sshConnection).Stats()
+	c.Assert(cs.Connected, Equals, false)
+	c.Assert(cs.DialErrors, Equals, uint64(1))
+}
+
+func (s *MetricsSuite) TestBalancedPassage(c *C) {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	b := NewBalancer(BalancePolicyRoundRobin, 0)
+	p := NewBalancedPassage(b)
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	assertClosed(c, p.Addr())
+	waitIdle(c, p)
+	c.Assert(p.Stats().Errors, DeepEquals, map[string]uint64{ErrorKindNoBackend: 1})
+
+	b = NewBalancer(BalancePolicyRoundRobin, 0, Backend{Conn: conn, Remote: NewRemote("tcp", s.echo.Addr().String())})
+	p = NewBalancedPassage(b)
+	err = p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	assertEcho(c, p.Addr())
+	waitIdle(c, p)
+	c.Assert(p.Stats().DialLatency.Count, Equals, uint64(1))
+	c.Assert(p.Stats().BytesIn, Equals, uint64(3))
+}
+
+func (s *MetricsSuite) TestPassageStatsMerge(c *C) {
+	a := PassageStats{ActiveConnections: 1, BytesIn: 2, Errors: map[string]uint64{ErrorKindDial: 1}}
+	b := PassageStats{TotalConnections: 3, BytesOut: 4, Errors: map[string]uint64{ErrorKindDial: 1, ErrorKindProxy: 2}}
+
+	merged := a.Merge(b)
+	c.Assert(merged.ActiveConnections, Equals, int64(1))
+	c.Assert(merged.TotalConnections, Equals, uint64(3))
+	c.Assert(merged.BytesIn, Equals, uint64(2))
+	c.Assert(merged.BytesOut, Equals, uint64(4))
+	c.Assert(merged.Errors, DeepEquals, map[string]uint64{ErrorKindDial: 2, ErrorKindProxy: 2})
+	c.Assert(a.Errors, DeepEquals, map[string]uint64{ErrorKindDial: 1})
+}
+
+func (s *MetricsSuite) TestErrorKind(c *C) {
+	m := NewPassageMetrics()
+	m.error(fmt.Errorf("foo"))
+	m.error(newPassageError(ErrorKindProxy, fmt.Errorf("foo")))
+	m.error(newPassageError(ErrorKindResolve, &HostKeyError{}))
+	m.error(&ServerDownError{})
+
+	c.Assert(m.Snapshot().Errors, DeepEquals, map[string]uint64{
+		ErrorKindDial:       1,
+		ErrorKindProxy:      1,
+		ErrorKindHostKey:    1,
+		ErrorKindServerDown: 1,
+	})
+
+	c.Assert(newPassageError(ErrorKindProxy, nil), IsNil)
+}
+
+// assertClosed asserts the passage closes the connection without replying
+func assertClosed(c *C, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+	defer conn.Close()
+
+	content, _ := ioutil.ReadAll(conn)
+	c.Assert(content, HasLen, 0)
+}
+
+func waitIdle(c *C, p *Passage) {
+	for i := 0; i < 100 && p.Stats().ActiveConnections != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(p.Stats().ActiveConnections, Equals, int64(0))
+}
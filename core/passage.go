@@ -1,39 +1,219 @@
 package core
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"time"
 )
 
+type Proxy interface {
+	Handle(net.Conn, SSHConnection) error
+	// HandleContext is like Handle, the dials carry ctx
+	HandleContext(context.Context, net.Conn, SSHConnection) error
+	fmt.Stringer
+}
+
+type passageListener interface {
+	StartContext(context.Context) error
+	Close() error
+	Drain(time.Duration) (int, error)
+	String() string
+}
+
 type Passage struct {
 	c SSHConnection
 	r Remote
-	l *Listener
+	p Proxy
+	b *Balancer
+	l passageListener
+
+	reverse     bool
+	udp         bool
+	idleTimeout time.Duration
+
+	// Socket is applied when the passage listens on a unix socket
+	Socket *SocketOptions
+	// Metrics are updated by the connections handled by the passage
+	Metrics *PassageMetrics
 }
 
 func NewPassage(c SSHConnection, r Remote) *Passage {
-	return &Passage{c: c, r: r}
+	return &Passage{c: c, r: r, Metrics: NewPassageMetrics()}
+}
+
+func NewReversePassage(c SSHConnection, r Remote) *Passage {
+	return &Passage{c: c, r: r, reverse: true, Metrics: NewPassageMetrics()}
+}
+
+func NewProxyPassage(c SSHConnection, proxy Proxy) *Passage {
+	return &Passage{c: c, p: proxy, Metrics: NewPassageMetrics()}
+}
+
+// NewBalancedPassage returns a passage distributing the connections between
+// the backends of the balancer
+func NewBalancedPassage(b *Balancer) *Passage {
+	return &Passage{b: b, Metrics: NewPassageMetrics()}
+}
+
+// NewUDPPassage returns a passage forwarding the datagrams received locally to
+// the remote, see UDPListener
+func NewUDPPassage(c SSHConnection, r Remote, idleTimeout time.Duration) *Passage {
+	return &Passage{
+		c:           c,
+		r:           r,
+		udp:         true,
+		idleTimeout: idleTimeout,
+		Metrics:     NewPassageMetrics(),
+	}
 }
 
 func (p *Passage) Start(a net.Addr) error {
+	return p.StartContext(context.Background(), a)
+}
+
+// StartContext starts the passage, it's closed when ctx is done
+func (p *Passage) StartContext(ctx context.Context, a net.Addr) error {
 	p.buildListener(a)
-	return p.l.Start()
+	return p.l.StartContext(ctx)
 }
 
 func (p *Passage) Close() error {
+	p.closeRemote()
 	return p.l.Close()
 }
 
+// Drain closes the passage, waiting up to timeout for the active tunnels, the
+// number of tunnels cut is returned
+func (p *Passage) Drain(timeout time.Duration) (int, error) {
+	p.closeRemote()
+	return p.l.Drain(timeout)
+}
+
+func (p *Passage) closeRemote() {
+	if c, ok := p.r.(io.Closer); ok {
+		c.Close()
+	}
+
+	if p.b != nil {
+		p.b.Close()
+	}
+
+	if f, ok := p.c.(*FailoverConnection); ok {
+		f.Close()
+	}
+}
+
 func (p *Passage) buildListener(a net.Addr) {
-	p.l = NewListener(a)
-	p.l.Handler = func(c net.Conn) error {
-		remote, err := p.r.Addr(p.c)
-		if err != nil {
-			return err
-		}
+	if p.udp {
+		l := NewUDPListener(a, p.c, p.r, p.idleTimeout)
+		l.Metrics = p.Metrics
+		p.l = l
+		return
+	}
+
+	if p.reverse {
+		l := NewRemoteListener(a, p.c)
+		l.Handler = p.metered(p.handleReverse)
+		p.l = l
+		return
+	}
+
+	handler := p.handle
+	if p.p != nil {
+		handler = p.handleProxy
+	}
+
+	if p.b != nil {
+		handler = p.handleBalanced
+	}
+
+	l := NewListener(a)
+	l.Socket = p.Socket
+	l.Handler = p.metered(handler)
+	p.l = l
+}
 
-		return p.c.Tunnel(c, remote)
+// metered records the connections handled by h, and the bytes transferred
+func (p *Passage) metered(h ListenerHandler) ListenerHandler {
+	return func(c net.Conn) (err error) {
+		start := time.Now()
+		p.Metrics.opened()
+		defer func() { p.Metrics.closed(start, err) }()
+
+		return h(&meteredConn{Conn: c, m: p.Metrics})
+	}
+}
+
+func (p *Passage) dialContext() context.Context {
+	return withDialObserver(context.Background(), p.Metrics.dialLatency)
+}
+
+func (p *Passage) handle(c net.Conn) error {
+	ctx := p.dialContext()
+	remote, err := p.r.AddrContext(ctx, p.c)
+	if err != nil {
+		return newPassageError(ErrorKindResolve, err)
+	}
+
+	return p.c.TunnelContext(ctx, c, remote)
+}
+
+func (p *Passage) handleProxy(c net.Conn) error {
+	return newPassageError(ErrorKindProxy, p.p.HandleContext(p.dialContext(), c, p.c))
+}
+
+func (p *Passage) handleBalanced(c net.Conn) error {
+	return p.b.HandleContext(p.dialContext(), c)
+}
+
+func (p *Passage) handleReverse(c net.Conn) error {
+	local, err := p.r.Addr(p.c)
+	if err != nil {
+		return newPassageError(ErrorKindResolve, err)
 	}
+
+	start := time.Now()
+	l, err := net.Dial(local.Network(), local.String())
+	if err != nil {
+		return fmt.Errorf("error dialing local: %s", err)
+	}
+
+	p.Metrics.dialLatency.Observe(time.Since(start))
+	tunnel(c, l)
+	return nil
+}
+
+// Stats returns the current values of the passage metrics
+func (p *Passage) Stats() PassageStats {
+	return p.Metrics.Snapshot()
+}
+
+// Conn returns the SSH connection of the passage, nil for balanced passages
+func (p *Passage) Conn() SSHConnection {
+	return p.c
+}
+
+func (p *Passage) Err() error {
+	if p.b != nil {
+		return p.b.Err()
+	}
+
+	return p.c.Err()
+}
+
+// Remote returns the description of where the connections are forwarded, the
+// remote, the proxy or the backends
+func (p *Passage) Remote() string {
+	switch {
+	case p.b != nil:
+		return p.b.String()
+	case p.p != nil:
+		return p.p.String()
+	}
+
+	return p.r.String()
 }
 
 func (p *Passage) Addr() string {
@@ -45,5 +225,17 @@ func (p *Passage) Addr() string {
 }
 
 func (p *Passage) String() string {
+	if p.b != nil {
+		return p.b.String()
+	}
+
+	if p.reverse {
+		return fmt.Sprintf("(%s)<-[%s]", p.c, p.r)
+	}
+
+	if p.p != nil {
+		return fmt.Sprintf("(%s)-[%s]", p.c, p.p)
+	}
+
 	return fmt.Sprintf("(%s)-[%s]", p.c, p.r)
 }
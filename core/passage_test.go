@@ -0,0 +1,82 @@
+package core
+
+import (
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type PassageSuite struct {
+	echo net.Listener
+	ssh  *sshServerFixture
+}
+
+var _ = Suite(&PassageSuite{})
+
+func (s *PassageSuite) SetUpTest(c *C) {
+	s.echo = newEchoServer(c)
+	s.ssh = newSSHServerFixture(c)
+}
+
+func (s *PassageSuite) TearDownTest(c *C) {
+	s.ssh.Close()
+	s.echo.Close()
+}
+
+func (s *PassageSuite) TestPassage(c *C) {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewPassage(conn, NewRemote("tcp", s.echo.Addr().String()))
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	assertEcho(c, p.Addr())
+}
+
+func (s *PassageSuite) TestReversePassage(c *C) {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewReversePassage(conn, NewRemote("tcp", s.echo.Addr().String()))
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	c.Assert(p.String(), Matches, `\(foo@.*\)<-\[.*/tcp\]`)
+	c.Assert(p.Remote(), Equals, s.echo.Addr().String()+"/tcp")
+	assertEcho(c, p.Addr())
+}
+
+func (s *PassageSuite) TestReversePassageUnresolved(c *C) {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewReversePassage(conn, NewRemote("tcp", s.echo.Addr().String()))
+	err := p.Start(NewUnresolvedAddr("tcp", "localhost:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	assertEcho(c, p.Addr())
+}
+
+func (s *PassageSuite) TestReversePassageReconnect(c *C) {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewReversePassage(conn, NewRemote("tcp", s.echo.Addr().String()))
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	addr := p.Addr()
+	s.ssh.CloseConnections()
+
+	for i := 0; i < 100 && p.Addr() == addr; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	c.Assert(p.Addr(), Not(Equals), addr)
+	assertEcho(c, p.Addr())
+}
+
+func assertEcho(c *C, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	c.Assert(err, IsNil)
+
+	assertEchoConn(c, conn)
+}
@@ -1,15 +1,23 @@
 package core
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"net"
-	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
 )
 
 type Remote interface {
 	Addr(SSHConnection) (net.Addr, error)
+	AddrContext(context.Context, SSHConnection) (net.Addr, error)
 	fmt.Stringer
 }
 
@@ -25,7 +33,19 @@ func NewRemote(network, address string) Remote {
 	}
 }
 
-func (r *addressRemote) Addr(SSHConnection) (net.Addr, error) {
+func (r *addressRemote) Addr(s SSHConnection) (net.Addr, error) {
+	return r.AddrContext(context.Background(), s)
+}
+
+func (r *addressRemote) AddrContext(ctx context.Context, _ SSHConnection) (net.Addr, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if r.network == "unix" {
+		return &net.UnixAddr{Name: r.address, Net: r.network}, nil
+	}
+
 	return net.ResolveTCPAddr(r.network, r.address)
 }
 
@@ -33,68 +53,299 @@ func (r *addressRemote) String() string {
 	return fmt.Sprintf("%s/%s", r.address, r.network)
 }
 
+const (
+	ContainerPolicyFirst      = "first"
+	ContainerPolicyRandom     = "random"
+	ContainerPolicyRoundRobin = "round-robin"
+)
+
+// ContainerSelector selects the containers of a container remote, a container
+// must match all the non-empty fields
+type ContainerSelector struct {
+	// Name of the container, matches the name exactly
+	Name string
+	// ID of the container, matches any ID with this prefix
+	ID string
+	// Image of the container, with or without tag
+	Image string
+	// Labels of the container, an empty value matches any value
+	Labels map[string]string
+	// Network where the IP of the container is taken from, if empty `bridge`
+	// or the only network of the container
+	Network string
+	// Policy used when several containers match, ContainerPolicyFirst (the
+	// default), ContainerPolicyRandom or ContainerPolicyRoundRobin
+	Policy string
+}
+
+func (s *ContainerSelector) match(c *container) bool {
+	if s.Name != "" && !c.hasName(s.Name) {
+		return false
+	}
+
+	if s.ID != "" && !strings.HasPrefix(c.ID, s.ID) {
+		return false
+	}
+
+	if s.Image != "" && c.Image != s.Image && !strings.HasPrefix(c.Image, s.Image+":") {
+		return false
+	}
+
+	for k, v := range s.Labels {
+		if value, ok := c.Labels[k]; !ok || (v != "" && value != v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *ContainerSelector) String() string {
+	var parts []string
+	if s.Name != "" {
+		parts = append(parts, s.Name)
+	}
+
+	if s.ID != "" {
+		parts = append(parts, "id="+s.ID)
+	}
+
+	if s.Image != "" {
+		parts = append(parts, "image="+s.Image)
+	}
+
+	var labels []string
+	for k, v := range s.Labels {
+		labels = append(labels, fmt.Sprintf("label=%s=%s", k, v))
+	}
+
+	sort.Strings(labels)
+	return strings.Join(append(parts, labels...), ",")
+}
+
 type containerRemote struct {
-	network   string
-	container string
-	address   string
-	port      string
+	network  string
+	selector ContainerSelector
+	port     string
+	endpoint DockerEndpoint
+	next     uint32
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// m guards the resolution cache, the last address and the API version
+	m        sync.Mutex
+	address  string
+	version  string
+	ips      []string
+	expires  time.Time
+	gen      int
+	lookup   *lookupCall
+	watching bool
+}
+
+// lookupCall is an in-flight resolution of the containers, shared by all the
+// concurrent callers
+type lookupCall struct {
+	done chan struct{}
+	ips  []string
+	err  error
 }
 
 func NewContainerRemote(network, container, port string) Remote {
-	return &containerRemote{
-		network:   network,
-		container: container,
-		port:      port,
+	return NewContainerRemoteWithEndpoint(network, container, port, nil)
+}
+
+// NewContainerRemoteWithEndpoint returns a container remote, looking up the
+// container at the given Docker endpoint, by default DefaultDockerEndpoint
+func NewContainerRemoteWithEndpoint(network, container, port string, e *DockerEndpoint) Remote {
+	return NewContainerRemoteWithSelector(network, &ContainerSelector{Name: container}, port, e)
+}
+
+// NewContainerRemoteWithSelector returns a container remote connecting to one
+// of the containers matched by the selector
+func NewContainerRemoteWithSelector(network string, s *ContainerSelector, port string, e *DockerEndpoint) Remote {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &containerRemote{
+		network:  network,
+		selector: *s,
+		port:     port,
+		ctx:      ctx,
+		cancel:   cancel,
 	}
+
+	if e != nil {
+		r.endpoint = *e
+	}
+
+	return r
 }
 
 func (r *containerRemote) Addr(s SSHConnection) (net.Addr, error) {
-	c := r.buildClient(s)
-	if err := r.getContainerIP(c); err != nil {
+	return r.AddrContext(context.Background(), s)
+}
+
+func (r *containerRemote) AddrContext(ctx context.Context, s SSHConnection) (net.Addr, error) {
+	ips, err := r.resolve(ctx, s)
+	if err != nil {
 		return nil, err
 	}
 
-	return net.ResolveTCPAddr("tcp", net.JoinHostPort(r.address, r.port))
+	address := r.pick(ips)
+
+	r.m.Lock()
+	r.address = address
+	r.m.Unlock()
+
+	return net.ResolveTCPAddr("tcp", net.JoinHostPort(address, r.port))
 }
 
-func (r *containerRemote) buildClient(s SSHConnection) *http.Client {
-	return &http.Client{
-		Transport: &http.Transport{
-			ResponseHeaderTimeout: time.Second * 2,
-			Dial: func(network, address string) (net.Conn, error) {
-				a, err := net.ResolveTCPAddr(network, address)
-				if err != nil {
-					return nil, err
-				}
+// resolve returns the IPs of the matching containers from the cache, if not
+// expired, or from an in-flight lookup shared with the other callers
+func (r *containerRemote) resolve(ctx context.Context, s SSHConnection) ([]string, error) {
+	r.m.Lock()
+	if r.ips != nil && time.Now().Before(r.expires) {
+		ips := r.ips
+		r.m.Unlock()
+		return ips, nil
+	}
+
+	call := r.lookup
+	if call == nil {
+		call = &lookupCall{done: make(chan struct{})}
+		r.lookup = call
+		go r.doLookup(s, call, r.gen)
+	}
+	r.m.Unlock()
 
-				return s.Conn(a)
-			},
-		},
+	select {
+	case <-call.done:
+		return call.ips, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
-func (r *containerRemote) getContainerIP(c *http.Client) error {
-	l, err := r.getContainers(c)
-	if err != nil {
-		return err
+func (r *containerRemote) doLookup(s SSHConnection, call *lookupCall, gen int) {
+	defer close(call.done)
+
+	c, err := r.buildClient(s)
+	if err == nil {
+		call.ips, call.err = r.getContainerIPs(r.ctx, c)
+	} else {
+		call.err = err
 	}
 
-	container, err := r.matchContainer(l)
-	if err != nil {
-		return err
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.lookup = nil
+	if call.err != nil {
+		return
 	}
 
-	n, ok := container.NetworkSettings.Networks["bridge"]
-	if !ok {
-		return fmt.Errorf("container: not supported networks")
+	r.version = c.version
+	if r.endpoint.CacheTTL > 0 && r.gen == gen {
+		r.ips, r.expires = call.ips, time.Now().Add(r.endpoint.CacheTTL)
 	}
 
-	r.address = n.IPAddress
+	r.watch(s)
+}
+
+func (r *containerRemote) invalidate() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.gen++
+	r.ips = nil
+}
+
+// watch starts following the Docker events, if enabled and not started yet,
+// once a lookup succeeds, it must be called holding m
+func (r *containerRemote) watch(s SSHConnection) {
+	if !r.endpoint.WatchEvents || r.watching || r.ctx.Err() != nil {
+		return
+	}
+
+	r.watching = true
+	go r.watchEvents(s)
+}
+
+// watchEvents follows the Docker events until the remote is closed. The stream
+// doesn't keep an on-demand server in use, once closed idle the watch stops
+// until the next lookup.
+func (r *containerRemote) watchEvents(s SSHConnection) {
+	ctx := withBackground(r.ctx)
+	for retry := 0; ; retry++ {
+		var received bool
+		c, err := r.buildClient(s)
+		if err == nil {
+			err = c.events(ctx, func() {
+				received = true
+				r.invalidate()
+			})
+		}
+
+		// the events sent while not connected are lost
+		r.invalidate()
+		if r.ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, errIdle) {
+			r.m.Lock()
+			r.watching = false
+			r.m.Unlock()
+			return
+		}
+
+		if received {
+			retry = 0
+		}
+
+		log15.Debug("docker events stream closed", "remote", r, "error", err)
+
+		t := time.NewTimer(DefaultBackoff.Delay(retry))
+		select {
+		case <-t.C:
+		case <-r.ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// Close stops following the Docker events and the in-flight lookups
+func (r *containerRemote) Close() error {
+	r.cancel()
 	return nil
 }
 
+func (r *containerRemote) buildClient(s SSHConnection) (*dockerClient, error) {
+	e := r.endpoint
+
+	r.m.Lock()
+	if e.APIVersion == "" {
+		e.APIVersion = r.version
+	}
+	r.m.Unlock()
+
+	return newDockerClient(s, &e)
+}
+
+func (r *containerRemote) getContainerIPs(ctx context.Context, c *dockerClient) ([]string, error) {
+	l, err := r.getContainers(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.matchContainers(l)
+}
+
 type container struct {
+	ID              string `json:"Id"`
 	Names           []string
+	Image           string
+	Labels          map[string]string
 	NetworkSettings struct {
 		Networks map[string]struct {
 			IPAddress string
@@ -102,40 +353,80 @@ type container struct {
 	}
 }
 
-func (r *containerRemote) matchContainer(l []*container) (*container, error) {
-	var container *container
-	for _, c := range l {
-		for _, name := range c.Names {
-			if name == fmt.Sprintf("/%s", r.container) {
-				container = c
+func (c *container) hasName(name string) bool {
+	for _, n := range c.Names {
+		if n == "/"+name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *container) ip(network string) (string, bool) {
+	networks := c.NetworkSettings.Networks
+	if network == "" {
+		network = "bridge"
+		if _, ok := networks[network]; !ok && len(networks) == 1 {
+			for name := range networks {
+				network = name
 			}
 		}
 	}
 
-	if container == nil {
-		return nil, fmt.Errorf("container %q not found", r.container)
+	n, ok := networks[network]
+	if !ok || n.IPAddress == "" {
+		return "", false
 	}
 
-	return container, nil
+	return n.IPAddress, true
 }
 
-func (r *containerRemote) getContainers(c *http.Client) ([]*container, error) {
-	req, err := http.NewRequest("GET", "http://localhost:2375/containers/json", nil)
-	if err != nil {
-		return nil, err
+// matchContainers returns the IPs of the matching containers, in the order
+// returned by the Docker API
+func (r *containerRemote) matchContainers(l []*container) ([]string, error) {
+	var matched bool
+	var ips []string
+	for _, c := range l {
+		if !r.selector.match(c) {
+			continue
+		}
+
+		matched = true
+		if ip, ok := c.ip(r.selector.Network); ok {
+			ips = append(ips, ip)
+		}
 	}
 
-	res, err := c.Do(req)
-	if err != nil {
-		return nil, err
+	if !matched {
+		return nil, fmt.Errorf("container %q not found", &r.selector)
+	}
+
+	if len(ips) == 0 && r.selector.Network != "" {
+		return nil, fmt.Errorf("container %q: not connected to network %q", &r.selector, r.selector.Network)
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("container %q: not supported networks, network must be set", &r.selector)
 	}
 
-	dec := json.NewDecoder(res.Body)
-	defer res.Body.Close()
+	return ips, nil
+}
+
+func (r *containerRemote) pick(ips []string) string {
+	switch r.selector.Policy {
+	case ContainerPolicyRandom:
+		return ips[rand.Intn(len(ips))]
+	case ContainerPolicyRoundRobin:
+		return ips[int(atomic.AddUint32(&r.next, 1)-1)%len(ips)]
+	}
 
+	return ips[0]
+}
+
+func (r *containerRemote) getContainers(ctx context.Context, c *dockerClient) ([]*container, error) {
 	result := []*container{}
-	err = dec.Decode(&result)
-	if err != nil {
+	if err := c.get(ctx, "/containers/json", &result); err != nil {
 		return nil, err
 	}
 
@@ -143,10 +434,13 @@ func (r *containerRemote) getContainers(c *http.Client) ([]*container, error) {
 }
 
 func (r *containerRemote) String() string {
+	r.m.Lock()
 	a := r.address
+	r.m.Unlock()
+
 	if a == "" {
 		a = ":"
 	}
 
-	return fmt.Sprintf("<container=%s>%s:%s/%s", r.container, a, r.port, r.network)
+	return fmt.Sprintf("<container=%s>%s:%s/%s", &r.selector, a, r.port, r.network)
 }
@@ -1,12 +1,19 @@
 package core
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"golang.org/x/crypto/ssh"
 	. "gopkg.in/check.v1"
 )
 
@@ -22,18 +29,286 @@ func (s *RemoteSuite) TestNewRemote(c *C) {
 	c.Assert(a.String(), Equals, "127.0.0.1:42")
 }
 
+func (s *RemoteSuite) TestNewRemoteContextCanceled(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r := NewRemote("tcp", "localhost:42")
+	_, err := r.AddrContext(ctx, nil)
+	c.Assert(err, Equals, context.Canceled)
+}
+
 func (s *RemoteSuite) TestRemoteString(c *C) {
 	r := NewRemote("tcp", ":42")
 	c.Assert(r.String(), Equals, ":42/tcp")
 }
 
 func (s *RemoteSuite) TestGetContainerIP(c *C) {
+	ssh := &SSHFixture{}
 	r := NewContainerRemote("tcp", "foo", "42")
-	a, err := r.Addr(&SSHFixture{})
+	a, err := r.Addr(ssh)
 	c.Assert(err, IsNil)
 	c.Assert(a.Network(), Equals, "tcp")
 	c.Assert(a.String(), Equals, "172.17.0.2:42")
 	c.Assert(r.String(), Equals, "<container=foo>172.17.0.2:42/tcp")
+	c.Assert(ssh.dialed[0], Equals, "unix:/var/run/docker.sock")
+	c.Assert(ssh.requests, DeepEquals, []string{"/_ping", "/v1.40/containers/json"})
+
+	_, err = r.Addr(ssh)
+	c.Assert(err, IsNil)
+	c.Assert(ssh.requests[2:], DeepEquals, []string{"/v1.40/containers/json"})
+}
+
+func (s *RemoteSuite) TestGetContainerIPEndpoint(c *C) {
+	ssh := &SSHFixture{APIVersion: "1.45"}
+	r := NewContainerRemoteWithEndpoint("tcp", "foo", "42", &DockerEndpoint{
+		Address: "tcp://localhost:2375",
+	})
+
+	_, err := r.Addr(ssh)
+	c.Assert(err, ErrorMatches, "docker: unexpected status .*")
+	c.Assert(ssh.dialed[0], Equals, "tcp:localhost:2375")
+	c.Assert(ssh.requests, DeepEquals, []string{"/_ping", "/v1.41/containers/json"})
+
+	ssh = &SSHFixture{}
+	r = NewContainerRemoteWithEndpoint("tcp", "foo", "42", &DockerEndpoint{APIVersion: "1.40"})
+	_, err = r.Addr(ssh)
+	c.Assert(err, IsNil)
+	c.Assert(ssh.requests, DeepEquals, []string{"/v1.40/containers/json"})
+}
+
+const composeContainers = `[
+	{"Id":"4f1e2a","Names":["/app_web_2"],"Image":"nginx:1.21","Labels":{"com.docker.compose.service":"web"},
+	 "NetworkSettings":{"Networks":{"app_default":{"IPAddress":"172.20.0.3"}}}},
+	{"Id":"9c3b7d","Names":["/app_web_1"],"Image":"nginx:1.21","Labels":{"com.docker.compose.service":"web"},
+	 "NetworkSettings":{"Networks":{"app_default":{"IPAddress":"172.20.0.2"},"app_backend":{"IPAddress":"172.21.0.2"}}}},
+	{"Id":"a0d5e8","Names":["/app_db_1"],"Image":"postgres","Labels":{"com.docker.compose.service":"db"},
+	 "NetworkSettings":{"Networks":{"app_backend":{"IPAddress":"172.21.0.3"}}}}
+]`
+
+func (s *RemoteSuite) TestGetContainerIPSelector(c *C) {
+	ssh := &SSHFixture{Containers: composeContainers}
+
+	for _, t := range []struct {
+		selector ContainerSelector
+		ip       string
+	}{
+		{ContainerSelector{Name: "app_web_1", Network: "app_default"}, "172.20.0.2"},
+		{ContainerSelector{ID: "a0d"}, "172.21.0.3"},
+		{ContainerSelector{Image: "postgres"}, "172.21.0.3"},
+		{ContainerSelector{Image: "nginx"}, "172.20.0.3"},
+		{ContainerSelector{Image: "nginx", Network: "app_backend"}, "172.21.0.2"},
+		{ContainerSelector{Labels: map[string]string{"com.docker.compose.service": "db"}}, "172.21.0.3"},
+	} {
+		r := NewContainerRemoteWithSelector("tcp", &t.selector, "80", nil)
+		a, err := r.Addr(ssh)
+		c.Assert(err, IsNil, Commentf("%s", &t.selector))
+		c.Assert(a.String(), Equals, t.ip+":80", Commentf("%s", &t.selector))
+	}
+}
+
+func (s *RemoteSuite) TestGetContainerIPRoundRobin(c *C) {
+	ssh := &SSHFixture{Containers: composeContainers}
+	r := NewContainerRemoteWithSelector("tcp", &ContainerSelector{
+		Labels:  map[string]string{"com.docker.compose.service": "web"},
+		Network: "app_default",
+		Policy:  ContainerPolicyRoundRobin,
+	}, "80", nil)
+
+	var ips []string
+	for i := 0; i < 3; i++ {
+		a, err := r.Addr(ssh)
+		c.Assert(err, IsNil)
+		ips = append(ips, a.String())
+	}
+
+	c.Assert(ips, DeepEquals, []string{"172.20.0.3:80", "172.20.0.2:80", "172.20.0.3:80"})
+}
+
+func (s *RemoteSuite) TestGetContainerIPErrors(c *C) {
+	ssh := &SSHFixture{Containers: composeContainers}
+	r := NewContainerRemote("tcp", "app_web", "80")
+	_, err := r.Addr(ssh)
+	c.Assert(err, ErrorMatches, `container "app_web" not found`)
+
+	r = NewContainerRemoteWithSelector("tcp", &ContainerSelector{ID: "a0d", Network: "app_default"}, "80", nil)
+	_, err = r.Addr(ssh)
+	c.Assert(err, ErrorMatches, `container "id=a0d": not connected to network "app_default"`)
+
+	r = NewContainerRemote("tcp", "app_web_1", "80")
+	_, err = r.Addr(ssh)
+	c.Assert(err, ErrorMatches, `container "app_web_1": not supported networks, network must be set`)
+}
+
+func (s *RemoteSuite) TestGetContainerIPCache(c *C) {
+	ssh := &SSHFixture{}
+	r := NewContainerRemoteWithEndpoint("tcp", "foo", "42", &DockerEndpoint{
+		APIVersion: "1.40",
+		CacheTTL:   100 * time.Millisecond,
+	})
+
+	for i := 0; i < 3; i++ {
+		a, err := r.Addr(ssh)
+		c.Assert(err, IsNil)
+		c.Assert(a.String(), Equals, "172.17.0.2:42")
+	}
+
+	c.Assert(ssh.count("/v1.40/containers/json"), Equals, 1)
+
+	time.Sleep(200 * time.Millisecond)
+	_, err := r.Addr(ssh)
+	c.Assert(err, IsNil)
+	c.Assert(ssh.count("/v1.40/containers/json"), Equals, 2)
+}
+
+func (s *RemoteSuite) TestGetContainerIPConcurrent(c *C) {
+	ssh := &SSHFixture{Block: make(chan struct{})}
+	r := NewContainerRemoteWithEndpoint("tcp", "foo", "42", &DockerEndpoint{APIVersion: "1.40"})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := r.Addr(ssh)
+			c.Check(err, IsNil)
+			c.Check(a.String(), Equals, "172.17.0.2:42")
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(ssh.Block)
+	wg.Wait()
+
+	c.Assert(ssh.count("/v1.40/containers/json"), Equals, 1)
+}
+
+func (s *RemoteSuite) TestGetContainerIPEvents(c *C) {
+	ssh := &SSHFixture{Events: make(chan string)}
+	r := NewContainerRemoteWithEndpoint("tcp", "foo", "42", &DockerEndpoint{
+		APIVersion:  "1.40",
+		CacheTTL:    time.Hour,
+		WatchEvents: true,
+	})
+	defer r.(io.Closer).Close()
+
+	_, err := r.Addr(ssh)
+	c.Assert(err, IsNil)
+
+	ssh.Events <- `{"Type":"container","Action":"start"}`
+	for i := 0; ; i++ {
+		c.Assert(i < 100, Equals, true)
+
+		r.(*containerRemote).m.Lock()
+		invalidated := r.(*containerRemote).ips == nil
+		r.(*containerRemote).m.Unlock()
+		if invalidated {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = r.Addr(ssh)
+	c.Assert(err, IsNil)
+
+	c.Assert(ssh.count("/v1.40/events"), Equals, 1)
+	c.Assert(ssh.count("/v1.40/containers/json"), Equals, 2)
+}
+
+func (s *RemoteSuite) TestGetContainerIPReleasesConn(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	docker, socket := newDockerSocketFixture(c, "172.17.0.2")
+	defer docker.Close()
+
+	conn := NewSSHConnection(server.Addr(), server.ClientConfig(), 0)
+	defer conn.(io.Closer).Close()
+
+	r := NewContainerRemoteWithEndpoint("tcp", "foo", "42", &DockerEndpoint{
+		Address:    "unix://" + socket,
+		APIVersion: "1.40",
+	})
+
+	for i := 0; i < 3; i++ {
+		a, err := r.Addr(conn)
+		c.Assert(err, IsNil)
+		c.Assert(a.String(), Equals, "172.17.0.2:42")
+	}
+
+	for i := 0; activeConns(conn) != 0; i++ {
+		c.Assert(i < 100, Equals, true, Commentf("active: %d", activeConns(conn)))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *RemoteSuite) TestGetContainerIPEventsIdle(c *C) {
+	server := newSSHServerFixture(c)
+	defer server.Close()
+
+	docker, socket := newDockerSocketFixture(c, "172.17.0.2")
+	defer docker.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, server.Addr(), server.ClientConfig(), SSHConnectionOptions{
+		Mode:        ConnectionModeOnDemand,
+		IdleTimeout: 50 * time.Millisecond,
+	})
+	defer conn.(io.Closer).Close()
+
+	r := NewContainerRemoteWithEndpoint("tcp", "foo", "42", &DockerEndpoint{
+		Address:     "unix://" + socket,
+		APIVersion:  "1.40",
+		CacheTTL:    time.Hour,
+		WatchEvents: true,
+	})
+	defer r.(io.Closer).Close()
+
+	for i := 1; i <= 2; i++ {
+		a, err := r.Addr(conn)
+		c.Assert(err, IsNil)
+		c.Assert(a.String(), Equals, "172.17.0.2:42")
+
+		for j := 0; conn.(*sshConnection).Stats().IdleTimeouts != uint64(i); j++ {
+			c.Assert(j < 100, Equals, true, Commentf("the events keep the server connected"))
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func (s *RemoteSuite) TestContainerSelectorString(c *C) {
+	selector := &ContainerSelector{
+		Name:   "foo",
+		Image:  "nginx",
+		Labels: map[string]string{"b": "2", "a": "1"},
+	}
+
+	c.Assert(selector.String(), Equals, "foo,image=nginx,label=a=1,label=b=2")
+}
+
+func (s *RemoteSuite) TestParseDockerEndpoint(c *C) {
+	network, address, err := ParseDockerEndpoint("unix:///var/run/docker.sock")
+	c.Assert(err, IsNil)
+	c.Assert(network, Equals, "unix")
+	c.Assert(address, Equals, "/var/run/docker.sock")
+
+	network, address, err = ParseDockerEndpoint("tcp://10.0.0.1:2376")
+	c.Assert(err, IsNil)
+	c.Assert(network, Equals, "tcp")
+	c.Assert(address, Equals, "10.0.0.1:2376")
+
+	_, _, err = ParseDockerEndpoint("http://10.0.0.1:2376")
+	c.Assert(err, NotNil)
+
+	_, _, err = ParseDockerEndpoint("tcp://10.0.0.1")
+	c.Assert(err, NotNil)
+}
+
+func (s *RemoteSuite) TestCompareVersions(c *C) {
+	c.Assert(compareVersions("1.40", "1.41"), Equals, -1)
+	c.Assert(compareVersions("1.41", "1.41"), Equals, 0)
+	c.Assert(compareVersions("1.9", "1.24"), Equals, -1)
+	c.Assert(compareVersions("2.0", "1.41"), Equals, 1)
 }
 
 func (s *RemoteSuite) TestContainerRemoteString(c *C) {
@@ -41,21 +316,155 @@ func (s *RemoteSuite) TestContainerRemoteString(c *C) {
 	c.Assert(r.String(), Equals, "<container=foo>::42/tcp")
 }
 
-type SSHFixture struct{}
+type SSHFixture struct {
+	// APIVersion returned by the Docker API ping, by default 1.40
+	APIVersion string
+	// Containers is the JSON returned listing the containers, by default a
+	// single container named foo
+	Containers string
+	// Block, if not nil, holds the containers requests until closed
+	Block chan struct{}
+	// Events are sent to the clients following the Docker events
+	Events chan string
+	// Handler, if not nil, serves the requests instead of the Docker API
+	Handler http.Handler
+
+	m        sync.Mutex
+	dialed   []string
+	requests []string
+}
 
 func (s *SSHFixture) Conn(a net.Addr) (net.Conn, error) {
+	s.m.Lock()
+	s.dialed = append(s.dialed, fmt.Sprintf("%s:%s", a.Network(), a))
+	s.m.Unlock()
+
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, `[{"Id":"aaa1a054326e8d1bb28617cc04230b16394972d92c9b545c5ab1571f23810524","Names":["/foo"],"Image":"swarm","ImageID":"sha256:291cbe419fe661bfff00d4b2ed7c599f348c7001c17042b2b9b369c495819715","Command":"foo","Created":1458357052,"Ports":[{"PrivatePort":2375,"Type":"tcp"},{"IP":"0.0.0.0","PrivatePort":4000,"PublicPort":4000,"Type":"tcp"}],"SizeRootFs":18106629,"Labels":{},"Status":"Up 39 hours","HostConfig":{"NetworkMode":"default"},"NetworkSettings":{"Networks":{"bridge":{"IPAMConfig":null,"Links":null,"Aliases":null,"NetworkID":"","EndpointID":"c05c5f539e90a400704f8e309cff49b30e53d428217ba2aec28ace6e486851ca","Gateway":"172.17.0.1","IPAddress":"172.17.0.2","IPPrefixLen":16,"IPv6Gateway":"","GlobalIPv6Address":"","GlobalIPv6PrefixLen":0,"MacAddress":"02:42:ac:11:00:02"}}}}]`)
+		s.m.Lock()
+		s.requests = append(s.requests, r.URL.Path)
+		s.m.Unlock()
+
+		if s.Handler != nil {
+			s.Handler.ServeHTTP(w, r)
+			return
+		}
+
+		version := s.APIVersion
+		if version == "" {
+			version = "1.40"
+		}
+
+		switch r.URL.Path {
+		case "/_ping":
+			w.Header().Set("API-Version", version)
+			fmt.Fprint(w, "OK")
+		case fmt.Sprintf("/v%s/events", version):
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case e := <-s.Events:
+					fmt.Fprintln(w, e)
+					w.(http.Flusher).Flush()
+				case <-r.Context().Done():
+					return
+				}
+			}
+		case fmt.Sprintf("/v%s/containers/json", version):
+			if s.Block != nil {
+				<-s.Block
+			}
+
+			if s.Containers != "" {
+				fmt.Fprintln(w, s.Containers)
+				return
+			}
+
+			fmt.Fprintln(w, `[{"Id":"aaa1a054326e8d1bb28617cc04230b16394972d92c9b545c5ab1571f23810524","Names":["/foo"],"Image":"swarm","ImageID":"sha256:291cbe419fe661bfff00d4b2ed7c599f348c7001c17042b2b9b369c495819715","Command":"foo","Created":1458357052,"Ports":[{"PrivatePort":2375,"Type":"tcp"},{"IP":"0.0.0.0","PrivatePort":4000,"PublicPort":4000,"Type":"tcp"}],"SizeRootFs":18106629,"Labels":{},"Status":"Up 39 hours","HostConfig":{"NetworkMode":"default"},"NetworkSettings":{"Networks":{"bridge":{"IPAMConfig":null,"Links":null,"Aliases":null,"NetworkID":"","EndpointID":"c05c5f539e90a400704f8e309cff49b30e53d428217ba2aec28ace6e486851ca","Gateway":"172.17.0.1","IPAddress":"172.17.0.2","IPPrefixLen":16,"IPv6Gateway":"","GlobalIPv6Address":"","GlobalIPv6PrefixLen":0,"MacAddress":"02:42:ac:11:00:02"}}}}]`)
+		default:
+			http.NotFound(w, r)
+		}
 	}))
 
 	url, _ := url.Parse(ts.URL)
 	return net.Dial("tcp", url.Host)
 }
 
+func (s *SSHFixture) count(path string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var n int
+	for _, r := range s.requests {
+		if r == path {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (s *SSHFixture) DialContext(ctx context.Context, a net.Addr) (net.Conn, error) {
+	return s.Conn(a)
+}
+
+func (s *SSHFixture) Listen(a net.Addr) (net.Listener, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (s *SSHFixture) ListenContext(ctx context.Context, a net.Addr) (net.Listener, error) {
+	return s.Listen(a)
+}
+
 func (s *SSHFixture) Tunnel(c net.Conn, a net.Addr) error {
 	return nil
 }
 
+func (s *SSHFixture) TunnelContext(ctx context.Context, c net.Conn, a net.Addr) error {
+	return nil
+}
+
+func (s *SSHFixture) Config() *ssh.ClientConfig {
+	return &ssh.ClientConfig{}
+}
+
+func (s *SSHFixture) Err() error {
+	return nil
+}
+
 func (s *SSHFixture) String() string {
 	return ""
 }
+
+// newDockerSocketFixture returns a Docker API listening on an unix socket,
+// listing a container named foo with the given IP, the events are streamed
+// without sending any
+func newDockerSocketFixture(c *C, ip string) (*httptest.Server, string) {
+	socket := filepath.Join(c.MkDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	c.Assert(err, IsNil)
+
+	docker := &httptest.Server{Listener: l, Config: &http.Server{Handler: http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasSuffix(r.URL.Path, "/events") {
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				return
+			}
+
+			fmt.Fprintf(w, `[{"Id":"aaa1a0","Names":["/foo"],"NetworkSettings":{"Networks":{"bridge":{"IPAddress":%q}}}}]`, ip)
+		},
+	)}}
+
+	docker.Start()
+	return docker, socket
+}
+
+// activeConns returns the number of tunnels and listeners using the client
+func activeConns(conn SSHConnection) int {
+	c := conn.(*sshConnection)
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.active
+}
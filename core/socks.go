@@ -0,0 +1,312 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socksCmdConnect = 0x01
+
+	socks5AuthNone     = 0x00
+	socks5AuthPassword = 0x02
+	socks5AuthNoMethod = 0xff
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5Succeeded          = 0x00
+	socks5NotAllowed         = 0x02
+	socks5HostUnreachable    = 0x04
+	socks5CmdNotSupported    = 0x07
+	socks5AddrNotSupported   = 0x08
+	socks4Granted            = 0x5a
+	socks4Rejected           = 0x5b
+	socksPasswordAuthVersion = 0x01
+)
+
+var ErrSOCKSAuthFailed = errors.New("socks: authentication failed")
+
+type SOCKSProxy struct {
+	users  map[string]string
+	filter *DestinationFilter
+}
+
+func NewSOCKSProxy(users map[string]string, f *DestinationFilter) *SOCKSProxy {
+	return &SOCKSProxy{users: users, filter: f}
+}
+
+func (p *SOCKSProxy) Handle(c net.Conn, s SSHConnection) error {
+	return p.HandleContext(context.Background(), c, s)
+}
+
+func (p *SOCKSProxy) HandleContext(ctx context.Context, c net.Conn, s SSHConnection) error {
+	var version [1]byte
+	if _, err := io.ReadFull(c, version[:]); err != nil {
+		return err
+	}
+
+	switch version[0] {
+	case socks5Version:
+		return p.handleSOCKS5(ctx, c, s)
+	case socks4Version:
+		return p.handleSOCKS4(ctx, c, s)
+	}
+
+	return fmt.Errorf("socks: unsupported version %d", version[0])
+}
+
+func (p *SOCKSProxy) handleSOCKS5(ctx context.Context, c net.Conn, s SSHConnection) error {
+	if err := p.negotiateSOCKS5Auth(c); err != nil {
+		return err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return err
+	}
+
+	host, err := readSOCKS5Addr(c, header[3])
+	if err != nil {
+		writeSOCKS5Reply(c, socks5AddrNotSupported)
+		return err
+	}
+
+	port, err := readPort(c)
+	if err != nil {
+		return err
+	}
+
+	if header[1] != socksCmdConnect {
+		writeSOCKS5Reply(c, socks5CmdNotSupported)
+		return fmt.Errorf("socks: unsupported command %d", header[1])
+	}
+
+	if !p.filter.Allowed(host, port) {
+		writeSOCKS5Reply(c, socks5NotAllowed)
+		return fmt.Errorf("socks: destination %s not allowed", net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+
+	r, err := p.dial(ctx, s, host, port)
+	if err != nil {
+		writeSOCKS5Reply(c, socks5HostUnreachable)
+		return err
+	}
+
+	if err := writeSOCKS5Reply(c, socks5Succeeded); err != nil {
+		r.Close()
+		return err
+	}
+
+	tunnel(c, r)
+	return nil
+}
+
+func (p *SOCKSProxy) negotiateSOCKS5Auth(c net.Conn) error {
+	var n [1]byte
+	if _, err := io.ReadFull(c, n[:]); err != nil {
+		return err
+	}
+
+	methods := make([]byte, n[0])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return err
+	}
+
+	required := byte(socks5AuthNone)
+	if len(p.users) != 0 {
+		required = socks5AuthPassword
+	}
+
+	for _, m := range methods {
+		if m != required {
+			continue
+		}
+
+		if _, err := c.Write([]byte{socks5Version, required}); err != nil {
+			return err
+		}
+
+		if required == socks5AuthPassword {
+			return p.authenticate(c)
+		}
+
+		return nil
+	}
+
+	c.Write([]byte{socks5Version, socks5AuthNoMethod})
+	return ErrSOCKSAuthFailed
+}
+
+func (p *SOCKSProxy) authenticate(c net.Conn) error {
+	var version [1]byte
+	if _, err := io.ReadFull(c, version[:]); err != nil {
+		return err
+	}
+
+	if version[0] != socksPasswordAuthVersion {
+		return fmt.Errorf("socks: unsupported auth version %d", version[0])
+	}
+
+	user, err := readString(c)
+	if err != nil {
+		return err
+	}
+
+	password, err := readString(c)
+	if err != nil {
+		return err
+	}
+
+	if expected, ok := p.users[user]; !ok || expected != password {
+		c.Write([]byte{socksPasswordAuthVersion, 0x01})
+		return ErrSOCKSAuthFailed
+	}
+
+	_, err = c.Write([]byte{socksPasswordAuthVersion, 0x00})
+	return err
+}
+
+func (p *SOCKSProxy) handleSOCKS4(ctx context.Context, c net.Conn, s SSHConnection) error {
+	var header [7]byte
+	if _, err := io.ReadFull(c, header[:]); err != nil {
+		return err
+	}
+
+	if _, err := readNullString(c); err != nil {
+		return err
+	}
+
+	port := int(binary.BigEndian.Uint16(header[1:3]))
+	ip := net.IP(header[3:7])
+	host := ip.String()
+
+	// SOCKS4a, the host is sent as a domain after the user id
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		var err error
+		if host, err = readNullString(c); err != nil {
+			return err
+		}
+	}
+
+	if len(p.users) != 0 {
+		writeSOCKS4Reply(c, socks4Rejected)
+		return fmt.Errorf("socks: socks4 doesn't support password authentication")
+	}
+
+	if header[0] != socksCmdConnect {
+		writeSOCKS4Reply(c, socks4Rejected)
+		return fmt.Errorf("socks: unsupported command %d", header[0])
+	}
+
+	if !p.filter.Allowed(host, port) {
+		writeSOCKS4Reply(c, socks4Rejected)
+		return fmt.Errorf("socks: destination %s not allowed", net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+
+	r, err := p.dial(ctx, s, host, port)
+	if err != nil {
+		writeSOCKS4Reply(c, socks4Rejected)
+		return err
+	}
+
+	if err := writeSOCKS4Reply(c, socks4Granted); err != nil {
+		r.Close()
+		return err
+	}
+
+	tunnel(c, r)
+	return nil
+}
+
+// dial dials the destination once, the client is waiting for the reply and
+// may try another one
+func (p *SOCKSProxy) dial(ctx context.Context, s SSHConnection, host string, port int) (net.Conn, error) {
+	return dialOnce(ctx, s, &netAddr{"tcp", net.JoinHostPort(host, strconv.Itoa(port))})
+}
+
+func (p *SOCKSProxy) String() string {
+	return "socks"
+}
+
+func readSOCKS5Addr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		size := net.IPv4len
+		if atyp == socks5AddrIPv6 {
+			size = net.IPv6len
+		}
+
+		ip := make(net.IP, size)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+
+		return ip.String(), nil
+	case socks5AddrDomain:
+		return readString(r)
+	}
+
+	return "", fmt.Errorf("socks: unsupported address type %d", atyp)
+}
+
+func readPort(r io.Reader) (int, error) {
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return 0, err
+	}
+
+	return int(binary.BigEndian.Uint16(port[:])), nil
+}
+
+func readString(r io.Reader) (string, error) {
+	var size [1]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", err
+	}
+
+	s := make([]byte, size[0])
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+
+	return string(s), nil
+}
+
+func readNullString(r io.Reader) (string, error) {
+	var s []byte
+	var b [1]byte
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return "", err
+		}
+
+		if b[0] == 0 {
+			return string(s), nil
+		}
+
+		s = append(s, b[0])
+		if len(s) > 255 {
+			return "", fmt.Errorf("socks: string too long")
+		}
+	}
+}
+
+func writeSOCKS5Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socks5Version, rep, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func writeSOCKS4Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{0x00, rep, 0, 0, 0, 0, 0, 0})
+	return err
+}
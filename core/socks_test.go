@@ -0,0 +1,202 @@
+package core
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SOCKSSuite struct {
+	echo net.Listener
+	ssh  *sshServerFixture
+}
+
+var _ = Suite(&SOCKSSuite{})
+
+func (s *SOCKSSuite) SetUpTest(c *C) {
+	s.echo = newEchoServer(c)
+	s.ssh = newSSHServerFixture(c)
+}
+
+func (s *SOCKSSuite) TearDownTest(c *C) {
+	s.ssh.Close()
+	s.echo.Close()
+}
+
+func (s *SOCKSSuite) startPassage(c *C, proxy *SOCKSProxy) *Passage {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewProxyPassage(conn, proxy)
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+
+	return p
+}
+
+func (s *SOCKSSuite) echoPort() uint16 {
+	return uint16(s.echo.Addr().(*net.TCPAddr).Port)
+}
+
+func (s *SOCKSSuite) TestSOCKS5(c *C) {
+	p := s.startPassage(c, NewSOCKSProxy(nil, nil))
+	defer p.Close()
+
+	conn := dialSOCKS(c, p)
+	write(c, conn, 0x05, 0x01, 0x00)
+	c.Assert(read(c, conn, 2), DeepEquals, []byte{0x05, 0x00})
+
+	write(c, conn, 0x05, 0x01, 0x00, 0x03, 9)
+	write(c, conn, []byte("localhost")...)
+	write(c, conn, port(s.echoPort())...)
+	c.Assert(read(c, conn, 10)[1], Equals, byte(0x00))
+
+	assertEchoConn(c, conn)
+}
+
+func (s *SOCKSSuite) TestSOCKS5Password(c *C) {
+	p := s.startPassage(c, NewSOCKSProxy(map[string]string{"foo": "bar"}, nil))
+	defer p.Close()
+
+	conn := dialSOCKS(c, p)
+	write(c, conn, 0x05, 0x02, 0x00, 0x02)
+	c.Assert(read(c, conn, 2), DeepEquals, []byte{0x05, 0x02})
+
+	write(c, conn, 0x01, 3, 'f', 'o', 'o', 3, 'b', 'a', 'r')
+	c.Assert(read(c, conn, 2), DeepEquals, []byte{0x01, 0x00})
+
+	write(c, conn, 0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1)
+	write(c, conn, port(s.echoPort())...)
+	c.Assert(read(c, conn, 10)[1], Equals, byte(0x00))
+
+	assertEchoConn(c, conn)
+}
+
+func (s *SOCKSSuite) TestSOCKS5PasswordInvalid(c *C) {
+	p := s.startPassage(c, NewSOCKSProxy(map[string]string{"foo": "bar"}, nil))
+	defer p.Close()
+
+	conn := dialSOCKS(c, p)
+	write(c, conn, 0x05, 0x01, 0x00)
+	c.Assert(read(c, conn, 2), DeepEquals, []byte{0x05, 0xff})
+
+	conn = dialSOCKS(c, p)
+	write(c, conn, 0x05, 0x01, 0x02)
+	c.Assert(read(c, conn, 2), DeepEquals, []byte{0x05, 0x02})
+
+	write(c, conn, 0x01, 3, 'f', 'o', 'o', 3, 'q', 'u', 'x')
+	c.Assert(read(c, conn, 2), DeepEquals, []byte{0x01, 0x01})
+}
+
+func (s *SOCKSSuite) TestSOCKS5ServerDown(c *C) {
+	s.ssh.Close()
+
+	conn := NewSSHConnectionWithOptions(nil, s.ssh.Addr(), s.ssh.ClientConfig(), SSHConnectionOptions{
+		Retries: 3,
+		Backoff: Backoff{InitialDelay: time.Second, MaxDelay: time.Second},
+	})
+
+	p := NewProxyPassage(conn, NewSOCKSProxy(nil, nil))
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	client := dialSOCKS(c, p)
+	write(c, client, 0x05, 0x01, 0x00)
+	c.Assert(read(c, client, 2), DeepEquals, []byte{0x05, 0x00})
+
+	// the failure is replied without waiting for the backoff
+	start := time.Now()
+	write(c, client, 0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1)
+	write(c, client, port(s.echoPort())...)
+	c.Assert(read(c, client, 10)[1], Equals, byte(0x04))
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+func (s *SOCKSSuite) TestSOCKS5NotAllowed(c *C) {
+	f, err := NewDestinationFilter([]string{"10.0.0.0/8"}, nil)
+	c.Assert(err, IsNil)
+
+	p := s.startPassage(c, NewSOCKSProxy(nil, f))
+	defer p.Close()
+
+	conn := dialSOCKS(c, p)
+	write(c, conn, 0x05, 0x01, 0x00)
+	c.Assert(read(c, conn, 2), DeepEquals, []byte{0x05, 0x00})
+
+	write(c, conn, 0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1)
+	write(c, conn, port(s.echoPort())...)
+	c.Assert(read(c, conn, 10)[1], Equals, byte(0x02))
+}
+
+func (s *SOCKSSuite) TestSOCKS5HostnameNotAllowed(c *C) {
+	f, err := NewDestinationFilter(nil, []string{"127.0.0.0/8"})
+	c.Assert(err, IsNil)
+
+	p := s.startPassage(c, NewSOCKSProxy(nil, f))
+	defer p.Close()
+
+	conn := dialSOCKS(c, p)
+	write(c, conn, 0x05, 0x01, 0x00)
+	c.Assert(read(c, conn, 2), DeepEquals, []byte{0x05, 0x00})
+
+	write(c, conn, 0x05, 0x01, 0x00, 0x03, 9)
+	write(c, conn, []byte("localhost")...)
+	write(c, conn, port(s.echoPort())...)
+	c.Assert(read(c, conn, 10)[1], Equals, byte(0x02))
+}
+
+func (s *SOCKSSuite) TestSOCKS4aHostnameNotAllowed(c *C) {
+	f, err := NewDestinationFilter(nil, []string{"127.0.0.0/8"})
+	c.Assert(err, IsNil)
+
+	p := s.startPassage(c, NewSOCKSProxy(nil, f))
+	defer p.Close()
+
+	conn := dialSOCKS(c, p)
+	write(c, conn, 0x04, 0x01)
+	write(c, conn, port(s.echoPort())...)
+	write(c, conn, 0, 0, 0, 1, 'f', 'o', 'o', 0)
+	write(c, conn, []byte("localhost")...)
+	write(c, conn, 0)
+	c.Assert(read(c, conn, 8)[1], Equals, byte(0x5b))
+}
+
+func (s *SOCKSSuite) TestSOCKS4a(c *C) {
+	p := s.startPassage(c, NewSOCKSProxy(nil, nil))
+	defer p.Close()
+
+	conn := dialSOCKS(c, p)
+	write(c, conn, 0x04, 0x01)
+	write(c, conn, port(s.echoPort())...)
+	write(c, conn, 0, 0, 0, 1, 'f', 'o', 'o', 0)
+	write(c, conn, []byte("localhost")...)
+	write(c, conn, 0)
+	c.Assert(read(c, conn, 8)[1], Equals, byte(0x5a))
+
+	assertEchoConn(c, conn)
+}
+
+func (s *SOCKSSuite) TestSOCKS4WithUsers(c *C) {
+	p := s.startPassage(c, NewSOCKSProxy(map[string]string{"foo": "bar"}, nil))
+	defer p.Close()
+
+	conn := dialSOCKS(c, p)
+	write(c, conn, 0x04, 0x01)
+	write(c, conn, port(s.echoPort())...)
+	write(c, conn, 127, 0, 0, 1, 0)
+	c.Assert(read(c, conn, 8)[1], Equals, byte(0x5b))
+}
+
+func dialSOCKS(c *C, p *Passage) net.Conn {
+	conn, err := net.Dial("tcp", p.Addr())
+	c.Assert(err, IsNil)
+
+	return conn
+}
+
+func port(p uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, p)
+	return b
+}
@@ -0,0 +1,400 @@
+package core
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const (
+	DefaultUDPIdleTimeout = time.Minute
+
+	maxDatagramSize  = 65535
+	udpSessionQueue  = 64
+	minExpireTimeout = 100 * time.Millisecond
+)
+
+// UDPListener reads datagrams from a local UDP socket and forwards them over
+// the SSH connection. Every client address has its own session, a stream to
+// the remote where each datagram is framed prefixed by its length as a 16-bit
+// big-endian integer, the same framing used by DNS over TCP. Other services
+// require an UDPRelay at the SSH server.
+type UDPListener struct {
+	a           net.Addr
+	c           SSHConnection
+	r           Remote
+	idleTimeout time.Duration
+
+	m        sync.Mutex
+	conn     net.PacketConn
+	sessions map[string]*udpSession
+	closing  int32
+	stopped  chan bool
+
+	// Metrics are updated by the sessions, every session counts as a
+	// connection
+	Metrics *PassageMetrics
+}
+
+func NewUDPListener(a net.Addr, c SSHConnection, r Remote, idleTimeout time.Duration) *UDPListener {
+	if idleTimeout == 0 {
+		idleTimeout = DefaultUDPIdleTimeout
+	}
+
+	return &UDPListener{
+		a:           a,
+		c:           c,
+		r:           r,
+		idleTimeout: idleTimeout,
+		sessions:    make(map[string]*udpSession),
+		stopped:     make(chan bool),
+		Metrics:     NewPassageMetrics(),
+	}
+}
+
+func (l *UDPListener) Start() error {
+	return l.StartContext(context.Background())
+}
+
+// StartContext starts the listener, it's closed when ctx is done
+func (l *UDPListener) StartContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var lc net.ListenConfig
+	conn, err := lc.ListenPacket(ctx, l.a.Network(), l.a.String())
+	if err != nil {
+		return fmt.Errorf("error creating listener: %s", err)
+	}
+
+	l.m.Lock()
+	l.conn = conn
+	l.m.Unlock()
+
+	go l.serve()
+	go l.expire()
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				l.Close()
+			case <-l.stopped:
+			}
+		}()
+	}
+
+	return nil
+}
+
+func (l *UDPListener) serve() {
+	defer close(l.stopped)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadInt32(&l.closing) == 1 {
+				log15.Debug("socket closed", "addr", l)
+				return
+			}
+
+			log15.Error("read failed", "addr", l, "error", err)
+			continue
+		}
+
+		p := make([]byte, n)
+		copy(p, buf[:n])
+		l.session(addr).send(p)
+	}
+}
+
+func (l *UDPListener) session(addr net.Addr) *udpSession {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if s, ok := l.sessions[addr.String()]; ok {
+		return s
+	}
+
+	s := newUDPSession(l, addr)
+	l.sessions[addr.String()] = s
+	go s.run()
+
+	return s
+}
+
+func (l *UDPListener) remove(s *udpSession) {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.sessions[s.addr.String()] == s {
+		delete(l.sessions, s.addr.String())
+	}
+}
+
+// expire closes the sessions idle for longer than the idle timeout, until the
+// listener is closed and all the sessions are gone
+func (l *UDPListener) expire() {
+	interval := l.idleTimeout / 2
+	if interval < minExpireTimeout {
+		interval = minExpireTimeout
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for range t.C {
+		var idle []*udpSession
+		l.m.Lock()
+		for _, s := range l.sessions {
+			if s.idle() > l.idleTimeout {
+				idle = append(idle, s)
+			}
+		}
+
+		done := atomic.LoadInt32(&l.closing) == 1 && len(l.sessions) == len(idle)
+		l.m.Unlock()
+
+		for _, s := range idle {
+			log15.Debug("udp session expired", "addr", l, "client", s.addr)
+			s.close()
+		}
+
+		if done {
+			return
+		}
+	}
+}
+
+// Sessions returns the number of active client sessions
+func (l *UDPListener) Sessions() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	return len(l.sessions)
+}
+
+// Close closes the local socket, the sessions are closed once idle
+func (l *UDPListener) Close() error {
+	if !atomic.CompareAndSwapInt32(&l.closing, 0, 1) {
+		return nil
+	}
+
+	l.m.Lock()
+	conn := l.conn
+	l.m.Unlock()
+	if conn == nil {
+		return nil
+	}
+
+	if err := conn.Close(); err != nil {
+		return err
+	}
+
+	<-l.stopped
+	return nil
+}
+
+// Drain closes the listener and waits up to timeout for the sessions to finish
+// sending its datagrams, the remaining ones are closed and its number returned
+func (l *UDPListener) Drain(timeout time.Duration) (int, error) {
+	if err := l.Close(); err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for l.Sessions() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	l.m.Lock()
+	var sessions []*udpSession
+	for _, s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	l.m.Unlock()
+
+	for _, s := range sessions {
+		s.close()
+	}
+
+	return len(sessions), nil
+}
+
+func (l *UDPListener) String() string {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if l.conn == nil {
+		return "<nil>"
+	}
+
+	return l.conn.LocalAddr().String()
+}
+
+type udpSession struct {
+	l      *UDPListener
+	addr   net.Addr
+	queue  chan []byte
+	last   int64
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+
+	start time.Time
+
+	m      sync.Mutex
+	stream net.Conn
+	err    error
+}
+
+func newUDPSession(l *UDPListener, addr net.Addr) *udpSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	l.Metrics.opened()
+	return &udpSession{
+		l:      l,
+		addr:   addr,
+		queue:  make(chan []byte, udpSessionQueue),
+		last:   time.Now().UnixNano(),
+		ctx:    withDialObserver(ctx, l.Metrics.dialLatency),
+		cancel: cancel,
+		start:  time.Now(),
+	}
+}
+
+func (s *udpSession) send(p []byte) {
+	s.touch()
+	s.l.Metrics.received(len(p))
+	select {
+	case s.queue <- p:
+	default:
+		log15.Debug("udp session queue full, datagram dropped", "addr", s.l, "client", s.addr)
+	}
+}
+
+func (s *udpSession) run() {
+	defer s.close()
+
+	stream, err := s.dial()
+	if err != nil {
+		s.m.Lock()
+		s.err = err
+		s.m.Unlock()
+
+		log15.Error("error handling udp session", "addr", s.l, "client", s.addr, "error", err)
+		return
+	}
+
+	go s.reply(stream)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case p := <-s.queue:
+			if err := writeFrame(stream, p); err != nil {
+				log15.Debug("error writing datagram", "client", s.addr, "error", err)
+				return
+			}
+		}
+	}
+}
+
+func (s *udpSession) dial() (net.Conn, error) {
+	remote, err := s.l.r.AddrContext(s.ctx, s.l.c)
+	if err != nil {
+		return nil, newPassageError(ErrorKindResolve, err)
+	}
+
+	stream, err := s.l.c.DialContext(s.ctx, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.ctx.Err() != nil {
+		stream.Close()
+		return nil, s.ctx.Err()
+	}
+
+	s.stream = stream
+	return stream, nil
+}
+
+func (s *udpSession) reply(stream net.Conn) {
+	defer s.close()
+
+	for {
+		p, err := readFrame(stream)
+		if err != nil {
+			if err != io.EOF {
+				log15.Debug("error reading datagram", "client", s.addr, "error", err)
+			}
+
+			return
+		}
+
+		s.touch()
+		if _, err := s.l.conn.WriteTo(p, s.addr); err != nil {
+			log15.Debug("error replying datagram", "client", s.addr, "error", err)
+			return
+		}
+
+		s.l.Metrics.sent(len(p))
+	}
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.last)))
+}
+
+func (s *udpSession) close() {
+	s.once.Do(func() {
+		s.cancel()
+		s.l.remove(s)
+
+		s.m.Lock()
+		defer s.m.Unlock()
+		if s.stream != nil {
+			s.stream.Close()
+		}
+
+		s.l.Metrics.closed(s.start, s.err)
+	})
+}
+
+func writeFrame(w io.Writer, p []byte) error {
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+
+	p := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
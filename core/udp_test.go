@@ -0,0 +1,155 @@
+package core
+
+import (
+	"bytes"
+	"net"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type UDPSuite struct {
+	relay net.Listener
+	ssh   *sshServerFixture
+}
+
+var _ = Suite(&UDPSuite{})
+
+func (s *UDPSuite) SetUpTest(c *C) {
+	s.relay = newFrameEchoServer(c)
+	s.ssh = newSSHServerFixture(c)
+}
+
+func (s *UDPSuite) TearDownTest(c *C) {
+	s.ssh.Close()
+	s.relay.Close()
+}
+
+func (s *UDPSuite) TestFrame(c *C) {
+	var buf bytes.Buffer
+	c.Assert(writeFrame(&buf, []byte("foo")), IsNil)
+	c.Assert(writeFrame(&buf, []byte{}), IsNil)
+	c.Assert(buf.Bytes(), DeepEquals, []byte{0, 3, 'f', 'o', 'o', 0, 0})
+
+	p, err := readFrame(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(p, DeepEquals, []byte("foo"))
+
+	p, err = readFrame(&buf)
+	c.Assert(err, IsNil)
+	c.Assert(p, HasLen, 0)
+}
+
+func (s *UDPSuite) TestUDPPassage(c *C) {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewUDPPassage(conn, NewRemote("tcp", s.relay.Addr().String()), time.Minute)
+	err := p.Start(MustResolveAddr("udp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	foo := dialUDP(c, p.Addr())
+	defer foo.Close()
+	bar := dialUDP(c, p.Addr())
+	defer bar.Close()
+
+	assertDatagramEcho(c, foo, "foo")
+	assertDatagramEcho(c, bar, "bar")
+	assertDatagramEcho(c, foo, "qux")
+
+	c.Assert(p.l.(*UDPListener).Sessions(), Equals, 2)
+}
+
+func (s *UDPSuite) TestUDPPassageIdleTimeout(c *C) {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewUDPPassage(conn, NewRemote("tcp", s.relay.Addr().String()), 100*time.Millisecond)
+	err := p.Start(MustResolveAddr("udp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+
+	foo := dialUDP(c, p.Addr())
+	defer foo.Close()
+
+	assertDatagramEcho(c, foo, "foo")
+	c.Assert(p.l.(*UDPListener).Sessions(), Equals, 1)
+
+	time.Sleep(500 * time.Millisecond)
+	c.Assert(p.l.(*UDPListener).Sessions(), Equals, 0)
+
+	assertDatagramEcho(c, foo, "bar")
+
+	cut, err := p.Drain(0)
+	c.Assert(err, IsNil)
+	c.Assert(cut, Equals, 1)
+}
+
+func (s *UDPSuite) TestUDPPassageMetrics(c *C) {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewUDPPassage(conn, NewRemote("tcp", s.relay.Addr().String()), 100*time.Millisecond)
+	err := p.Start(MustResolveAddr("udp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	foo := dialUDP(c, p.Addr())
+	defer foo.Close()
+
+	assertDatagramEcho(c, foo, "foo")
+	assertDatagramEcho(c, foo, "bar")
+
+	stats := p.Stats()
+	c.Assert(stats.ActiveConnections, Equals, int64(1))
+	c.Assert(stats.TotalConnections, Equals, uint64(1))
+	c.Assert(stats.BytesIn, Equals, uint64(6))
+	c.Assert(stats.DialLatency.Count, Equals, uint64(1))
+
+	waitIdle(c, p)
+	stats = p.Stats()
+	c.Assert(stats.BytesOut, Equals, uint64(6))
+	c.Assert(stats.TunnelDuration.Count, Equals, uint64(1))
+}
+
+func newFrameEchoServer(c *C) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				for {
+					p, err := readFrame(conn)
+					if err != nil {
+						return
+					}
+
+					if err := writeFrame(conn, p); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+func dialUDP(c *C, addr string) net.Conn {
+	conn, err := net.Dial("udp", addr)
+	c.Assert(err, IsNil)
+
+	return conn
+}
+
+func assertDatagramEcho(c *C, conn net.Conn, msg string) {
+	_, err := conn.Write([]byte(msg))
+	c.Assert(err, IsNil)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf[:n]), Equals, msg)
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// UDPRelay runs at the SSH server, relaying the streams of the UDP passages to
+// a UDP service. Every stream carries the datagrams of a client, each one
+// prefixed by its length as a 16-bit big-endian integer, and has its own UDP
+// socket, so the replies go back to the stream they belong to.
+type UDPRelay struct {
+	target string
+
+	m sync.Mutex
+	l net.Listener
+}
+
+func NewUDPRelay(target string) *UDPRelay {
+	return &UDPRelay{target: target}
+}
+
+// Listen accepts the streams at addr, an unix socket if it's an absolute path
+func (r *UDPRelay) Listen(addr string) error {
+	network := "tcp"
+	if filepath.IsAbs(addr) {
+		network = "unix"
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("error creating listener: %s", err)
+	}
+
+	r.m.Lock()
+	r.l = l
+	r.m.Unlock()
+
+	go r.serve(l)
+	return nil
+}
+
+func (r *UDPRelay) serve(l net.Listener) {
+	for {
+		stream, err := l.Accept()
+		if err != nil {
+			log15.Debug("udp relay closed", "addr", l.Addr(), "error", err)
+			return
+		}
+
+		go r.handle(stream)
+	}
+}
+
+func (r *UDPRelay) handle(stream net.Conn) {
+	defer stream.Close()
+
+	conn, err := net.Dial("udp", r.target)
+	if err != nil {
+		log15.Error("error dialing udp target", "target", r.target, "error", err)
+		return
+	}
+
+	done := make(chan struct{})
+	defer conn.Close()
+	defer close(done)
+
+	go r.reply(stream, conn, done)
+	for {
+		p, err := readFrame(stream)
+		if err != nil {
+			if err != io.EOF {
+				log15.Debug("error reading datagram", "target", r.target, "error", err)
+			}
+
+			return
+		}
+
+		// the target may be down for a while, as with any UDP client, the
+		// datagrams are lost meanwhile
+		if _, err := conn.Write(p); err != nil {
+			log15.Debug("error relaying datagram", "target", r.target, "error", err)
+		}
+	}
+}
+
+// reply writes back to the stream the datagrams received from the target,
+// until done
+func (r *UDPRelay) reply(stream, conn net.Conn, done <-chan struct{}) {
+	defer stream.Close()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			log15.Debug("error reading reply", "target", r.target, "error", err)
+			continue
+		}
+
+		if err := writeFrame(stream, buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+func (r *UDPRelay) Addr() string {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.l == nil {
+		return "<nil>"
+	}
+
+	return r.l.Addr().String()
+}
+
+// Close stops accepting streams, the open ones are kept until its passage
+// closes them
+func (r *UDPRelay) Close() error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.l == nil {
+		return nil
+	}
+
+	return r.l.Close()
+}
@@ -0,0 +1,95 @@
+package core
+
+import (
+	"net"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type UDPRelaySuite struct {
+	echo net.PacketConn
+	ssh  *sshServerFixture
+}
+
+var _ = Suite(&UDPRelaySuite{})
+
+func (s *UDPRelaySuite) SetUpTest(c *C) {
+	s.echo = newUDPEchoServer(c)
+	s.ssh = newSSHServerFixture(c)
+}
+
+func (s *UDPRelaySuite) TearDownTest(c *C) {
+	s.ssh.Close()
+	s.echo.Close()
+}
+
+func (s *UDPRelaySuite) TestRelay(c *C) {
+	r := NewUDPRelay(s.echo.LocalAddr().String())
+	err := r.Listen(filepath.Join(c.MkDir(), "relay.sock"))
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	stream, err := net.Dial("unix", r.Addr())
+	c.Assert(err, IsNil)
+	defer stream.Close()
+
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, msg := range []string{"foo", "bar"} {
+		c.Assert(writeFrame(stream, []byte(msg)), IsNil)
+
+		p, err := readFrame(stream)
+		c.Assert(err, IsNil)
+		c.Assert(string(p), Equals, msg)
+	}
+}
+
+func (s *UDPRelaySuite) TestUDPPassage(c *C) {
+	r := NewUDPRelay(s.echo.LocalAddr().String())
+	err := r.Listen(filepath.Join(c.MkDir(), "relay.sock"))
+	c.Assert(err, IsNil)
+	defer r.Close()
+
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewUDPPassage(conn, NewRemote("unix", r.Addr()), time.Minute)
+	err = p.Start(MustResolveAddr("udp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	foo := dialUDP(c, p.Addr())
+	defer foo.Close()
+	bar := dialUDP(c, p.Addr())
+	defer bar.Close()
+
+	assertDatagramEcho(c, foo, "foo")
+	assertDatagramEcho(c, bar, "bar")
+	assertDatagramEcho(c, foo, "qux")
+}
+
+func (s *UDPRelaySuite) TestListenError(c *C) {
+	r := NewUDPRelay(s.echo.LocalAddr().String())
+	err := r.Listen(filepath.Join(c.MkDir(), "missing", "relay.sock"))
+	c.Assert(err, ErrorMatches, "error creating listener: .*")
+	c.Assert(r.Addr(), Equals, "<nil>")
+	c.Assert(r.Close(), IsNil)
+}
+
+func newUDPEchoServer(c *C) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	return conn
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// SocketOptions are the permissions and ownership applied to the unix socket
+// files created by the listeners
+type SocketOptions struct {
+	// Mode of the socket file, zero keeps the mode given by the umask
+	Mode os.FileMode
+	// UID and GID of the socket file, -1 keeps the current one
+	UID, GID int
+}
+
+func (o *SocketOptions) apply(path string) error {
+	if o == nil {
+		return nil
+	}
+
+	if o.Mode != 0 {
+		if err := os.Chmod(path, o.Mode); err != nil {
+			return err
+		}
+	}
+
+	if o.UID != -1 || o.GID != -1 {
+		if err := os.Chown(path, o.UID, o.GID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func listenUnix(path string, o *SocketOptions) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := o.apply(path); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// removeStaleSocket removes the socket file left by a process that is not
+// listening anymore, a socket still in use or any other file are kept
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s: file exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s: socket in use", path)
+	}
+
+	log15.Warn("removing stale socket", "path", path)
+	return os.Remove(path)
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type UnixSuite struct {
+	dir  string
+	echo net.Listener
+	ssh  *sshServerFixture
+}
+
+var _ = Suite(&UnixSuite{})
+
+func (s *UnixSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.echo = listenEchoServer(c, "unix", filepath.Join(s.dir, "echo.sock"))
+	s.ssh = newSSHServerFixture(c)
+}
+
+func (s *UnixSuite) TearDownTest(c *C) {
+	s.ssh.Close()
+	s.echo.Close()
+}
+
+func (s *UnixSuite) TestPassageUnixRemote(c *C) {
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewPassage(conn, NewRemote("unix", s.echo.Addr().String()))
+	err := p.Start(MustResolveAddr("tcp", "127.0.0.1:0"))
+	c.Assert(err, IsNil)
+	defer p.Close()
+
+	assertEcho(c, p.Addr())
+}
+
+func (s *UnixSuite) TestPassageUnixLocal(c *C) {
+	path := filepath.Join(s.dir, "local.sock")
+
+	conn := NewSSHConnection(s.ssh.Addr(), s.ssh.ClientConfig(), 0)
+	p := NewPassage(conn, NewRemote("unix", s.echo.Addr().String()))
+	p.Socket = &SocketOptions{Mode: 0600, UID: -1, GID: -1}
+	err := p.Start(&net.UnixAddr{Name: path, Net: "unix"})
+	c.Assert(err, IsNil)
+	c.Assert(p.Addr(), Equals, path)
+
+	fi, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0600))
+
+	local, err := net.Dial("unix", path)
+	c.Assert(err, IsNil)
+	assertEchoConn(c, local)
+
+	c.Assert(p.Close(), IsNil)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *UnixSuite) TestRemoveStaleSocket(c *C) {
+	path := filepath.Join(s.dir, "stale.sock")
+	l, err := net.Listen("unix", path)
+	c.Assert(err, IsNil)
+
+	c.Assert(removeStaleSocket(path), ErrorMatches, ".*: socket in use")
+
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+
+	c.Assert(removeStaleSocket(path), IsNil)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Assert(removeStaleSocket(path), IsNil)
+}
+
+func (s *UnixSuite) TestRemoveStaleSocketRegularFile(c *C) {
+	path := filepath.Join(s.dir, "file")
+	c.Assert(ioutil.WriteFile(path, nil, 0644), IsNil)
+
+	c.Assert(removeStaleSocket(path), ErrorMatches, ".*: file exists and is not a socket")
+}
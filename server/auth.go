@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/mcuadros/passage/core"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// buildAuthMethods returns the auth methods in order, the agent and the
+// identity files are merged into a single publickey method at the position of
+// the first one, since the ssh client tries each method only once
+func buildAuthMethods(config *SSHServerConfig) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	var keys []core.Signers
+	keysAt := -1
+	for _, ac := range config.Auth {
+		if ac.Method == "agent" || ac.Method == "identity_file" {
+			signers, err := buildSigners(ac)
+			if err != nil {
+				return nil, err
+			}
+
+			if keysAt == -1 {
+				keysAt = len(methods)
+				methods = append(methods, nil)
+			}
+
+			keys = append(keys, signers)
+			continue
+		}
+
+		m, err := buildAuthMethod(ac)
+		if err != nil {
+			return nil, err
+		}
+
+		methods = append(methods, m)
+	}
+
+	if keysAt != -1 {
+		methods[keysAt] = core.SSHPublicKeys(keys...)
+	}
+
+	return methods, nil
+}
+
+func buildSigners(config *AuthConfig) (core.Signers, error) {
+	if config.Method == "agent" {
+		return core.SSHAgentSigners(), nil
+	}
+
+	passphrase, err := readSecret("", config.PassphraseEnv, config.PassphraseFile)
+	if err != nil {
+		return nil, fmt.Errorf("identity file %q passphrase: %s", config.IdentityFile, err)
+	}
+
+	return core.SSHIdentityFileSigners(expandHome(config.IdentityFile), []byte(passphrase))
+}
+
+func buildAuthMethod(config *AuthConfig) (ssh.AuthMethod, error) {
+	switch config.Method {
+	case "password":
+		password, err := readSecret(config.Password, config.PasswordEnv, config.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("password: %s", err)
+		}
+
+		return ssh.Password(password), nil
+	case "keyboard-interactive":
+		password, err := readSecret(config.Password, config.PasswordEnv, config.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("keyboard-interactive: %s", err)
+		}
+
+		return core.SSHKeyboardInteractive(password), nil
+	}
+
+	return nil, fmt.Errorf("invalid auth method: %q", config.Method)
+}
+
+func readSecret(value, env, file string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+
+	if env != "" {
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", env)
+		}
+
+		return v, nil
+	}
+
+	if file != "" {
+		content, err := ioutil.ReadFile(expandHome(file))
+		if err != nil {
+			return "", err
+		}
+
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	return "", nil
+}
+
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return path
+	}
+
+	return filepath.Join(u.HomeDir, path[1:])
+}
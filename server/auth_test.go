@@ -0,0 +1,98 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type AuthSuite struct{}
+
+var _ = Suite(&AuthSuite{})
+
+func (s *AuthSuite) TestBuildAuthMethods(c *C) {
+	file := filepath.Join(c.MkDir(), "password")
+	err := ioutil.WriteFile(file, []byte("foo\n"), 0600)
+	c.Assert(err, IsNil)
+
+	methods, err := buildAuthMethods(&SSHServerConfig{Auth: []*AuthConfig{
+		{Method: "agent"},
+		{Method: "password", Password: "foo"},
+		{Method: "keyboard-interactive", PasswordFile: file},
+	}})
+
+	c.Assert(err, IsNil)
+	c.Assert(methods, HasLen, 3)
+}
+
+func (s *AuthSuite) TestBuildAuthMethodsPublicKeysMerged(c *C) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, IsNil)
+
+	file := filepath.Join(c.MkDir(), "id_rsa")
+	err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600)
+	c.Assert(err, IsNil)
+
+	methods, err := buildAuthMethods(&SSHServerConfig{Auth: []*AuthConfig{
+		{Method: "password", Password: "foo"},
+		{Method: "agent"},
+		{Method: "keyboard-interactive", Password: "foo"},
+		{Method: "identity_file", IdentityFile: file},
+	}})
+
+	c.Assert(err, IsNil)
+	c.Assert(methods, HasLen, 3)
+}
+
+func (s *AuthSuite) TestBuildAuthMethodsIdentityFileNotFound(c *C) {
+	_, err := buildAuthMethods(&SSHServerConfig{Auth: []*AuthConfig{
+		{Method: "identity_file", IdentityFile: filepath.Join(c.MkDir(), "id_rsa")},
+	}})
+
+	c.Assert(err, ErrorMatches, "error reading identity file: .*")
+}
+
+func (s *AuthSuite) TestBuildAuthMethodsMissingEnv(c *C) {
+	os.Unsetenv("PASSAGE_TEST_PASSWORD")
+	_, err := buildAuthMethods(&SSHServerConfig{Auth: []*AuthConfig{
+		{Method: "password", PasswordEnv: "PASSAGE_TEST_PASSWORD"},
+	}})
+
+	c.Assert(err, ErrorMatches, `password: environment variable "PASSAGE_TEST_PASSWORD" is not set`)
+}
+
+func (s *AuthSuite) TestReadSecret(c *C) {
+	v, err := readSecret("foo", "", "")
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "foo")
+
+	os.Setenv("PASSAGE_TEST_SECRET", "bar")
+	defer os.Unsetenv("PASSAGE_TEST_SECRET")
+
+	v, err = readSecret("", "PASSAGE_TEST_SECRET", "")
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "bar")
+
+	file := filepath.Join(c.MkDir(), "secret")
+	err = ioutil.WriteFile(file, []byte("qux\n"), 0600)
+	c.Assert(err, IsNil)
+
+	v, err = readSecret("", "", file)
+	c.Assert(err, IsNil)
+	c.Assert(v, Equals, "qux")
+}
+
+func (s *AuthSuite) TestExpandHome(c *C) {
+	c.Assert(expandHome("/foo/bar"), Equals, "/foo/bar")
+	c.Assert(expandHome("~/foo"), Not(Equals), "~/foo")
+	c.Assert(filepath.Base(expandHome("~/foo")), Equals, "foo")
+}
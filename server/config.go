@@ -2,16 +2,26 @@ package server
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/mcuadros/passage/core"
+
 	"github.com/mcuadros/go-defaults"
 	"gopkg.in/yaml.v1"
 )
 
 type Config struct {
 	Servers map[string]*SSHServerConfig
+	// DrainTimeout is the time the active tunnels of a removed passage have to
+	// finish before being closed, a negative value closes them right away
+	DrainTimeout time.Duration `mapstructure:"drain_timeout" yaml:"drain_timeout" default:"10s"`
 }
 
 func (c *Config) Validate() error {
@@ -21,14 +31,18 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("invalid empty config")
 	}
 
+	jumps := c.jumpServers()
+
 	var errs []error
 	for name, sc := range c.Servers {
-		if err := sc.validate(name); len(err) != 0 {
+		if err := sc.validate(name, jumps[name]); len(err) != 0 {
 			errs = append(errs, err...)
 		}
 	}
 
 	errs = append(errs, c.validatePassageNames()...)
+	errs = append(errs, c.validateVia()...)
+	errs = append(errs, c.validateBackends()...)
 	if len(errs) != 0 {
 		return &ConfigError{errs}
 	}
@@ -58,17 +72,173 @@ func (c *Config) validatePassageNames() []error {
 	return errs
 }
 
+func (c *Config) passageNames() []string {
+	var names []string
+	for _, s := range c.Servers {
+		for n := range s.Passages {
+			names = append(names, n)
+		}
+	}
+
+	return names
+}
+
+// jumpServers returns the servers used by others, as via or by the backends or
+// fallbacks of its passages, these servers don't require passages
+func (c *Config) jumpServers() map[string]bool {
+	jumps := map[string]bool{}
+	for _, s := range c.Servers {
+		if s.Via != "" {
+			jumps[s.Via] = true
+		}
+
+		for _, p := range s.Passages {
+			for _, b := range p.Backends {
+				if b.Server != "" {
+					jumps[b.Server] = true
+				}
+			}
+
+			for _, f := range p.Fallbacks {
+				jumps[f] = true
+			}
+		}
+	}
+
+	return jumps
+}
+
+func (c *Config) validateVia() []error {
+	var errs []error
+	for _, name := range sortedKeys(c.Servers) {
+		if err := c.validateViaChain(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+func (c *Config) validateBackends() []error {
+	var errs []error
+	for _, server := range sortedKeys(c.Servers) {
+		for name, pc := range c.Servers[server].Passages {
+			for _, b := range pc.Backends {
+				if _, ok := c.Servers[b.Server]; b.Server != "" && !ok {
+					errs = append(errs, fmt.Errorf("passage %q: unknown backend server %q", name, b.Server))
+				}
+			}
+
+			seen := map[string]bool{server: true}
+			for _, f := range pc.Fallbacks {
+				if _, ok := c.Servers[f]; !ok {
+					errs = append(errs, fmt.Errorf("passage %q: unknown fallback server %q", name, f))
+				}
+
+				if seen[f] {
+					errs = append(errs, fmt.Errorf("passage %q: duplicate fallback server %q", name, f))
+				}
+
+				seen[f] = true
+			}
+		}
+	}
+
+	return errs
+}
+
+func (c *Config) validateViaChain(name string) error {
+	chain := []string{name}
+	for s := c.Servers[name]; s.Via != ""; s = c.Servers[s.Via] {
+		if _, ok := c.Servers[s.Via]; !ok {
+			return fmt.Errorf("ssh server %q: unknown via server %q", chain[len(chain)-1], s.Via)
+		}
+
+		if contains(chain, s.Via) {
+			return fmt.Errorf(
+				"ssh server %q: via cycle detected: %s -> %s",
+				name, strings.Join(chain, " -> "), s.Via,
+			)
+		}
+
+		chain = append(chain, s.Via)
+	}
+
+	return nil
+}
+
+// the servers used as via are returned before the servers using them
+func (c *Config) serverNames() []string {
+	var names []string
+	seen := map[string]bool{}
+
+	var visit func(name string)
+	visit = func(name string) {
+		if seen[name] {
+			return
+		}
+
+		seen[name] = true
+		if via := c.Servers[name].Via; via != "" {
+			visit(via)
+		}
+
+		names = append(names, name)
+	}
+
+	for _, name := range sortedKeys(c.Servers) {
+		visit(name)
+	}
+
+	return names
+}
+
+func sortedKeys(m map[string]*SSHServerConfig) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
 type SSHServerConfig struct {
 	User     string
 	Timeout  time.Duration
 	Address  string
 	Retries  int
+	Via      string
+	Auth     []*AuthConfig
+	Backoff  BackoffConfig
 	Passages map[string]*PassageConfig
+
+	Docker     DockerConfig
+	Kubernetes KubernetesConfig
+
+	KnownHosts            []string `mapstructure:"known_hosts" yaml:"known_hosts"`
+	HostKey               []string `mapstructure:"host_key" yaml:"host_key"`
+	StrictHostKeyChecking string   `mapstructure:"strict_host_key_checking" yaml:"strict_host_key_checking"`
+
+	// KeepAliveInterval between keepalives, a negative value disables them
+	KeepAliveInterval  time.Duration `mapstructure:"keepalive_interval" yaml:"keepalive_interval"`
+	KeepAliveMaxMissed int           `mapstructure:"keepalive_max_missed" yaml:"keepalive_max_missed"`
+
+	// Mode is when the server is connected, lazy, eager or on-demand, the
+	// IdleTimeout only applies to on-demand
+	Mode        string
+	IdleTimeout time.Duration `mapstructure:"idle_timeout" yaml:"idle_timeout"`
 }
 
 const (
-	DefaultTimeout = 5 * time.Second
-	DefaultRetries = 3
+	DefaultTimeout               = 5 * time.Second
+	DefaultRetries               = 3
+	DefaultKnownHosts            = "~/.ssh/known_hosts"
+	DefaultStrictHostKeyChecking = core.HostKeyCheckingYes
+	DefaultKeepAliveInterval     = 30 * time.Second
+	DefaultKeepAliveMaxMissed    = 3
+	DefaultMode                  = core.ConnectionModeLazy
+	DefaultIdleTimeout           = 5 * time.Minute
 )
 
 func (c *SSHServerConfig) defaults() error {
@@ -89,10 +259,42 @@ func (c *SSHServerConfig) defaults() error {
 		c.Retries = DefaultRetries
 	}
 
+	if len(c.Auth) == 0 {
+		c.Auth = []*AuthConfig{{Method: "agent"}}
+	}
+
+	if len(c.KnownHosts) == 0 {
+		c.KnownHosts = []string{DefaultKnownHosts}
+	}
+
+	if c.StrictHostKeyChecking == "" {
+		c.StrictHostKeyChecking = DefaultStrictHostKeyChecking
+	}
+
+	if c.KeepAliveInterval == 0 {
+		c.KeepAliveInterval = DefaultKeepAliveInterval
+	}
+
+	if c.KeepAliveMaxMissed == 0 {
+		c.KeepAliveMaxMissed = DefaultKeepAliveMaxMissed
+	}
+
+	if c.Mode == "" {
+		c.Mode = DefaultMode
+	}
+
+	if c.Mode == core.ConnectionModeOnDemand && c.IdleTimeout == 0 {
+		c.IdleTimeout = DefaultIdleTimeout
+	}
+
+	defaults.SetDefaults(&c.Backoff)
+	defaults.SetDefaults(&c.Docker)
+	defaults.SetDefaults(&c.Kubernetes)
+
 	return nil
 }
 
-func (c *SSHServerConfig) validate(name string) []error {
+func (c *SSHServerConfig) validate(name string, jump bool) []error {
 	if err := c.defaults(); err != nil {
 		return []error{err}
 	}
@@ -107,10 +309,42 @@ func (c *SSHServerConfig) validate(name string) []error {
 		errs = append(errs, fmt.Errorf("ssh server %q: address cannot be empty", name))
 	}
 
-	if len(c.Passages) == 0 {
+	if len(c.Passages) == 0 && !jump {
 		errs = append(errs, fmt.Errorf("ssh server %q: passages cannot be empty", name))
 	}
 
+	if valid := StrictHostKeyCheckingValidModes[c.StrictHostKeyChecking]; !valid {
+		errs = append(errs, fmt.Errorf(
+			"ssh server %q: invalid strict_host_key_checking %q", name, c.StrictHostKeyChecking,
+		))
+	}
+
+	if c.KeepAliveMaxMissed < 0 {
+		errs = append(errs, fmt.Errorf("ssh server %q: keepalive_max_missed cannot be negative", name))
+	}
+
+	if valid := ValidModes[c.Mode]; !valid {
+		errs = append(errs, fmt.Errorf("ssh server %q: invalid mode %q", name, c.Mode))
+	}
+
+	if c.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("ssh server %q: idle_timeout cannot be negative", name))
+	}
+
+	if c.IdleTimeout != 0 && c.Mode != core.ConnectionModeOnDemand {
+		errs = append(errs, fmt.Errorf("ssh server %q: idle_timeout requires the on-demand mode", name))
+	}
+
+	errs = append(errs, c.Backoff.validate(name)...)
+	errs = append(errs, c.Docker.validate(name)...)
+	errs = append(errs, c.Kubernetes.validate(name, c.hasPassageType("kubernetes"))...)
+
+	for _, ac := range c.Auth {
+		if err := ac.validate(name); len(err) != 0 {
+			errs = append(errs, err...)
+		}
+	}
+
 	for name, pc := range c.Passages {
 		if err := pc.validate(name); len(err) != 0 {
 			errs = append(errs, err...)
@@ -120,12 +354,207 @@ func (c *SSHServerConfig) validate(name string) []error {
 	return errs
 }
 
+func (c *SSHServerConfig) hasPassageType(t string) bool {
+	for _, pc := range c.Passages {
+		if pc.Type == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+var StrictHostKeyCheckingValidModes = map[string]bool{
+	core.HostKeyCheckingYes:       true,
+	core.HostKeyCheckingNo:        true,
+	core.HostKeyCheckingAcceptNew: true,
+}
+
+var ValidModes = map[string]bool{
+	core.ConnectionModeLazy:     true,
+	core.ConnectionModeEager:    true,
+	core.ConnectionModeOnDemand: true,
+}
+
+type BackoffConfig struct {
+	InitialDelay time.Duration `mapstructure:"initial_delay" yaml:"initial_delay" default:"1s"`
+	Multiplier   float64       `default:"2"`
+	MaxDelay     time.Duration `mapstructure:"max_delay" yaml:"max_delay" default:"30s"`
+	Jitter       float64       `default:"0.2"`
+	MaxElapsed   time.Duration `mapstructure:"max_elapsed" yaml:"max_elapsed"`
+}
+
+func (c *BackoffConfig) validate(server string) []error {
+	var errs []error
+	if c.InitialDelay < 0 || c.MaxDelay < 0 || c.MaxElapsed < 0 {
+		errs = append(errs, fmt.Errorf("ssh server %q: backoff delays cannot be negative", server))
+	}
+
+	if c.MaxDelay < c.InitialDelay {
+		errs = append(errs, fmt.Errorf("ssh server %q: backoff max_delay lower than initial_delay", server))
+	}
+
+	if c.Multiplier < 1 {
+		errs = append(errs, fmt.Errorf("ssh server %q: backoff multiplier must be at least 1", server))
+	}
+
+	if c.Jitter < 0 || c.Jitter > 1 {
+		errs = append(errs, fmt.Errorf("ssh server %q: backoff jitter must be between 0 and 1", server))
+	}
+
+	return errs
+}
+
+func (c *BackoffConfig) Backoff() core.Backoff {
+	return core.Backoff{
+		InitialDelay: c.InitialDelay,
+		Multiplier:   c.Multiplier,
+		MaxDelay:     c.MaxDelay,
+		Jitter:       c.Jitter,
+		MaxElapsed:   c.MaxElapsed,
+	}
+}
+
+type DockerConfig struct {
+	Endpoint   string
+	APIVersion string `mapstructure:"api_version" yaml:"api_version"`
+	TLSCert    string `mapstructure:"tls_cert" yaml:"tls_cert"`
+	TLSKey     string `mapstructure:"tls_key" yaml:"tls_key"`
+	TLSCA      string `mapstructure:"tls_ca" yaml:"tls_ca"`
+
+	// CacheTTL of the containers resolved, a negative value disables the cache
+	CacheTTL    time.Duration `mapstructure:"cache_ttl" yaml:"cache_ttl" default:"10s"`
+	WatchEvents bool          `mapstructure:"watch_events" yaml:"watch_events"`
+}
+
+func (c *DockerConfig) validate(server string) []error {
+	network := "unix"
+	if c.Endpoint != "" {
+		var err error
+		if network, _, err = core.ParseDockerEndpoint(c.Endpoint); err != nil {
+			return []error{fmt.Errorf("ssh server %q: %s", server, err)}
+		}
+	}
+
+	var errs []error
+	if (c.TLSCert != "" || c.TLSCA != "") && network != "tcp" {
+		errs = append(errs, fmt.Errorf("ssh server %q: docker tls requires a tcp endpoint", server))
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, fmt.Errorf("ssh server %q: docker tls_cert and tls_key go together", server))
+	}
+
+	return errs
+}
+
+type KubernetesConfig struct {
+	Kubeconfig string
+	Context    string
+	Server     string
+	Token      string
+	TokenEnv   string `mapstructure:"token_env" yaml:"token_env"`
+	TokenFile  string `mapstructure:"token_file" yaml:"token_file"`
+	CA         string
+	Namespace  string
+
+	InsecureSkipTLSVerify bool `mapstructure:"insecure_skip_tls_verify" yaml:"insecure_skip_tls_verify"`
+	// CacheTTL of the pods and services resolved, a negative value disables
+	// the cache
+	CacheTTL time.Duration `mapstructure:"cache_ttl" yaml:"cache_ttl" default:"10s"`
+}
+
+func (c *KubernetesConfig) validate(server string, required bool) []error {
+	if c.Server == "" && c.Kubeconfig == "" {
+		if required {
+			return []error{fmt.Errorf("ssh server %q: kubernetes server or kubeconfig is required", server)}
+		}
+
+		return nil
+	}
+
+	if c.Server == "" {
+		return nil
+	}
+
+	if u, err := url.Parse(c.Server); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return []error{fmt.Errorf("ssh server %q: invalid kubernetes server %q", server, c.Server)}
+	}
+
+	return nil
+}
+
+type AuthConfig struct {
+	Method         string `default:"agent"`
+	IdentityFile   string `mapstructure:"identity_file" yaml:"identity_file"`
+	PassphraseEnv  string `mapstructure:"passphrase_env" yaml:"passphrase_env"`
+	PassphraseFile string `mapstructure:"passphrase_file" yaml:"passphrase_file"`
+	Password       string
+	PasswordEnv    string `mapstructure:"password_env" yaml:"password_env"`
+	PasswordFile   string `mapstructure:"password_file" yaml:"password_file"`
+}
+
+func (c *AuthConfig) validate(server string) []error {
+	defaults.SetDefaults(c)
+
+	var errs []error
+	if valid := AuthConfigValidMethods[c.Method]; !valid {
+		errs = append(errs, fmt.Errorf("ssh server %q: invalid auth method %q", server, c.Method))
+		return errs
+	}
+
+	if c.Method == "identity_file" && c.IdentityFile == "" {
+		errs = append(errs, fmt.Errorf("ssh server %q: identity_file cannot be empty", server))
+	}
+
+	if c.Method == "password" || c.Method == "keyboard-interactive" {
+		if c.Password == "" && c.PasswordEnv == "" && c.PasswordFile == "" {
+			errs = append(errs, fmt.Errorf(
+				"ssh server %q: %s auth requires password, password_env or password_file",
+				server, c.Method,
+			))
+		}
+	}
+
+	return errs
+}
+
+var AuthConfigValidMethods = map[string]bool{
+	"agent": true, "identity_file": true, "password": true, "keyboard-interactive": true,
+}
+
 type PassageConfig struct {
 	Type      string `default:"tcp"`
 	Address   string
 	Container string
 	Port      string
 	Local     string `default:"127.0.0.1:0"`
+	Users     map[string]string
+	Allow     []string
+	Deny      []string
+
+	ContainerID string `mapstructure:"container_id" yaml:"container_id"`
+	Network     string
+	Image       string
+	Labels      []string
+	Policy      string
+
+	Namespace  string
+	Pod        string
+	Deployment string
+	Service    string
+
+	Backends            []BackendConfig
+	HealthCheckInterval time.Duration `mapstructure:"health_check_interval" yaml:"health_check_interval"`
+
+	Fallbacks        []string
+	FailbackInterval time.Duration `mapstructure:"failback_interval" yaml:"failback_interval"`
+
+	IdleTimeout time.Duration `mapstructure:"idle_timeout" yaml:"idle_timeout"`
+
+	SocketMode  string `mapstructure:"socket_mode" yaml:"socket_mode"`
+	SocketOwner string `mapstructure:"socket_owner" yaml:"socket_owner"`
+	SocketGroup string `mapstructure:"socket_group" yaml:"socket_group"`
 }
 
 func (c *PassageConfig) validate(name string) []error {
@@ -140,10 +569,289 @@ func (c *PassageConfig) validate(name string) []error {
 		errs = append(errs, fmt.Errorf("passage %q: invalid remote type %q", name, c.Type))
 	}
 
+	if c.Type == "reverse" {
+		errs = append(errs, c.validateReverse(name)...)
+	}
+
+	if c.Type == "container" {
+		errs = append(errs, c.validateContainer(name)...)
+	}
+
+	if c.Type == "kubernetes" {
+		errs = append(errs, c.validateKubernetes(name)...)
+	}
+
+	if len(c.Backends) != 0 {
+		errs = append(errs, c.validateBackends(name)...)
+	}
+
+	if c.Type == "udp" && c.Address == "" {
+		errs = append(errs, fmt.Errorf("passage %q: address cannot be empty", name))
+	}
+
+	if c.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("passage %q: idle_timeout cannot be negative", name))
+	}
+
+	if c.FailbackInterval < 0 {
+		errs = append(errs, fmt.Errorf("passage %q: failback_interval cannot be negative", name))
+	}
+
+	errs = append(errs, c.validateSocket(name)...)
+
+	if _, err := core.NewDestinationFilter(c.Allow, c.Deny); err != nil {
+		errs = append(errs, fmt.Errorf("passage %q: %s", name, err))
+	}
+
+	return errs
+}
+
+func (c *PassageConfig) validateReverse(name string) []error {
+	var errs []error
+	if c.Address == "" {
+		errs = append(errs, fmt.Errorf("passage %q: address cannot be empty", name))
+	}
+
+	if filepath.IsAbs(c.Address) {
+		errs = append(errs, fmt.Errorf("passage %q: unix sockets not supported as address", name))
+	}
+
+	if filepath.IsAbs(c.Local) {
+		return errs
+	}
+
+	if _, port, err := net.SplitHostPort(c.Local); err != nil || port == "0" {
+		errs = append(errs, fmt.Errorf(
+			"passage %q: local must be the address of a local service", name,
+		))
+	}
+
+	return errs
+}
+
+func (c *PassageConfig) validateContainer(name string) []error {
+	var errs []error
+	if c.Container == "" && c.ContainerID == "" && c.Image == "" && len(c.Labels) == 0 {
+		errs = append(errs, fmt.Errorf(
+			"passage %q: one of container, container_id, image or labels is required", name,
+		))
+	}
+
+	if _, err := c.ContainerSelector(); err != nil {
+		errs = append(errs, fmt.Errorf("passage %q: %s", name, err))
+	}
+
+	return errs
+}
+
+// ContainerSelector returns the selector of the containers of a container
+// passage, the labels are given as `key=value` or just `key`
+func (c *PassageConfig) ContainerSelector() (*core.ContainerSelector, error) {
+	s := &core.ContainerSelector{
+		Name:    c.Container,
+		ID:      c.ContainerID,
+		Image:   c.Image,
+		Network: c.Network,
+		Policy:  c.Policy,
+	}
+
+	if err := c.validatePolicy(); err != nil {
+		return nil, err
+	}
+
+	for _, l := range c.Labels {
+		if s.Labels == nil {
+			s.Labels = make(map[string]string)
+		}
+
+		parts := strings.SplitN(l, "=", 2)
+		if parts[0] == "" {
+			return nil, fmt.Errorf("invalid label %q", l)
+		}
+
+		s.Labels[parts[0]] = ""
+		if len(parts) == 2 {
+			s.Labels[parts[0]] = parts[1]
+		}
+	}
+
+	return s, nil
+}
+
+func (c *PassageConfig) validatePolicy() error {
+	switch c.Policy {
+	case "", core.ContainerPolicyFirst, core.ContainerPolicyRandom, core.ContainerPolicyRoundRobin:
+		return nil
+	}
+
+	return fmt.Errorf("invalid policy %q", c.Policy)
+}
+
+func (c *PassageConfig) validateBackends(name string) []error {
+	var errs []error
+	if c.Type != "tcp" {
+		errs = append(errs, fmt.Errorf("passage %q: backends only supported by tcp passages", name))
+	}
+
+	if c.Address != "" {
+		errs = append(errs, fmt.Errorf("passage %q: address and backends cannot be used together", name))
+	}
+
+	for i, b := range c.Backends {
+		if b.Address == "" {
+			errs = append(errs, fmt.Errorf("passage %q: backend %d address cannot be empty", name, i))
+		}
+	}
+
+	switch c.Policy {
+	case "", core.BalancePolicyRoundRobin, core.BalancePolicyLeastConn, core.BalancePolicyRandom:
+	default:
+		errs = append(errs, fmt.Errorf("passage %q: invalid policy %q", name, c.Policy))
+	}
+
+	if c.HealthCheckInterval < 0 {
+		errs = append(errs, fmt.Errorf("passage %q: health_check_interval cannot be negative", name))
+	}
+
+	return errs
+}
+
+// BackendConfig is one of the backends of a load-balanced passage, through the
+// server of the passage if server is empty
+type BackendConfig struct {
+	Server  string
+	Address string
+}
+
+func (c *PassageConfig) validateKubernetes(name string) []error {
+	var errs []error
+	var set int
+	for _, v := range []string{c.Pod, c.Deployment, c.Service, strings.Join(c.Labels, ",")} {
+		if v != "" {
+			set++
+		}
+	}
+
+	if set != 1 {
+		errs = append(errs, fmt.Errorf(
+			"passage %q: one, and only one, of pod, labels, deployment or service is required", name,
+		))
+	}
+
+	if c.Port == "" {
+		errs = append(errs, fmt.Errorf("passage %q: port cannot be empty", name))
+	}
+
+	if err := c.validatePolicy(); err != nil {
+		errs = append(errs, fmt.Errorf("passage %q: %s", name, err))
+	}
+
 	return errs
 }
 
-var PassageConfigValidTypes = map[string]bool{"tcp": true, "container": true}
+// KubernetesSelector returns the selector of a kubernetes passage, namespace
+// is used if the passage doesn't have one
+func (c *PassageConfig) KubernetesSelector(namespace string) *core.KubernetesSelector {
+	s := &core.KubernetesSelector{
+		Namespace:  c.Namespace,
+		Pod:        c.Pod,
+		Labels:     strings.Join(c.Labels, ","),
+		Deployment: c.Deployment,
+		Service:    c.Service,
+		Policy:     c.Policy,
+	}
+
+	if s.Namespace == "" {
+		s.Namespace = namespace
+	}
+
+	return s
+}
+
+func (c *PassageConfig) validateSocket(name string) []error {
+	var errs []error
+	if c.Type == "udp" && filepath.IsAbs(c.Local) {
+		errs = append(errs, fmt.Errorf("passage %q: unix sockets not supported as local", name))
+	}
+
+	if c.SocketMode == "" {
+		return errs
+	}
+
+	if _, err := strconv.ParseUint(c.SocketMode, 8, 32); err != nil {
+		errs = append(errs, fmt.Errorf("passage %q: invalid socket_mode %q", name, c.SocketMode))
+	}
+
+	return errs
+}
+
+// IsUnix returns true if the passage listens on a unix socket
+func (c *PassageConfig) IsUnix() bool {
+	return c.Type != "reverse" && filepath.IsAbs(c.Local)
+}
+
+func (c *PassageConfig) ListenAddress() string {
+	if c.Type == "reverse" {
+		return c.Address
+	}
+
+	return c.Local
+}
+
+// ParseRemote returns the config of a passage to the given remote, in the
+// format of the --remote flags: a port, as `8080` or `:8080`, an address, as
+// `10.0.0.1:8080`, or a container, as `container=foo:8080`, followed by
+// `/tcp`, the default, or `/udp`. An `/udp` remote, as `10.0.0.1:53/udp`,
+// receives its datagrams length-framed over a stream, so any service but a DNS
+// server needs `passage udp-relay` running at the SSH server, with the address
+// of the relay as remote
+func ParseRemote(value string) (*PassageConfig, error) {
+	spec, network := value, "tcp"
+	if i := strings.LastIndex(value, "/"); i != -1 {
+		spec, network = value[:i], value[i+1:]
+	}
+
+	if network != "tcp" && network != "udp" {
+		return nil, fmt.Errorf("invalid remote network %q", network)
+	}
+
+	spec = strings.TrimPrefix(spec, ":")
+	if spec == "" {
+		return nil, fmt.Errorf("invalid remote format: %s", value)
+	}
+
+	if kv := strings.SplitN(spec, "=", 2); len(kv) == 2 {
+		if kv[0] != "container" {
+			return nil, fmt.Errorf("invalid remote format: %s", value)
+		}
+
+		container, port, err := net.SplitHostPort(kv[1])
+		if err != nil || container == "" || port == "" {
+			return nil, fmt.Errorf("invalid remote format: %s", value)
+		}
+
+		if network != "tcp" {
+			return nil, fmt.Errorf("invalid remote network %q, containers only support tcp", network)
+		}
+
+		return &PassageConfig{Type: "container", Container: container, Port: port}, nil
+	}
+
+	if !strings.Contains(spec, ":") {
+		spec = net.JoinHostPort("127.0.0.1", spec)
+	}
+
+	if _, _, err := net.SplitHostPort(spec); err != nil {
+		return nil, fmt.Errorf("invalid remote format: %s", value)
+	}
+
+	return &PassageConfig{Type: network, Address: spec}, nil
+}
+
+var PassageConfigValidTypes = map[string]bool{
+	"tcp": true, "container": true, "reverse": true, "socks": true, "http-proxy": true,
+	"udp": true, "kubernetes": true,
+}
 
 func (c *Config) Marshal() ([]byte, error) {
 	return yaml.Marshal(c)
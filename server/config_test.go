@@ -1,7 +1,10 @@
 package server
 
 import (
+	"fmt"
+	"regexp"
 	"testing"
+	"time"
 
 	. "gopkg.in/check.v1"
 )
@@ -36,6 +39,7 @@ func (s *ConfigSuite) TestValidate(c *C) {
 
 	err := config.Validate()
 	c.Assert(err, IsNil)
+	c.Assert(config.DrainTimeout, Equals, 10*time.Second)
 }
 
 func (s *ConfigSuite) TestValidateErrors(c *C) {
@@ -52,9 +56,423 @@ func (s *ConfigSuite) TestValidateErrors(c *C) {
 	c.Assert(err.(*ConfigError).Errors, Not(Equals), 0)
 }
 
+func (s *ConfigSuite) TestValidateAuthDefault(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Passages: map[string]*PassageConfig{
+				"qux": {Type: "tcp", Address: "foo", Local: "baz"},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(config.Servers["foo"].Auth, HasLen, 1)
+	c.Assert(config.Servers["foo"].Auth[0].Method, Equals, "agent")
+}
+
+func (s *ConfigSuite) TestValidateAuthErrors(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Auth: []*AuthConfig{
+				{Method: "foo"},
+				{Method: "identity_file"},
+				{Method: "password"},
+			}, Passages: map[string]*PassageConfig{
+				"qux": {Type: "tcp", Address: "foo", Local: "baz"},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 3)
+}
+
+func (s *ConfigSuite) TestValidateStrictHostKeyChecking(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", StrictHostKeyChecking: "maybe", Passages: map[string]*PassageConfig{
+				"qux": {Type: "tcp", Address: "foo", Local: "baz"},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 1)
+
+	config.Servers["foo"].StrictHostKeyChecking = ""
+	err = config.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(config.Servers["foo"].StrictHostKeyChecking, Equals, "yes")
+	c.Assert(config.Servers["foo"].KnownHosts, DeepEquals, []string{"~/.ssh/known_hosts"})
+}
+
+func (s *ConfigSuite) TestValidateKeepAlive(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", KeepAliveMaxMissed: -1, Passages: map[string]*PassageConfig{
+				"qux": {Type: "tcp", Address: "foo", Local: "baz"},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 1)
+
+	config.Servers["foo"].KeepAliveMaxMissed = 0
+	config.Servers["foo"].KeepAliveInterval = -1
+	err = config.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(config.Servers["foo"].KeepAliveInterval, Equals, time.Duration(-1))
+
+	config.Servers["foo"].KeepAliveInterval = 0
+	err = config.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(config.Servers["foo"].KeepAliveInterval, Equals, DefaultKeepAliveInterval)
+	c.Assert(config.Servers["foo"].KeepAliveMaxMissed, Equals, DefaultKeepAliveMaxMissed)
+}
+
+func (s *ConfigSuite) TestValidateMode(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Passages: map[string]*PassageConfig{
+				"qux": {Type: "tcp", Address: "foo", Local: "baz"},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(config.Servers["foo"].Mode, Equals, "lazy")
+	c.Assert(config.Servers["foo"].IdleTimeout, Equals, time.Duration(0))
+
+	config.Servers["foo"].Mode = "on-demand"
+	err = config.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(config.Servers["foo"].IdleTimeout, Equals, DefaultIdleTimeout)
+
+	config.Servers["foo"].Mode = "eager"
+	err = config.Validate()
+	c.Assert(err, ErrorMatches, "(?s).*idle_timeout requires the on-demand mode.*")
+
+	config.Servers["foo"].Mode = "sometimes"
+	config.Servers["foo"].IdleTimeout = -1
+	err = config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 3)
+}
+
+func (s *ConfigSuite) TestValidateBackoff(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Passages: map[string]*PassageConfig{
+				"qux": {Type: "tcp", Address: "foo", Local: "baz"},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(config.Servers["foo"].Backoff, Equals, BackoffConfig{
+		InitialDelay: time.Second, Multiplier: 2, MaxDelay: 30 * time.Second, Jitter: 0.2,
+	})
+
+	config.Servers["foo"].Backoff = BackoffConfig{
+		InitialDelay: time.Minute, MaxDelay: time.Second, Multiplier: 0.5, Jitter: 2,
+	}
+
+	err = config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 3)
+}
+
+func (s *ConfigSuite) TestValidateReverse(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Passages: map[string]*PassageConfig{
+				"qux": {Type: "reverse", Address: "0.0.0.0:8080", Local: "localhost:80"},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(config.Servers["foo"].Passages["qux"].ListenAddress(), Equals, "0.0.0.0:8080")
+}
+
+func (s *ConfigSuite) TestValidateReverseErrors(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Passages: map[string]*PassageConfig{
+				"qux": {Type: "reverse"},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 2)
+}
+
+func (s *ConfigSuite) TestValidateSOCKS(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Passages: map[string]*PassageConfig{
+				"qux": {Type: "socks", Allow: []string{"10.0.0.0/8"}, Deny: []string{"*:25"}},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err, IsNil)
+
+	config.Servers["foo"].Passages["qux"].Allow = []string{"foo bar"}
+	err = config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 1)
+}
+
+func (s *ConfigSuite) TestValidateUDP(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Passages: map[string]*PassageConfig{
+				"qux": {Type: "udp", IdleTimeout: -1},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 2)
+
+	config.Servers["foo"].Passages["qux"] = &PassageConfig{Type: "udp", Address: "10.0.0.2:53"}
+	err = config.Validate()
+	c.Assert(err, IsNil)
+}
+
+func (s *ConfigSuite) TestValidateUnix(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Passages: map[string]*PassageConfig{
+				"qux": {Address: "/var/run/docker.sock", Local: "/tmp/docker.sock", SocketMode: "0660"},
+				"bar": {Type: "reverse", Address: "127.0.0.1:80", Local: "/tmp/app.sock"},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err, IsNil)
+	c.Assert(config.Servers["foo"].Passages["qux"].IsUnix(), Equals, true)
+	c.Assert(config.Servers["foo"].Passages["bar"].IsUnix(), Equals, false)
+
+	config.Servers["foo"].Passages["qux"].SocketMode = "rw"
+	config.Servers["foo"].Passages["bar"].Address = "/tmp/remote.sock"
+	config.Servers["foo"].Passages["baz"] = &PassageConfig{Type: "udp", Address: "foo:53", Local: "/tmp/dns.sock"}
+
+	err = config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 3)
+}
+
+func (s *ConfigSuite) TestValidateDocker(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Docker: DockerConfig{
+				Endpoint: "tcp://localhost:2376", TLSCert: "cert.pem", TLSKey: "key.pem",
+			}, Passages: map[string]*PassageConfig{
+				"qux": {Type: "container", Container: "foo", Port: "80"},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err, IsNil)
+
+	config.Servers["foo"].Docker = DockerConfig{Endpoint: "http://localhost:2375"}
+	err = config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 1)
+
+	config.Servers["foo"].Docker = DockerConfig{TLSCert: "cert.pem"}
+	err = config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 2)
+}
+
+func (s *ConfigSuite) TestValidateContainer(c *C) {
+	passage := &PassageConfig{Type: "container", Port: "80"}
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Passages: map[string]*PassageConfig{"qux": passage}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 1)
+
+	passage.Labels = []string{"com.docker.compose.service=web", "=foo"}
+	passage.Policy = "least-conn"
+	err = config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 1)
+
+	passage.Labels = []string{"com.docker.compose.service=web", "traefik.enable"}
+	passage.Policy = "round-robin"
+	err = config.Validate()
+	c.Assert(err, IsNil)
+
+	selector, err := passage.ContainerSelector()
+	c.Assert(err, IsNil)
+	c.Assert(selector.Labels, DeepEquals, map[string]string{
+		"com.docker.compose.service": "web", "traefik.enable": "",
+	})
+	c.Assert(selector.Policy, Equals, "round-robin")
+}
+
+func (s *ConfigSuite) TestValidateKubernetes(c *C) {
+	passage := &PassageConfig{Type: "kubernetes", Pod: "web-1"}
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Passages: map[string]*PassageConfig{"qux": passage}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 2)
+
+	config.Servers["foo"].Kubernetes.Server = "10.0.0.1:6443"
+	passage.Port = "http"
+	passage.Deployment = "web"
+	err = config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 2)
+
+	config.Servers["foo"].Kubernetes.Server = "https://10.0.0.1:6443"
+	passage.Deployment = ""
+	err = config.Validate()
+	c.Assert(err, IsNil)
+
+	selector := passage.KubernetesSelector("web")
+	c.Assert(selector.Namespace, Equals, "web")
+	c.Assert(selector.Pod, Equals, "web-1")
+}
+
+func (s *ConfigSuite) TestValidateBackends(c *C) {
+	passage := &PassageConfig{Type: "tcp", Backends: []BackendConfig{
+		{Address: "10.0.0.1:80"}, {Server: "bar", Address: "10.0.0.2:80"},
+	}}
+
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "qux", Passages: map[string]*PassageConfig{"qux": passage}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 1)
+
+	config.Servers["bar"] = &SSHServerConfig{User: "foo", Address: "bar"}
+
+	passage.Policy = "first"
+	passage.Address = "10.0.0.3:80"
+	passage.Backends = append(passage.Backends, BackendConfig{})
+	err = config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 3)
+
+	passage.Policy = "least-conn"
+	passage.Address = ""
+	passage.Backends = passage.Backends[:2]
+	err = config.Validate()
+	c.Assert(err, IsNil)
+}
+
+func (s *ConfigSuite) TestValidateFallbacks(c *C) {
+	passage := &PassageConfig{Type: "tcp", Address: "10.0.0.1:80", Fallbacks: []string{"bar", "foo", "qux"}}
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"foo": {User: "foo", Address: "foo", Passages: map[string]*PassageConfig{"baz": passage}},
+			"bar": {User: "foo", Address: "bar"},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err.(*ConfigError).Errors, HasLen, 2)
+
+	passage.Fallbacks = []string{"bar"}
+	err = config.Validate()
+	c.Assert(err, IsNil)
+}
+
+func (s *ConfigSuite) TestValidateVia(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"bastion": {User: "foo", Address: "bastion:22"},
+			"foo": {User: "foo", Address: "qux", Via: "bastion", Passages: map[string]*PassageConfig{
+				"qux": {Type: "tcp", Address: "foo", Local: "baz"},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err, IsNil)
+}
+
+func (s *ConfigSuite) TestValidateViaErrors(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"a": {User: "foo", Address: "a", Via: "b"},
+			"b": {User: "foo", Address: "b", Via: "c"},
+			"c": {User: "foo", Address: "c", Via: "a"},
+			"foo": {User: "foo", Address: "qux", Via: "qux", Passages: map[string]*PassageConfig{
+				"qux": {Type: "tcp", Address: "foo", Local: "baz"},
+			}},
+		},
+	}
+
+	err := config.Validate()
+	c.Assert(err, NotNil)
+	c.Assert(err.(*ConfigError).Errors, DeepEquals, []error{
+		fmt.Errorf(`ssh server "a": via cycle detected: a -> b -> c -> a`),
+		fmt.Errorf(`ssh server "b": via cycle detected: b -> c -> a -> b`),
+		fmt.Errorf(`ssh server "c": via cycle detected: c -> a -> b -> c`),
+		fmt.Errorf(`ssh server "foo": unknown via server "qux"`),
+	})
+}
+
+func (s *ConfigSuite) TestServerNames(c *C) {
+	config := &Config{
+		Servers: map[string]*SSHServerConfig{
+			"a": {Via: "c"},
+			"b": {},
+			"c": {Via: "d"},
+			"d": {},
+		},
+	}
+
+	c.Assert(config.serverNames(), DeepEquals, []string{"d", "c", "a", "b"})
+}
+
 func (s *ConfigSuite) TestValidateEmpty(c *C) {
 	config := &Config{}
 
 	err := config.Validate()
 	c.Assert(err.Error(), Equals, "invalid empty config")
 }
+
+func (s *ConfigSuite) TestParseRemote(c *C) {
+	for value, expected := range map[string]PassageConfig{
+		"8080":               {Type: "tcp", Address: "127.0.0.1:8080"},
+		":8080/tcp":          {Type: "tcp", Address: "127.0.0.1:8080"},
+		"10.0.0.1:53/udp":    {Type: "udp", Address: "10.0.0.1:53"},
+		"container=foo:42":   {Type: "container", Container: "foo", Port: "42"},
+		"[::1]:8080":         {Type: "tcp", Address: "[::1]:8080"},
+		"container=foo:http": {Type: "container", Container: "foo", Port: "http"},
+	} {
+		config, err := ParseRemote(value)
+		c.Assert(err, IsNil, Commentf(value))
+		c.Assert(*config, DeepEquals, expected, Commentf(value))
+	}
+
+	for value, msg := range map[string]string{
+		"":                     "invalid remote format: ",
+		"/tcp":                 "invalid remote format: /tcp",
+		"8080/sctp":            `invalid remote network "sctp"`,
+		"container=foo":        "invalid remote format: container=foo",
+		"pod=foo:80":           "invalid remote format: pod=foo:80",
+		"container=foo:53/udp": `invalid remote network "udp", containers only support tcp`,
+		"foo:bar:80":           "invalid remote format: foo:bar:80",
+	} {
+		_, err := ParseRemote(value)
+		c.Assert(err, ErrorMatches, regexp.QuoteMeta(msg), Commentf(value))
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/mcuadros/passage/core"
+)
+
+// ConnectServers dials the given SSH servers not connected yet, the jump hosts
+// go first. The servers are connected on demand anyway, this warms them up.
+func (s *Server) ConnectServers(ctx context.Context, names []string) error {
+	conns, err := s.serverConnections(names, false)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	for _, name := range conns.names {
+		c, ok := conns.m[name].(core.Connector)
+		if !ok {
+			continue
+		}
+
+		if err := c.Connect(ctx); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("error connecting to %s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// DisconnectServers closes the connections to the given SSH servers, cutting
+// its tunnels. The servers behind them are disconnected too, otherwise they
+// would dial the jump host again while reconnecting.
+func (s *Server) DisconnectServers(names []string) error {
+	conns, err := s.serverConnections(names, true)
+	if err != nil {
+		return err
+	}
+
+	_, err = disconnect(conns)
+	return err
+}
+
+// ReconnectServers closes the connections to the given SSH servers and dials
+// them again, like after a network change. The servers behind them that were
+// connected are dialed again too, with no servers given only the connected
+// ones are dialed again.
+func (s *Server) ReconnectServers(ctx context.Context, names []string) error {
+	conns, err := s.serverConnections(names, true)
+	if err != nil {
+		return err
+	}
+
+	disconnected, err := disconnect(conns)
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 && len(disconnected) == 0 {
+		return nil
+	}
+
+	return s.ConnectServers(ctx, append(names, disconnected...))
+}
+
+// disconnect closes the connections, the servers behind a jump host first, and
+// returns the ones that were connected
+func disconnect(conns *serverConnections) ([]string, error) {
+	var disconnected, errs []string
+	for i := len(conns.names) - 1; i >= 0; i-- {
+		name := conns.names[i]
+		c, ok := conns.m[name].(core.Disconnector)
+		if !ok {
+			continue
+		}
+
+		if connected(conns.m[name]) {
+			disconnected = append(disconnected, name)
+		}
+
+		if err := c.Disconnect(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+
+	if len(errs) != 0 {
+		return nil, fmt.Errorf("error disconnecting from %s", strings.Join(errs, ", "))
+	}
+
+	return disconnected, nil
+}
+
+func connected(c core.SSHConnection) bool {
+	s, ok := c.(interface {
+		Stats() core.ConnectionStats
+	})
+
+	return ok && s.Stats().Connected
+}
+
+type serverConnections struct {
+	// names are sorted with the jump hosts before the servers using them
+	names []string
+	m     map[string]core.SSHConnection
+}
+
+// serverConnections returns the connections of the given servers, all of them
+// if empty, optionally with the servers behind them
+func (s *Server) serverConnections(names []string, behind bool) (*serverConnections, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	if s.c == nil {
+		return nil, fmt.Errorf("no config loaded")
+	}
+
+	selected := map[string]bool{}
+	for _, name := range names {
+		if _, ok := s.servers[name]; !ok {
+			return nil, fmt.Errorf("unable to find a server with name %q", name)
+		}
+
+		selected[name] = true
+	}
+
+	conns := &serverConnections{m: make(map[string]core.SSHConnection)}
+	for _, name := range s.c.serverNames() {
+		include := len(names) == 0 || selected[name]
+		if behind && !include {
+			include = conns.m[s.c.Servers[name].Via] != nil
+		}
+
+		if include && s.servers[name] != nil {
+			conns.names = append(conns.names, name)
+			conns.m[name] = s.servers[name]
+		}
+	}
+
+	return conns, nil
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+
+	"github.com/mcuadros/passage/core"
+
+	. "gopkg.in/check.v1"
+)
+
+type ConnectSuite struct{}
+
+var _ = Suite(&ConnectSuite{})
+
+func (s *ConnectSuite) TestServerConnections(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Via = "quux"
+	config.Servers["baz"].Passages["foo"].Fallbacks = []string{"qux"}
+	config.Servers["qux"] = &SSHServerConfig{User: "root", Address: "127.0.0.2:22"}
+	config.Servers["quux"] = &SSHServerConfig{User: "root", Address: "127.0.0.3:22"}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	conns, err := server.serverConnections(nil, false)
+	c.Assert(err, IsNil)
+	c.Assert(conns.names, DeepEquals, []string{"quux", "baz", "qux"})
+
+	conns, err = server.serverConnections([]string{"quux"}, false)
+	c.Assert(err, IsNil)
+	c.Assert(conns.names, DeepEquals, []string{"quux"})
+
+	conns, err = server.serverConnections([]string{"quux"}, true)
+	c.Assert(err, IsNil)
+	c.Assert(conns.names, DeepEquals, []string{"quux", "baz"})
+	c.Assert(conns.m["baz"], Equals, server.servers["baz"])
+
+	_, err = server.serverConnections([]string{"missing"}, true)
+	c.Assert(err, ErrorMatches, `unable to find a server with name "missing"`)
+}
+
+func (s *ConnectSuite) TestConnectServersError(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Address = closedAddr(c)
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	err = server.ConnectServers(context.Background(), []string{"baz"})
+	c.Assert(err, ErrorMatches, "error connecting to baz: error dialing server: .*")
+
+	stats := server.servers["baz"].(interface {
+		Stats() core.ConnectionStats
+	}).Stats()
+
+	c.Assert(stats.Connected, Equals, false)
+	c.Assert(stats.DialErrors, Equals, uint64(1))
+
+	err = server.DisconnectServers(nil)
+	c.Assert(err, IsNil)
+	c.Assert(server.connectionStats("baz").Disconnects, Equals, uint64(0))
+}
+
+func (s *ConnectSuite) TestConnectServersNoConfig(c *C) {
+	err := NewServer().ConnectServers(context.Background(), nil)
+	c.Assert(err, ErrorMatches, "no config loaded")
+}
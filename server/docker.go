@@ -0,0 +1,57 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/mcuadros/passage/core"
+)
+
+func buildDockerEndpoint(config *DockerConfig) (*core.DockerEndpoint, error) {
+	e := &core.DockerEndpoint{
+		Address:     config.Endpoint,
+		APIVersion:  config.APIVersion,
+		CacheTTL:    config.CacheTTL,
+		WatchEvents: config.WatchEvents,
+	}
+
+	if e.CacheTTL < 0 {
+		e.CacheTTL = 0
+	}
+
+	if config.TLSCert == "" && config.TLSCA == "" {
+		return e, nil
+	}
+
+	var err error
+	e.TLS, err = buildDockerTLS(config)
+	return e, err
+}
+
+func buildDockerTLS(config *DockerConfig) (*tls.Config, error) {
+	c := &tls.Config{}
+	if config.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(expandHome(config.TLSCert), expandHome(config.TLSKey))
+		if err != nil {
+			return nil, fmt.Errorf("error loading docker tls certificate: %s", err)
+		}
+
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.TLSCA != "" {
+		ca, err := ioutil.ReadFile(expandHome(config.TLSCA))
+		if err != nil {
+			return nil, fmt.Errorf("error reading docker tls ca: %s", err)
+		}
+
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("error reading docker tls ca: no certificates found")
+		}
+	}
+
+	return c, nil
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// ephemeralPassage is a passage added at runtime, it's kept apart from the
+// config file and merged on every reload until removed or expired. The
+// persisted ones are saved in the passages file, and read again on every load.
+type ephemeralPassage struct {
+	server    string
+	config    *PassageConfig
+	expires   time.Time
+	persisted bool
+	timer     *time.Timer
+}
+
+// AddPassageArgs is a passage to add at runtime, Remote has the format of the
+// --remote flags, see ParseRemote
+type AddPassageArgs struct {
+	Name   string
+	Server string
+	Remote string
+	Local  string
+	// TTL is the time after which the passage is removed, zero means forever
+	TTL time.Duration
+	// Persist saves the passage in the passages file
+	Persist bool
+}
+
+// AddPassage creates a passage without editing the config file, saving it in
+// the passages file if asked
+func (s *Server) AddPassage(args *AddPassageArgs) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("no config loaded")
+	}
+
+	if args.Name == "" {
+		return fmt.Errorf("passage name cannot be empty")
+	}
+
+	if _, ok := s.passages[args.Name]; ok {
+		return fmt.Errorf("passage %q already exists", args.Name)
+	}
+
+	if args.Persist && args.TTL != 0 {
+		return fmt.Errorf("passage %q: persisted passages can't have a ttl", args.Name)
+	}
+
+	server, err := s.passageServer(args.Server)
+	if err != nil {
+		return err
+	}
+
+	config, err := ParseRemote(args.Remote)
+	if err != nil {
+		return err
+	}
+
+	config.Local = args.Local
+	e := &ephemeralPassage{server: server, config: config, persisted: args.Persist}
+	s.ephemeral[args.Name] = e
+	if err := s.apply(); err != nil {
+		s.dropEphemeral(args.Name)
+		return err
+	}
+
+	if args.Persist {
+		if err := persistPassage(s.PassagesFile, server, args.Name, config); err != nil {
+			s.dropEphemeral(args.Name)
+			return fmt.Errorf("error persisting passage %q: %s", args.Name, err)
+		}
+	}
+
+	if args.TTL != 0 {
+		e.expires = time.Now().Add(args.TTL)
+		e.timer = time.AfterFunc(args.TTL, func() { s.expire(args.Name, e) })
+	}
+
+	log15.Info("passage added", "name", args.Name, "server", server, "ttl", args.TTL, "persisted", args.Persist)
+	return nil
+}
+
+// passageServer returns the server for a new passage, the only one may be
+// omitted
+func (s *Server) passageServer(server string) (string, error) {
+	if server != "" {
+		if _, ok := s.file.Servers[server]; !ok {
+			return "", fmt.Errorf("unable to find a server with name %q", server)
+		}
+
+		return server, nil
+	}
+
+	if len(s.file.Servers) != 1 {
+		return "", fmt.Errorf("server cannot be empty, there are %d servers", len(s.file.Servers))
+	}
+
+	return sortedKeys(s.file.Servers)[0], nil
+}
+
+// RemovePassage removes a passage added at runtime, the persisted ones are
+// only removed if persist is set, deleting them from the passages file. The
+// passages of the config file can't be removed.
+func (s *Server) RemovePassage(name string, persist bool) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if _, ok := s.passages[name]; !ok {
+		return fmt.Errorf("unable to find a passage with name %q", name)
+	}
+
+	server := s.passageServers(name)[0]
+	e, ephemeral := s.ephemeral[name]
+	if !ephemeral {
+		return fmt.Errorf("passage %q is defined in the config file, it must be removed from the file", name)
+	}
+
+	if e.persisted && !persist {
+		return fmt.Errorf("passage %q is persisted, persist is required to remove it", name)
+	}
+
+	if e.persisted {
+		if err := unpersistPassage(s.PassagesFile, server, name); err != nil {
+			return fmt.Errorf("error removing passage %q from the passages file: %s", name, err)
+		}
+	}
+
+	if e.timer != nil {
+		e.timer.Stop()
+	}
+
+	delete(s.ephemeral, name)
+	if err := s.apply(); err != nil {
+		return err
+	}
+
+	log15.Info("passage removed", "name", name, "server", server)
+	return nil
+}
+
+func (s *Server) expire(name string, e *ephemeralPassage) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.ephemeral[name] != e {
+		return
+	}
+
+	delete(s.ephemeral, name)
+	if err := s.apply(); err != nil {
+		log15.Error("error removing expired passage", "name", name, "error", err)
+		return
+	}
+
+	log15.Info("passage expired", "name", name)
+}
+
+// dropEphemeral removes a passage that failed to be added, the config is
+// applied again to close it
+func (s *Server) dropEphemeral(name string) {
+	delete(s.ephemeral, name)
+	if err := s.apply(); err != nil {
+		log15.Error("error restoring config", "error", err)
+	}
+}
+
+// loadPersisted replaces the persisted passages with the ones of the passages
+// file, the passages added at runtime with the same name are replaced too
+func (s *Server) loadPersisted() error {
+	p, err := readPersisted(s.PassagesFile)
+	if err != nil {
+		return err
+	}
+
+	for name, e := range s.ephemeral {
+		if e.persisted {
+			delete(s.ephemeral, name)
+		}
+	}
+
+	for server, passages := range p {
+		for name, config := range passages {
+			if e, ok := s.ephemeral[name]; ok && e.timer != nil {
+				e.timer.Stop()
+			}
+
+			s.ephemeral[name] = &ephemeralPassage{server: server, config: config, persisted: true}
+		}
+	}
+
+	return nil
+}
+
+// mergeEphemeral returns a copy of c with the passages added at runtime. The
+// passages of servers no longer in c are dropped, as the ones with the same
+// name of a passage in c.
+func (s *Server) mergeEphemeral(c *Config) *Config {
+	if len(s.ephemeral) == 0 {
+		return c
+	}
+
+	names := map[string]bool{}
+	for _, name := range c.passageNames() {
+		names[name] = true
+	}
+
+	merged := *c
+	merged.Servers = make(map[string]*SSHServerConfig, len(c.Servers))
+	for name, sc := range c.Servers {
+		merged.Servers[name] = sc
+	}
+
+	for name, e := range s.ephemeral {
+		sc, ok := c.Servers[e.server]
+		if !ok || names[name] {
+			log15.Warn("passage added at runtime overridden by the config", "name", name, "server", e.server)
+
+			if e.timer != nil {
+				e.timer.Stop()
+			}
+
+			delete(s.ephemeral, name)
+			continue
+		}
+
+		if merged.Servers[e.server] == sc {
+			copied := *sc
+			copied.Passages = make(map[string]*PassageConfig, len(sc.Passages)+1)
+			for n, p := range sc.Passages {
+				copied.Passages[n] = p
+			}
+
+			merged.Servers[e.server] = &copied
+		}
+
+		merged.Servers[e.server].Passages[name] = e.config
+	}
+
+	return &merged
+}
+
+// isEphemeral returns if the passage was added at runtime, and its expiration
+func (s *Server) isEphemeral(name string) (bool, time.Time) {
+	e, ok := s.ephemeral[name]
+	if !ok || e.persisted {
+		return false, time.Time{}
+	}
+
+	return true, e.expires
+}
+
+func (s *Server) hasPassage(name string) bool {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	_, ok := s.passages[name]
+	return ok
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type EphemeralSuite struct{}
+
+var _ = Suite(&EphemeralSuite{})
+
+func (s *EphemeralSuite) TestAddPassage(c *C) {
+	server := NewServer()
+	err := server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	err = server.AddPassage(&AddPassageArgs{Name: "tmp", Remote: "container=foo:42"})
+	c.Assert(err, IsNil)
+	c.Assert(server.passages, HasLen, 4)
+
+	info := server.passageInfo("tmp")
+	c.Assert(info.Server, Equals, "baz")
+	c.Assert(info.Type, Equals, "container")
+	c.Assert(info.Ephemeral, Equals, true)
+	c.Assert(info.Local, Matches, `127\.0\.0\.1:\d+`)
+
+	// the file config is not modified, and the passage survives the reloads
+	c.Assert(server.file.Servers["baz"].Passages, HasLen, 3)
+	err = server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	c.Assert(server.passages, HasLen, 4)
+	c.Assert(server.passageInfo("tmp").Local, Equals, info.Local)
+
+	err = server.RemovePassage("tmp", false)
+	c.Assert(err, IsNil)
+	c.Assert(server.passages, HasLen, 3)
+	c.Assert(server.ephemeral, HasLen, 0)
+}
+
+func (s *EphemeralSuite) TestAddPassageErrors(c *C) {
+	config := getConfigFixture()
+	config.Servers["qux"] = &SSHServerConfig{User: "root", Address: "127.0.0.2:22", Passages: map[string]*PassageConfig{
+		"qux-foo": {Address: "localhost:80"},
+	}}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	for _, t := range []struct {
+		args AddPassageArgs
+		msg  string
+	}{
+		{AddPassageArgs{Name: "foo", Server: "baz", Remote: "80"}, `passage "foo" already exists`},
+		{AddPassageArgs{Name: "tmp", Remote: "80"}, "server cannot be empty, there are 2 servers"},
+		{AddPassageArgs{Name: "tmp", Server: "missing", Remote: "80"}, `unable to find a server with name "missing"`},
+		{AddPassageArgs{Name: "tmp", Server: "baz", Remote: "foo=bar"}, "invalid remote format: foo=bar"},
+		{AddPassageArgs{Name: "tmp", Server: "baz", Remote: "80", TTL: time.Hour, Persist: true}, `passage "tmp": persisted passages can't have a ttl`},
+		{AddPassageArgs{Name: "tmp", Server: "baz", Remote: "80", Local: ":8400"}, "error creating listener: .*"},
+	} {
+		err := server.AddPassage(&t.args)
+		c.Assert(err, ErrorMatches, t.msg)
+	}
+
+	c.Assert(server.passages, HasLen, 4)
+	c.Assert(server.ephemeral, HasLen, 0)
+}
+
+func (s *EphemeralSuite) TestAddPassageTTL(c *C) {
+	server := NewServer()
+	err := server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	err = server.AddPassage(&AddPassageArgs{Name: "tmp", Remote: "80", TTL: 50 * time.Millisecond})
+	c.Assert(err, IsNil)
+
+	server.m.RLock()
+	info := server.passageInfo("tmp")
+	server.m.RUnlock()
+	c.Assert(info.Expires.IsZero(), Equals, false)
+
+	for i := 0; i < 100 && server.hasPassage("tmp"); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(server.hasPassage("tmp"), Equals, false)
+}
+
+func (s *EphemeralSuite) TestReloadOverridesPassage(c *C) {
+	server := NewServer()
+	err := server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	err = server.AddPassage(&AddPassageArgs{Name: "tmp", Remote: "80", TTL: time.Hour})
+	c.Assert(err, IsNil)
+
+	config := getConfigFixture()
+	config.Servers["baz"].Passages["tmp"] = &PassageConfig{Address: "localhost:81"}
+	err = server.Load(config)
+	c.Assert(err, IsNil)
+
+	c.Assert(server.ephemeral, HasLen, 0)
+	c.Assert(server.passageInfo("tmp").Remote, Equals, "localhost:81/tcp")
+	c.Assert(server.passageInfo("tmp").Ephemeral, Equals, false)
+}
+
+func (s *EphemeralSuite) TestRemoveConfigPassage(c *C) {
+	server := NewServer()
+	err := server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	err = server.RemovePassage("foo", false)
+	c.Assert(err, ErrorMatches, `passage "foo" is defined in the config file, it must be removed from the file`)
+
+	err = server.RemovePassage("missing", false)
+	c.Assert(err, ErrorMatches, `unable to find a passage with name "missing"`)
+
+	err = server.RemovePassage("foo", true)
+	c.Assert(err, ErrorMatches, `passage "foo" is defined in the config file, it must be removed from the file`)
+	c.Assert(server.passages, HasLen, 3)
+}
+
+func (s *EphemeralSuite) TestPersist(c *C) {
+	file := filepath.Join(c.MkDir(), "passage.passages.yaml")
+
+	server := NewServer()
+	server.PassagesFile = file
+	err := server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	err = server.AddPassage(&AddPassageArgs{Name: "tmp", Server: "baz", Remote: ":81/udp", Local: "127.0.0.1:0", Persist: true})
+	c.Assert(err, IsNil)
+	c.Assert(server.passageInfo("tmp").Ephemeral, Equals, false)
+
+	content, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, persistedHeader+
+		"baz:\n  tmp:\n    address: 127.0.0.1:81\n    local: 127.0.0.1:0\n    type: udp\n")
+
+	// the passage is read again on every load
+	local := server.passageInfo("tmp").Local
+	err = server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	c.Assert(server.passageInfo("tmp").Local, Equals, local)
+
+	config := getConfigFixture()
+	config.Servers["baz"].Passages["foo"].Local = "127.0.0.1:0"
+
+	restarted := NewServer()
+	restarted.PassagesFile = file
+	err = restarted.Load(config)
+	c.Assert(err, IsNil)
+	defer restarted.Close()
+
+	c.Assert(restarted.passageInfo("tmp").Type, Equals, "udp")
+	c.Assert(restarted.passageInfo("tmp").Remote, Equals, "127.0.0.1:81/tcp")
+
+	err = server.RemovePassage("tmp", false)
+	c.Assert(err, ErrorMatches, `passage "tmp" is persisted, persist is required to remove it`)
+
+	err = server.RemovePassage("tmp", true)
+	c.Assert(err, IsNil)
+	c.Assert(server.passages, HasLen, 3)
+
+	content, err = ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	c.Assert(string(content), Equals, persistedHeader+"{}\n")
+}
+
+func (s *EphemeralSuite) TestPersistNoFile(c *C) {
+	server := NewServer()
+	err := server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	err = server.AddPassage(&AddPassageArgs{Name: "tmp", Server: "baz", Remote: "80", Persist: true})
+	c.Assert(err, ErrorMatches, `error persisting passage "tmp": no passages file`)
+	c.Assert(server.hasPassage("tmp"), Equals, false)
+}
+
+func (s *EphemeralSuite) TestPersistedOverridden(c *C) {
+	file := filepath.Join(c.MkDir(), "passage.passages.yaml")
+	err := ioutil.WriteFile(file, []byte("baz:\n  foo:\n    address: localhost:81\n"), 0600)
+	c.Assert(err, IsNil)
+
+	server := NewServer()
+	server.PassagesFile = file
+	err = server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	c.Assert(server.passageInfo("foo").Remote, Equals, "localhost:8400/tcp")
+	c.Assert(server.ephemeral, HasLen, 0)
+}
+
+func (s *EphemeralSuite) TestPassagesFile(c *C) {
+	c.Assert(PassagesFile("/home/foo/.passage.yaml"), Equals, "/home/foo/.passage.passages.yaml")
+	c.Assert(PassagesFile("passage.yml"), Equals, "passage.passages.yaml")
+	c.Assert(PassagesFile(""), Equals, "")
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/mcuadros/passage/core"
+
+	"gopkg.in/yaml.v1"
+)
+
+// kubeconfig is the subset of a kubeconfig file needed to reach the API server
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string
+		Cluster struct {
+			Server                   string
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		}
+	}
+	Users []struct {
+		Name string
+		User struct {
+			Token                 string
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		}
+	}
+	Contexts []struct {
+		Name    string
+		Context struct {
+			Cluster   string
+			User      string
+			Namespace string
+		}
+	}
+}
+
+// kubernetesSettings are the settings from the kubeconfig file, overridden by
+// the ones from the passage config
+type kubernetesSettings struct {
+	server    string
+	token     string
+	ca        []byte
+	cert      []byte
+	key       []byte
+	insecure  bool
+	namespace string
+}
+
+func buildKubernetesEndpoint(config *KubernetesConfig) (*core.KubernetesEndpoint, string, error) {
+	s := &kubernetesSettings{}
+	if config.Kubeconfig != "" {
+		if err := s.loadKubeconfig(expandHome(config.Kubeconfig), config.Context); err != nil {
+			return nil, "", fmt.Errorf("error loading kubeconfig: %s", err)
+		}
+	}
+
+	if err := s.load(config); err != nil {
+		return nil, "", err
+	}
+
+	e := &core.KubernetesEndpoint{Address: s.server, Token: s.token, CacheTTL: config.CacheTTL}
+	if e.CacheTTL < 0 {
+		e.CacheTTL = 0
+	}
+
+	if !strings.HasPrefix(s.server, "https://") {
+		return e, s.namespace, nil
+	}
+
+	var err error
+	e.TLS, err = s.buildTLS()
+	return e, s.namespace, err
+}
+
+func (s *kubernetesSettings) load(config *KubernetesConfig) error {
+	if config.Server != "" {
+		s.server = config.Server
+	}
+
+	token, err := readSecret(config.Token, config.TokenEnv, config.TokenFile)
+	if err != nil {
+		return fmt.Errorf("kubernetes token: %s", err)
+	}
+
+	if token != "" {
+		s.token = token
+	}
+
+	if config.CA != "" {
+		if s.ca, err = ioutil.ReadFile(expandHome(config.CA)); err != nil {
+			return fmt.Errorf("error reading kubernetes ca: %s", err)
+		}
+	}
+
+	if config.InsecureSkipTLSVerify {
+		s.insecure = true
+	}
+
+	if config.Namespace != "" {
+		s.namespace = config.Namespace
+	}
+
+	return nil
+}
+
+func (s *kubernetesSettings) loadKubeconfig(path, context string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	kc := &kubeconfig{}
+	if err := yaml.Unmarshal(content, kc); err != nil {
+		return err
+	}
+
+	if context == "" {
+		context = kc.CurrentContext
+	}
+
+	var cluster, user string
+	found := false
+	for _, c := range kc.Contexts {
+		if c.Name == context {
+			cluster, user, s.namespace = c.Context.Cluster, c.Context.User, c.Context.Namespace
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("context %q not found", context)
+	}
+
+	dir := filepath.Dir(path)
+	for _, c := range kc.Clusters {
+		if c.Name != cluster {
+			continue
+		}
+
+		s.server, s.insecure = c.Cluster.Server, c.Cluster.InsecureSkipTLSVerify
+		if s.ca, err = readKubeconfigData(dir, c.Cluster.CertificateAuthority, c.Cluster.CertificateAuthorityData); err != nil {
+			return err
+		}
+	}
+
+	if s.server == "" {
+		return fmt.Errorf("cluster %q not found", cluster)
+	}
+
+	for _, u := range kc.Users {
+		if u.Name != user {
+			continue
+		}
+
+		if s.token, err = readSecret(u.User.Token, "", resolvePath(dir, u.User.TokenFile)); err != nil {
+			return err
+		}
+
+		if s.cert, err = readKubeconfigData(dir, u.User.ClientCertificate, u.User.ClientCertificateData); err != nil {
+			return err
+		}
+
+		if s.key, err = readKubeconfigData(dir, u.User.ClientKey, u.User.ClientKeyData); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *kubernetesSettings) buildTLS() (*tls.Config, error) {
+	c := &tls.Config{InsecureSkipVerify: s.insecure}
+	if len(s.ca) != 0 {
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(s.ca) {
+			return nil, fmt.Errorf("error reading kubernetes ca: no certificates found")
+		}
+	}
+
+	if len(s.cert) != 0 {
+		cert, err := tls.X509KeyPair(s.cert, s.key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading kubernetes client certificate: %s", err)
+		}
+
+		c.Certificates = []tls.Certificate{cert}
+	}
+
+	return c, nil
+}
+
+// readKubeconfigData returns the content of a file or the base64 encoded data,
+// as given in a kubeconfig file
+func readKubeconfigData(dir, file, data string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	if file == "" {
+		return nil, nil
+	}
+
+	return ioutil.ReadFile(resolvePath(dir, file))
+}
+
+func resolvePath(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+
+	return filepath.Join(dir, path)
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type KubernetesSuite struct{}
+
+var _ = Suite(&KubernetesSuite{})
+
+const kubeconfigFixture = `
+apiVersion: v1
+kind: Config
+current-context: staging
+clusters:
+- name: staging
+  cluster:
+    server: http://10.0.0.1:8080
+- name: prod
+  cluster:
+    server: https://10.0.0.2:6443
+    certificate-authority-data: %s
+users:
+- name: staging
+  user:
+    tokenFile: token
+- name: prod
+  user:
+    token: prod-token
+contexts:
+- name: staging
+  context:
+    cluster: staging
+    user: staging
+    namespace: web
+- name: prod
+  context:
+    cluster: prod
+    user: prod
+`
+
+func (s *KubernetesSuite) writeKubeconfig(c *C) string {
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+
+	dir := c.MkDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("staging-token\n"), 0600)
+	c.Assert(err, IsNil)
+
+	content := fmt.Sprintf(kubeconfigFixture, base64.StdEncoding.EncodeToString(ca))
+	file := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(file, []byte(content), 0600)
+	c.Assert(err, IsNil)
+
+	return file
+}
+
+func (s *KubernetesSuite) TestBuildKubernetesEndpoint(c *C) {
+	file := s.writeKubeconfig(c)
+
+	e, namespace, err := buildKubernetesEndpoint(&KubernetesConfig{Kubeconfig: file})
+	c.Assert(err, IsNil)
+	c.Assert(e.Address, Equals, "http://10.0.0.1:8080")
+	c.Assert(e.Token, Equals, "staging-token")
+	c.Assert(e.TLS, IsNil)
+	c.Assert(namespace, Equals, "web")
+
+	e, namespace, err = buildKubernetesEndpoint(&KubernetesConfig{Kubeconfig: file, Context: "prod"})
+	c.Assert(err, IsNil)
+	c.Assert(e.Address, Equals, "https://10.0.0.2:6443")
+	c.Assert(e.Token, Equals, "prod-token")
+	c.Assert(e.TLS, NotNil)
+	c.Assert(e.TLS.RootCAs, NotNil)
+	c.Assert(namespace, Equals, "")
+}
+
+func (s *KubernetesSuite) TestBuildKubernetesEndpointOverride(c *C) {
+	file := s.writeKubeconfig(c)
+
+	e, namespace, err := buildKubernetesEndpoint(&KubernetesConfig{
+		Kubeconfig:            file,
+		Server:                "https://10.0.0.3:6443",
+		Token:                 "foo",
+		Namespace:             "qux",
+		InsecureSkipTLSVerify: true,
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(e.Address, Equals, "https://10.0.0.3:6443")
+	c.Assert(e.Token, Equals, "foo")
+	c.Assert(e.TLS.InsecureSkipVerify, Equals, true)
+	c.Assert(namespace, Equals, "qux")
+}
+
+func (s *KubernetesSuite) TestBuildKubernetesEndpointContextNotFound(c *C) {
+	file := s.writeKubeconfig(c)
+
+	_, _, err := buildKubernetesEndpoint(&KubernetesConfig{Kubeconfig: file, Context: "foo"})
+	c.Assert(err, ErrorMatches, `error loading kubeconfig: context "foo" not found`)
+}
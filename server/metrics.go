@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mcuadros/passage/core"
+
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// MetricsServer serves the metrics of the server, in the Prometheus text
+// exposition format, at /metrics
+type MetricsServer struct {
+	s *Server
+	l net.Listener
+	h *http.Server
+}
+
+func NewMetricsServer(s *Server) *MetricsServer {
+	return &MetricsServer{s: s}
+}
+
+func (m *MetricsServer) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error creating metrics listener: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	m.l = l
+	m.h = &http.Server{Handler: mux}
+	go func() {
+		if err := m.h.Serve(l); err != nil && err != http.ErrServerClosed {
+			log15.Error("metrics server stopped", "addr", l.Addr(), "error", err)
+		}
+	}()
+
+	return nil
+}
+
+func (m *MetricsServer) Addr() string {
+	if m.l == nil {
+		return "<nil>"
+	}
+
+	return m.l.Addr().String()
+}
+
+func (m *MetricsServer) Close() error {
+	if m.h == nil {
+		return nil
+	}
+
+	return m.h.Close()
+}
+
+func (m *MetricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metricsContentType)
+	bw := bufio.NewWriter(w)
+	m.s.WriteMetrics(bw)
+	bw.Flush()
+}
+
+// WriteMetrics writes the metrics of the passages, the SSH servers and the
+// config reloads in the Prometheus text exposition format
+func (s *Server) WriteMetrics(w io.Writer) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	passages := s.passageNames()
+
+	var servers []string
+	for name := range s.servers {
+		servers = append(servers, name)
+	}
+
+	sort.Strings(servers)
+
+	stats := make(map[string]core.PassageStats, len(passages))
+	for _, name := range passages {
+		stats[name] = s.passages[name].Stats()
+	}
+
+	conns := make(map[string]core.ConnectionStats, len(servers))
+	for _, name := range servers {
+		conns[name] = s.connectionStats(name)
+	}
+
+	// the traffic is accounted to the server of the passage
+	traffic := make(map[string]core.PassageStats, len(servers))
+	for _, name := range passages {
+		if servers := s.passageServers(name); len(servers) != 0 {
+			traffic[servers[0]] = traffic[servers[0]].Merge(stats[name])
+		}
+	}
+
+	mw := &metricsWriter{w: w}
+
+	mw.header("passage_up", "gauge", "Whether the passage can reach its remote, 1, or its SSH server is failing, 0.")
+	for _, name := range passages {
+		mw.sample("passage_up", passageLabels(name), boolValue(s.passages[name].Err() == nil))
+	}
+
+	mw.header("passage_tunnels_active", "gauge", "Number of tunnels open in the passage.")
+	for _, name := range passages {
+		mw.sample("passage_tunnels_active", passageLabels(name), float64(stats[name].ActiveConnections))
+	}
+
+	mw.header("passage_tunnels_total", "counter", "Number of connections accepted by the passage.")
+	for _, name := range passages {
+		mw.sample("passage_tunnels_total", passageLabels(name), float64(stats[name].TotalConnections))
+	}
+
+	mw.header("passage_received_bytes_total", "counter", "Bytes received from the local clients of the passage.")
+	for _, name := range passages {
+		mw.sample("passage_received_bytes_total", passageLabels(name), float64(stats[name].BytesIn))
+	}
+
+	mw.header("passage_sent_bytes_total", "counter", "Bytes sent to the local clients of the passage.")
+	for _, name := range passages {
+		mw.sample("passage_sent_bytes_total", passageLabels(name), float64(stats[name].BytesOut))
+	}
+
+	mw.header("passage_errors_total", "counter", "Connections of the passage failed, by kind of error.")
+	for _, name := range passages {
+		var kinds []string
+		for kind := range stats[name].Errors {
+			kinds = append(kinds, kind)
+		}
+
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			mw.sample("passage_errors_total", passageLabels(name, "kind", kind), float64(stats[name].Errors[kind]))
+		}
+	}
+
+	mw.header("passage_dial_duration_seconds", "histogram", "Time opening the remote connection of the tunnels.")
+	for _, name := range passages {
+		mw.histogram("passage_dial_duration_seconds", passageLabels(name), stats[name].DialLatency)
+	}
+
+	mw.header("passage_tunnel_duration_seconds", "histogram", "Duration of the tunnels of the passage.")
+	for _, name := range passages {
+		mw.histogram("passage_tunnel_duration_seconds", passageLabels(name), stats[name].TunnelDuration)
+	}
+
+	mw.header("passage_ssh_connected", "gauge", "Whether the connection to the SSH server is established.")
+	for _, name := range servers {
+		mw.sample("passage_ssh_connected", serverLabels(name), boolValue(conns[name].Connected))
+	}
+
+	mw.header("passage_ssh_connects_total", "counter", "Successful connections to the SSH server.")
+	for _, name := range servers {
+		mw.sample("passage_ssh_connects_total", serverLabels(name), float64(conns[name].Connects))
+	}
+
+	mw.header("passage_ssh_reconnects_total", "counter", "Connections to the SSH server after the first one.")
+	for _, name := range servers {
+		mw.sample("passage_ssh_reconnects_total", serverLabels(name), float64(conns[name].Reconnects))
+	}
+
+	mw.header("passage_ssh_disconnects_total", "counter", "Connections to the SSH server closed on demand.")
+	for _, name := range servers {
+		mw.sample("passage_ssh_disconnects_total", serverLabels(name), float64(conns[name].Disconnects))
+	}
+
+	mw.header("passage_ssh_idle_timeouts_total", "counter", "Connections to the SSH server closed once idle.")
+	for _, name := range servers {
+		mw.sample("passage_ssh_idle_timeouts_total", serverLabels(name), float64(conns[name].IdleTimeouts))
+	}
+
+	mw.header("passage_ssh_dial_errors_total", "counter", "Failed connections to the SSH server.")
+	for _, name := range servers {
+		mw.sample("passage_ssh_dial_errors_total", serverLabels(name), float64(conns[name].DialErrors))
+	}
+
+	mw.header("passage_ssh_tunnels_active", "gauge", "Number of tunnels open in the passages of the SSH server.")
+	for _, name := range servers {
+		mw.sample("passage_ssh_tunnels_active", serverLabels(name), float64(traffic[name].ActiveConnections))
+	}
+
+	mw.header("passage_ssh_tunnels_total", "counter", "Number of connections accepted by the passages of the SSH server.")
+	for _, name := range servers {
+		mw.sample("passage_ssh_tunnels_total", serverLabels(name), float64(traffic[name].TotalConnections))
+	}
+
+	mw.header("passage_ssh_received_bytes_total", "counter", "Bytes received from the local clients of the passages of the SSH server.")
+	for _, name := range servers {
+		mw.sample("passage_ssh_received_bytes_total", serverLabels(name), float64(traffic[name].BytesIn))
+	}
+
+	mw.header("passage_ssh_sent_bytes_total", "counter", "Bytes sent to the local clients of the passages of the SSH server.")
+	for _, name := range servers {
+		mw.sample("passage_ssh_sent_bytes_total", serverLabels(name), float64(traffic[name].BytesOut))
+	}
+
+	mw.header("passage_ssh_connect_duration_seconds", "histogram", "Time connecting to the SSH server, including the handshake.")
+	for _, name := range servers {
+		mw.histogram("passage_ssh_connect_duration_seconds", serverLabels(name), conns[name].ConnectLatency)
+	}
+
+	mw.header("passage_config_reloads_total", "counter", "Config loads, by result.")
+	mw.sample("passage_config_reloads_total", []string{"result", "success"}, float64(s.reloads.Successes))
+	mw.sample("passage_config_reloads_total", []string{"result", "failure"}, float64(s.reloads.Failures))
+
+	mw.header("passage_config_last_reload_successful", "gauge", "Whether the last config load succeeded.")
+	mw.sample("passage_config_last_reload_successful", nil, boolValue(s.reloads.LastSuccessful))
+
+	mw.header("passage_config_last_reload_success_timestamp_seconds", "gauge", "Time of the last successful config load.")
+	var last float64
+	if !s.reloads.LastSuccess.IsZero() {
+		last = float64(s.reloads.LastSuccess.UnixNano()) / 1e9
+	}
+
+	mw.sample("passage_config_last_reload_success_timestamp_seconds", nil, last)
+}
+
+func passageLabels(name string, extra ...string) []string {
+	return append([]string{"passage", name}, extra...)
+}
+
+func serverLabels(name string) []string {
+	return []string{"server", name}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// metricsWriter writes the Prometheus text exposition format, labels are
+// given as name and value pairs
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (w *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (w *metricsWriter) sample(name string, labels []string, value float64) {
+	fmt.Fprintf(w.w, "%s%s %s\n", name, formatLabels(labels), formatValue(value))
+}
+
+func (w *metricsWriter) histogram(name string, labels []string, h core.HistogramSnapshot) {
+	for i, b := range h.Buckets {
+		le := formatValue(b.Seconds())
+		w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", le), float64(h.Counts[i]))
+	}
+
+	w.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), float64(h.Count))
+	w.sample(name+"_sum", labels, h.Sum.Seconds())
+	w.sample(name+"_count", labels, float64(h.Count))
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
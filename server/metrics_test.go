@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+func (s *MetricsSuite) TestWriteMetrics(c *C) {
+	server := NewServer()
+	err := server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	var buf bytes.Buffer
+	server.WriteMetrics(&buf)
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE passage_tunnels_active gauge",
+		`passage_tunnels_active{passage="foo"} 0`,
+		`passage_tunnels_total{passage="qux"} 0`,
+		`passage_received_bytes_total{passage="bar"} 0`,
+		`passage_dial_duration_seconds_bucket{passage="foo",le="0.001"} 0`,
+		`passage_dial_duration_seconds_bucket{passage="foo",le="2.5"} 0`,
+		`passage_dial_duration_seconds_bucket{passage="foo",le="+Inf"} 0`,
+		`passage_tunnel_duration_seconds_count{passage="foo"} 0`,
+		`passage_ssh_connected{server="baz"} 0`,
+		`passage_ssh_reconnects_total{server="baz"} 0`,
+		`passage_ssh_disconnects_total{server="baz"} 0`,
+		`passage_ssh_idle_timeouts_total{server="baz"} 0`,
+		"# TYPE passage_ssh_tunnels_active gauge",
+		`passage_ssh_tunnels_active{server="baz"} 0`,
+		`passage_ssh_tunnels_total{server="baz"} 0`,
+		`passage_ssh_received_bytes_total{server="baz"} 0`,
+		`passage_ssh_sent_bytes_total{server="baz"} 0`,
+		`passage_config_reloads_total{result="success"} 1`,
+		`passage_config_reloads_total{result="failure"} 0`,
+		"passage_config_last_reload_successful 1",
+	} {
+		c.Assert(strings.Contains(out, line+"\n"), Equals, true, Commentf("missing %q", line))
+	}
+}
+
+func (s *MetricsSuite) TestWriteMetricsServerTraffic(c *C) {
+	config := getConfigFixture()
+	backoff := BackoffConfig{InitialDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	config.Servers["baz"].Address = closedAddr(c)
+	config.Servers["baz"].Backoff = backoff
+	config.Servers["baz"].Passages["foo"].Local = "127.0.0.1:0"
+	config.Servers["baz"].Passages["foo"].Fallbacks = []string{"qux"}
+	config.Servers["qux"] = &SSHServerConfig{User: "root", Address: closedAddr(c), Backoff: backoff}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.passages["foo"].Addr())
+	c.Assert(err, IsNil)
+	ioutil.ReadAll(conn)
+	conn.Close()
+
+	for i := 0; i < 100 && server.passages["foo"].Stats().ActiveConnections != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var buf bytes.Buffer
+	server.WriteMetrics(&buf)
+	out := buf.String()
+
+	for _, line := range []string{
+		`passage_ssh_tunnels_active{server="baz"} 0`,
+		`passage_ssh_tunnels_total{server="baz"} 1`,
+		`passage_ssh_tunnels_total{server="qux"} 0`,
+	} {
+		c.Assert(strings.Contains(out, line+"\n"), Equals, true, Commentf("missing %q", line))
+	}
+}
+
+func (s *MetricsSuite) TestWriteMetricsReloadFailure(c *C) {
+	server := NewServer()
+	err := server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	config := getConfigFixture()
+	config.Servers["baz"].Address = ""
+	err = server.Load(config)
+	c.Assert(err, NotNil)
+
+	reloads := server.Reloads()
+	c.Assert(reloads.Successes, Equals, uint64(1))
+	c.Assert(reloads.Failures, Equals, uint64(1))
+	c.Assert(reloads.LastSuccessful, Equals, false)
+	c.Assert(reloads.LastSuccess.IsZero(), Equals, false)
+
+	var buf bytes.Buffer
+	server.WriteMetrics(&buf)
+	c.Assert(strings.Contains(buf.String(), "passage_config_last_reload_successful 0\n"), Equals, true)
+}
+
+func (s *MetricsSuite) TestMetricsServer(c *C) {
+	server := NewServer()
+	err := server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	m := NewMetricsServer(server)
+	err = m.Listen("127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer m.Close()
+
+	res, err := http.Get("http://" + m.Addr() + "/metrics")
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), Equals, metricsContentType)
+
+	body, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(string(body), `passage_up{passage="foo"} 1`), Equals, true)
+}
+
+func (s *MetricsSuite) TestFormatLabels(c *C) {
+	c.Assert(formatLabels(nil), Equals, "")
+	c.Assert(formatLabels([]string{"passage", "a\"b\\c\nd", "kind", "dial"}), Equals, `{passage="a\"b\\c\nd",kind="dial"}`)
+}
+
+// closedAddr returns a local address where nobody is listening
+func closedAddr(c *C) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	l.Close()
+
+	return l.Addr().String()
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v1"
+)
+
+const persistedHeader = "# passages added with `passage add --persist`, managed by the passage server\n"
+
+// persistedPassages are the passages of the passages file, by server and name
+type persistedPassages map[string]map[string]*PassageConfig
+
+// PassagesFile returns the default passages file of a config file, next to it
+// with the `.passages.yaml` extension
+func PassagesFile(configFile string) string {
+	if configFile == "" {
+		return ""
+	}
+
+	return strings.TrimSuffix(configFile, filepath.Ext(configFile)) + ".passages.yaml"
+}
+
+// readPersisted returns the passages of the file, none if it doesn't exist
+func readPersisted(file string) (persistedPassages, error) {
+	p := make(persistedPassages)
+	if file == "" {
+		return p, nil
+	}
+
+	content, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(content, &p); err != nil {
+		return nil, fmt.Errorf("error reading passages file %q: %s", file, err)
+	}
+
+	return p, nil
+}
+
+// persistPassage adds the passage of the server to the passages file
+func persistPassage(file, server, name string, config *PassageConfig) error {
+	return editPersisted(file, func(p persistedPassages) error {
+		if p[server] == nil {
+			p[server] = make(map[string]*PassageConfig)
+		}
+
+		p[server][name] = config
+		return nil
+	})
+}
+
+// unpersistPassage removes the passage of the server from the passages file
+func unpersistPassage(file, server, name string) error {
+	return editPersisted(file, func(p persistedPassages) error {
+		if _, ok := p[server][name]; !ok {
+			return fmt.Errorf("passage %q not found", name)
+		}
+
+		delete(p[server], name)
+		if len(p[server]) == 0 {
+			delete(p, server)
+		}
+
+		return nil
+	})
+}
+
+// editPersisted calls edit with the passages of the file, writing back the
+// changes
+func editPersisted(file string, edit func(persistedPassages) error) error {
+	if file == "" {
+		return fmt.Errorf("no passages file")
+	}
+
+	p, err := readPersisted(file)
+	if err != nil {
+		return err
+	}
+
+	if err := edit(p); err != nil {
+		return err
+	}
+
+	doc := make(map[string]map[string]map[string]string, len(p))
+	for server, passages := range p {
+		doc[server] = make(map[string]map[string]string, len(passages))
+		for name, config := range passages {
+			doc[server][name] = passageYAML(config)
+		}
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(file, append([]byte(persistedHeader), out...))
+}
+
+// passageYAML returns the fields of the config set by ParseRemote
+func passageYAML(config *PassageConfig) map[string]string {
+	out := make(map[string]string)
+	for key, value := range map[string]string{
+		"type":      config.Type,
+		"address":   config.Address,
+		"container": config.Container,
+		"port":      config.Port,
+		"local":     config.Local,
+	} {
+		if value != "" {
+			out[key] = value
+		}
+	}
+
+	return out
+}
+
+// writeFileAtomic replaces the file keeping its mode, the content is written to
+// a temporary file first, so it's never read half written
+func writeFileAtomic(file string, content []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(file); err == nil {
+		mode = info.Mode()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
@@ -1,9 +1,11 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/rpc"
+	"time"
 
 	"github.com/mcuadros/passage/core"
 )
@@ -51,11 +53,298 @@ type RPCContainer struct {
 }
 
 func (r *RPCContainer) Addr(passage string, reply *string) error {
+	r.s.m.RLock()
+	defer r.s.m.RUnlock()
+
 	p, ok := r.s.passages[passage]
 	if !ok {
 		return fmt.Errorf("unable to find a passage with name %q", passage)
 	}
 
+	if err, ok := p.Err().(*core.HostKeyError); ok {
+		return fmt.Errorf("passage %q: %s", passage, err)
+	}
+
 	*reply = p.Addr()
 	return nil
 }
+
+// PassagePath are the SSH servers of a passage, the primary one followed by the
+// fallbacks, and the one in use
+type PassagePath struct {
+	Servers []string
+	Active  string
+}
+
+func (r *RPCContainer) Path(passage string, reply *PassagePath) error {
+	r.s.m.RLock()
+	defer r.s.m.RUnlock()
+
+	path, err := r.s.passagePath(passage)
+	if err != nil {
+		return err
+	}
+
+	*reply = path
+	return nil
+}
+
+// Stats are the metrics of the passages, and of the SSH servers with the
+// traffic of its passages
+type Stats struct {
+	Passages map[string]core.PassageStats
+	Servers  map[string]ServerStats
+}
+
+type ServerStats struct {
+	core.ConnectionStats
+	Traffic core.PassageStats
+}
+
+// Stats returns the metrics of the given passage and its servers, or all of
+// them if passage is empty
+func (r *RPCContainer) Stats(passage string, reply *Stats) error {
+	r.s.m.RLock()
+	defer r.s.m.RUnlock()
+
+	names := r.s.passageNames()
+	if passage != "" {
+		if _, ok := r.s.passages[passage]; !ok {
+			return fmt.Errorf("unable to find a passage with name %q", passage)
+		}
+
+		names = []string{passage}
+	}
+
+	*reply = Stats{
+		Passages: make(map[string]core.PassageStats),
+		Servers:  make(map[string]ServerStats),
+	}
+
+	for _, name := range names {
+		stats := r.s.passages[name].Stats()
+		reply.Passages[name] = stats
+
+		servers := r.s.passageServers(name)
+		for i, server := range servers {
+			ss, ok := reply.Servers[server]
+			if !ok {
+				ss = ServerStats{ConnectionStats: r.s.connectionStats(server)}
+			}
+
+			// the traffic is accounted to the server of the passage
+			if i == 0 {
+				ss.Traffic = ss.Traffic.Merge(stats)
+			}
+
+			reply.Servers[server] = ss
+		}
+	}
+
+	if passage != "" {
+		return nil
+	}
+
+	for name := range r.s.servers {
+		if _, ok := reply.Servers[name]; !ok {
+			reply.Servers[name] = ServerStats{ConnectionStats: r.s.connectionStats(name)}
+		}
+	}
+
+	return nil
+}
+
+const (
+	PassageStateUp      = "up"
+	PassageStateDown    = "down"
+	PassageStatePending = "pending"
+)
+
+// PassageInfo is the summary of a passage, the state is down when its SSH
+// server is failing and pending until it's listening
+type PassageInfo struct {
+	Name   string
+	Server string
+	Type   string
+	Local  string
+	Remote string
+	State  string
+	Error  string
+
+	// Ephemeral is set for the passages added at runtime and not persisted,
+	// Expires is the end of its TTL if any
+	Ephemeral bool
+	Expires   time.Time
+}
+
+// PassageDescription is everything known about a passage, the passwords of its
+// users are redacted
+type PassageDescription struct {
+	PassageInfo
+	Config PassageConfig
+	Path   PassagePath
+	Stats  core.PassageStats
+}
+
+const (
+	ServerStateConnected    = "connected"
+	ServerStateConnecting   = "connecting"
+	ServerStateDisconnected = "disconnected"
+)
+
+// ServerInfo is the state of the connection to a SSH server, Uptime is the
+// time since the current connection was established
+type ServerInfo struct {
+	Name      string
+	Address   string
+	User      string
+	Via       string
+	Mode      string
+	State     string
+	Connected bool
+	Uptime    time.Duration
+	LastError string
+	Passages  []string
+}
+
+// List returns the passages of the given server, or all of them if empty
+func (r *RPCContainer) List(server string, reply *[]PassageInfo) error {
+	r.s.m.RLock()
+	defer r.s.m.RUnlock()
+
+	if server != "" && r.s.servers[server] == nil {
+		return fmt.Errorf("unable to find a server with name %q", server)
+	}
+
+	infos := []PassageInfo{}
+	for _, name := range r.s.passageNames() {
+		info := r.s.passageInfo(name)
+		if server == "" || info.Server == server {
+			infos = append(infos, info)
+		}
+	}
+
+	*reply = infos
+	return nil
+}
+
+func (r *RPCContainer) Describe(passage string, reply *PassageDescription) error {
+	r.s.m.RLock()
+	defer r.s.m.RUnlock()
+
+	p, ok := r.s.passages[passage]
+	if !ok {
+		return fmt.Errorf("unable to find a passage with name %q", passage)
+	}
+
+	d := PassageDescription{PassageInfo: r.s.passageInfo(passage), Stats: p.Stats()}
+	if config := r.s.passageConfig(passage); config != nil {
+		d.Config = *config
+		d.Config.Users = redactUsers(config.Users)
+	}
+
+	var err error
+	if d.Path, err = r.s.passagePath(passage); err != nil {
+		return err
+	}
+
+	*reply = d
+	return nil
+}
+
+// Servers returns the SSH servers, sorted by name
+func (r *RPCContainer) Servers(_ string, reply *[]ServerInfo) error {
+	r.s.m.RLock()
+	defer r.s.m.RUnlock()
+
+	*reply = r.s.serverInfos(nil)
+	return nil
+}
+
+// ServerArgs are the SSH servers to connect, disconnect or reconnect, all of
+// them if empty
+type ServerArgs struct {
+	Names []string
+}
+
+// Connect dials the servers, see Server.ConnectServers
+func (r *RPCContainer) Connect(args ServerArgs, reply *[]ServerInfo) error {
+	if err := r.s.ConnectServers(context.Background(), args.Names); err != nil {
+		return err
+	}
+
+	return r.servers(args.Names, reply)
+}
+
+// Disconnect closes the connections to the servers, see
+// Server.DisconnectServers
+func (r *RPCContainer) Disconnect(args ServerArgs, reply *[]ServerInfo) error {
+	if err := r.s.DisconnectServers(args.Names); err != nil {
+		return err
+	}
+
+	return r.servers(args.Names, reply)
+}
+
+// Reconnect closes the connections to the servers and dials them again, see
+// Server.ReconnectServers
+func (r *RPCContainer) Reconnect(args ServerArgs, reply *[]ServerInfo) error {
+	if err := r.s.ReconnectServers(context.Background(), args.Names); err != nil {
+		return err
+	}
+
+	return r.servers(args.Names, reply)
+}
+
+func (r *RPCContainer) servers(names []string, reply *[]ServerInfo) error {
+	r.s.m.RLock()
+	defer r.s.m.RUnlock()
+
+	*reply = r.s.serverInfos(names)
+	return nil
+}
+
+// Add creates a passage at runtime, see Server.AddPassage
+func (r *RPCContainer) Add(args AddPassageArgs, reply *PassageInfo) error {
+	if err := r.s.AddPassage(&args); err != nil {
+		return err
+	}
+
+	r.s.m.RLock()
+	defer r.s.m.RUnlock()
+
+	if _, ok := r.s.passages[args.Name]; !ok {
+		return fmt.Errorf("passage %q removed while being added", args.Name)
+	}
+
+	*reply = r.s.passageInfo(args.Name)
+	return nil
+}
+
+type RemovePassageArgs struct {
+	Name    string
+	Persist bool
+}
+
+// Remove removes a passage, see Server.RemovePassage
+func (r *RPCContainer) Remove(args RemovePassageArgs, reply *bool) error {
+	if err := r.s.RemovePassage(args.Name, args.Persist); err != nil {
+		return err
+	}
+
+	*reply = true
+	return nil
+}
+
+func redactUsers(users map[string]string) map[string]string {
+	if users == nil {
+		return nil
+	}
+
+	redacted := make(map[string]string, len(users))
+	for user := range users {
+		redacted[user] = "<redacted>"
+	}
+
+	return redacted
+}
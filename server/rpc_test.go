@@ -3,6 +3,7 @@ package server
 import (
 	"net"
 	"net/rpc"
+	"path/filepath"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -24,8 +25,8 @@ func (s *RPCSuite) TestNewRPC(c *C) {
 	c.Assert(err, IsNil)
 
 	rpcServer := NewRPCServer(server)
-	go rpcServer.Listen(a)
-	time.Sleep(100 * time.Millisecond)
+	err = rpcServer.Listen(a)
+	c.Assert(err, IsNil)
 	defer rpcServer.Close()
 
 	rpcClient, err := rpc.Dial("unix", rpcServer.l.String())
@@ -37,3 +38,226 @@ func (s *RPCSuite) TestNewRPC(c *C) {
 
 	c.Assert(reply, Equals, "[::]:8400")
 }
+
+func (s *RPCSuite) TestPath(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Passages["foo"].Fallbacks = []string{"qux"}
+	config.Servers["qux"] = &SSHServerConfig{User: "root", Address: "127.0.0.2:22"}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	a, err := net.ResolveUnixAddr("unix", filepath.Join(c.MkDir(), "rpc.sock"))
+	c.Assert(err, IsNil)
+
+	rpcServer := NewRPCServer(server)
+	err = rpcServer.Listen(a)
+	c.Assert(err, IsNil)
+	defer rpcServer.Close()
+
+	rpcClient, err := rpc.Dial("unix", rpcServer.l.String())
+	c.Assert(err, IsNil)
+
+	var reply PassagePath
+	err = rpcClient.Call("Server.Path", "foo", &reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply, DeepEquals, PassagePath{Servers: []string{"baz", "qux"}, Active: "baz"})
+
+	err = rpcClient.Call("Server.Path", "bar", &reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply, DeepEquals, PassagePath{Servers: []string{"baz"}, Active: "baz"})
+}
+
+func (s *RPCSuite) TestStats(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Passages["foo"].Fallbacks = []string{"qux"}
+	config.Servers["qux"] = &SSHServerConfig{User: "root", Address: "127.0.0.2:22"}
+	config.Servers["quux"] = &SSHServerConfig{User: "root", Address: "127.0.0.3:22"}
+	config.Servers["baz"].Via = "quux"
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	a, err := net.ResolveUnixAddr("unix", filepath.Join(c.MkDir(), "rpc.sock"))
+	c.Assert(err, IsNil)
+
+	rpcServer := NewRPCServer(server)
+	err = rpcServer.Listen(a)
+	c.Assert(err, IsNil)
+	defer rpcServer.Close()
+
+	rpcClient, err := rpc.Dial("unix", rpcServer.l.String())
+	c.Assert(err, IsNil)
+
+	var reply Stats
+	err = rpcClient.Call("Server.Stats", "", &reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply.Passages, HasLen, 3)
+	c.Assert(reply.Servers, HasLen, 3)
+	c.Assert(reply.Servers["baz"].Connected, Equals, false)
+
+	reply = Stats{}
+	err = rpcClient.Call("Server.Stats", "foo", &reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply.Passages, HasLen, 1)
+	c.Assert(reply.Servers, HasLen, 2)
+	c.Assert(reply.Servers["baz"], NotNil)
+	c.Assert(reply.Servers["qux"], NotNil)
+
+	err = rpcClient.Call("Server.Stats", "missing", &reply)
+	c.Assert(err, ErrorMatches, `unable to find a passage with name "missing"`)
+}
+
+func (s *RPCSuite) TestList(c *C) {
+	config := getConfigFixture()
+	config.Servers["qux"] = &SSHServerConfig{User: "root", Address: "127.0.0.2:22", Passages: map[string]*PassageConfig{
+		"socks": {Type: "socks"},
+	}}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	r := &RPCContainer{s: server}
+
+	var reply []PassageInfo
+	err = r.List("", &reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply, HasLen, 4)
+	c.Assert(reply[0].Name, Equals, "bar")
+	c.Assert(reply[0].Server, Equals, "baz")
+	c.Assert(reply[0].Type, Equals, "tcp")
+	c.Assert(reply[0].Remote, Equals, "localhost:8400/tcp")
+	c.Assert(reply[0].State, Equals, PassageStateUp)
+	c.Assert(reply[1].Name, Equals, "foo")
+	c.Assert(reply[1].Local, Equals, "[::]:8400")
+	c.Assert(reply[3].Name, Equals, "socks")
+	c.Assert(reply[3].Type, Equals, "socks")
+
+	err = r.List("qux", &reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply, HasLen, 1)
+	c.Assert(reply[0].Name, Equals, "socks")
+
+	err = r.List("missing", &reply)
+	c.Assert(err, ErrorMatches, `unable to find a server with name "missing"`)
+}
+
+func (s *RPCSuite) TestDescribe(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Passages["proxy"] = &PassageConfig{
+		Type:  "socks",
+		Users: map[string]string{"foo": "secret"},
+	}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	r := &RPCContainer{s: server}
+
+	var reply PassageDescription
+	err = r.Describe("proxy", &reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply.Name, Equals, "proxy")
+	c.Assert(reply.Config.Type, Equals, "socks")
+	c.Assert(reply.Config.Users, DeepEquals, map[string]string{"foo": "<redacted>"})
+	c.Assert(reply.Path, DeepEquals, PassagePath{Servers: []string{"baz"}, Active: "baz"})
+	c.Assert(config.Servers["baz"].Passages["proxy"].Users["foo"], Equals, "secret")
+
+	err = r.Describe("missing", &reply)
+	c.Assert(err, ErrorMatches, `unable to find a passage with name "missing"`)
+}
+
+func (s *RPCSuite) TestServers(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Passages["foo"].Fallbacks = []string{"qux"}
+	config.Servers["qux"] = &SSHServerConfig{User: "root", Address: "127.0.0.2:22", Mode: "on-demand"}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	r := &RPCContainer{s: server}
+
+	var reply []ServerInfo
+	err = r.Servers("", &reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply, DeepEquals, []ServerInfo{
+		{Name: "baz", Address: "localhost:22", User: "root", Mode: "lazy", State: ServerStateDisconnected, Passages: []string{"bar", "foo", "qux"}},
+		{Name: "qux", Address: "127.0.0.2:22", User: "root", Mode: "on-demand", State: ServerStateDisconnected},
+	})
+}
+
+func (s *RPCSuite) TestConnect(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Address = closedAddr(c)
+	config.Servers["baz"].Passages["foo"].Fallbacks = []string{"qux"}
+	config.Servers["qux"] = &SSHServerConfig{User: "root", Address: "127.0.0.2:22"}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	r := &RPCContainer{s: server}
+
+	var reply []ServerInfo
+	err = r.Connect(ServerArgs{Names: []string{"baz"}}, &reply)
+	c.Assert(err, ErrorMatches, "error connecting to baz: .*")
+
+	err = r.Disconnect(ServerArgs{Names: []string{"qux"}}, &reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply, HasLen, 1)
+	c.Assert(reply[0].Name, Equals, "qux")
+	c.Assert(reply[0].State, Equals, ServerStateDisconnected)
+
+	err = r.Reconnect(ServerArgs{}, &reply)
+	c.Assert(err, IsNil)
+	c.Assert(reply, HasLen, 2)
+	c.Assert(reply[0].LastError, Not(Equals), "")
+
+	err = r.Reconnect(ServerArgs{Names: []string{"missing"}}, &reply)
+	c.Assert(err, ErrorMatches, `unable to find a server with name "missing"`)
+}
+
+func (s *RPCSuite) TestAddRemove(c *C) {
+	server := NewServer()
+	err := server.Load(getConfigFixture())
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	a, err := net.ResolveUnixAddr("unix", filepath.Join(c.MkDir(), "rpc.sock"))
+	c.Assert(err, IsNil)
+
+	rpcServer := NewRPCServer(server)
+	err = rpcServer.Listen(a)
+	c.Assert(err, IsNil)
+	defer rpcServer.Close()
+
+	rpcClient, err := rpc.Dial("unix", rpcServer.l.String())
+	c.Assert(err, IsNil)
+
+	var info PassageInfo
+	err = rpcClient.Call("Server.Add", AddPassageArgs{Name: "tmp", Remote: ":8080", TTL: time.Hour}, &info)
+	c.Assert(err, IsNil)
+	c.Assert(info.Name, Equals, "tmp")
+	c.Assert(info.Remote, Equals, "127.0.0.1:8080/tcp")
+	c.Assert(info.Ephemeral, Equals, true)
+	c.Assert(info.Expires.After(time.Now()), Equals, true)
+
+	var removed bool
+	err = rpcClient.Call("Server.Remove", RemovePassageArgs{Name: "tmp"}, &removed)
+	c.Assert(err, IsNil)
+	c.Assert(removed, Equals, true)
+
+	err = rpcClient.Call("Server.Remove", RemovePassageArgs{Name: "tmp"}, &removed)
+	c.Assert(err, ErrorMatches, `unable to find a passage with name "tmp"`)
+}
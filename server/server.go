@@ -1,10 +1,20 @@
 package server
 
 import (
+	"context"
 	"crypto/sha1"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mcuadros/passage/core"
 
@@ -16,172 +26,744 @@ type Server struct {
 	c *Config
 	f fingerprints
 
+	drainTimeout time.Duration
+
+	// m guards the config, servers and passages, read concurrently by the RPC
+	// and metrics servers
+	m        sync.RWMutex
 	servers  map[string]core.SSHConnection
 	passages map[string]*core.Passage
+	reloads  ReloadStats
+
+	// file is the last config loaded, the passages added at runtime are
+	// merged into it
+	file      *Config
+	ephemeral map[string]*ephemeralPassage
+
+	// PassagesFile is the file where the passages added at runtime are
+	// persisted, if asked, it's read on every load, see PassagesFile
+	PassagesFile string
+}
+
+// ReloadStats are the results of the config loads
+type ReloadStats struct {
+	Successes uint64
+	Failures  uint64
+	// LastSuccessful is the result of the last load, LastSuccess the time of
+	// the last successful one
+	LastSuccessful bool
+	LastSuccess    time.Time
 }
 
 func NewServer() *Server {
 	return &Server{
-		f:        make(fingerprints),
-		servers:  make(map[string]core.SSHConnection, 0),
-		passages: make(map[string]*core.Passage, 0),
+		f:         make(fingerprints),
+		servers:   make(map[string]core.SSHConnection, 0),
+		passages:  make(map[string]*core.Passage, 0),
+		ephemeral: make(map[string]*ephemeralPassage, 0),
 	}
 }
 
 func (s *Server) Load(c *Config) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	err := s.load(c)
+	if err != nil {
+		s.reloads.Failures++
+		s.reloads.LastSuccessful = false
+		return err
+	}
+
+	s.reloads.Successes++
+	s.reloads.LastSuccessful = true
+	s.reloads.LastSuccess = time.Now()
+	return nil
+}
+
+// Reloads returns the results of the config loads
+func (s *Server) Reloads() ReloadStats {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
+	return s.reloads
+}
+
+func (s *Server) load(c *Config) error {
 	if err := c.Validate(); err != nil {
 		return err
 	}
 
-	var loadedServers, loadedPassages []string
+	if err := s.loadPersisted(); err != nil {
+		return err
+	}
 
-	for name, server := range c.Servers {
-		loadedPassage, err := s.loadSSHConnection(name, server)
-		if err != nil {
+	s.file = c
+	return s.apply()
+}
+
+// apply loads the config with the passages added at runtime
+func (s *Server) apply() error {
+	c := s.mergeEphemeral(s.file)
+	if err := c.Validate(); err != nil {
+		return err
+	}
+
+	s.c = c
+	s.drainTimeout = c.DrainTimeout
+
+	// the removed passages are closed first, releasing its local addresses
+	if err := s.cleanPassages(c.passageNames()); err != nil {
+		return err
+	}
+
+	var loadedServers []string
+
+	rebuilt := map[string]bool{}
+	for _, name := range c.serverNames() {
+		if err := s.loadSSHConnection(name, c.Servers[name], rebuilt); err != nil {
 			return err
 		}
 
 		loadedServers = append(loadedServers, name)
-		loadedPassages = append(loadedPassages, loadedPassage...)
+	}
+
+	// the passages are loaded once all the connections are, since the
+	// backends of a passage may be at other servers
+	for _, name := range loadedServers {
+		if err := s.loadPassages(name, c.Servers[name], rebuilt); err != nil {
+			return err
+		}
 	}
 
 	s.cleanServers(loadedServers)
-	s.cleanPassages(loadedPassages)
+	s.connectEager(c, rebuilt)
 	return nil
 }
 
-func (s *Server) loadSSHConnection(name string, config *SSHServerConfig) ([]string, error) {
+func (s *Server) loadSSHConnection(
+	name string, config *SSHServerConfig, rebuilt map[string]bool,
+) error {
 	c, err := s.buildSSHConnection(config)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if s.f.IsNewSSHServer(name, config) {
+	// a server using a rebuilt server as via holds the old connection
+	if s.f.IsNewSSHServer(name, config) || rebuilt[config.Via] {
+		if old, ok := s.servers[name]; ok {
+			closeConnection(old)
+		}
+
 		s.servers[name] = c
+		rebuilt[name] = true
 	}
 
-	loadedPassages, err := s.loadPassages(s.servers[name], config)
-	if err != nil {
-		return loadedPassages, err
+	return nil
+}
+
+// closeConnection closes the client once the tunnels of the drained passages
+// finish
+func closeConnection(c core.SSHConnection) {
+	if closer, ok := c.(io.Closer); ok {
+		closer.Close()
 	}
+}
+
+// connectEager dials in background the rebuilt servers in the eager mode, they
+// keep reconnecting on failure
+func (s *Server) connectEager(c *Config, rebuilt map[string]bool) {
+	for _, name := range c.serverNames() {
+		if !rebuilt[name] || c.Servers[name].Mode != core.ConnectionModeEager {
+			continue
+		}
 
-	return loadedPassages, nil
+		if conn, ok := s.servers[name].(core.Connector); ok {
+			go conn.Connect(context.Background())
+		}
+	}
 }
 
 func (s *Server) buildSSHConnection(config *SSHServerConfig) (core.SSHConnection, error) {
-	a, err := net.ResolveTCPAddr("tcp", config.Address)
+	auth, err := buildAuthMethods(config)
 	if err != nil {
 		return nil, err
 	}
 
-	agent, err := core.SSHAgent()
+	c := &ssh.ClientConfig{
+		User:            config.User,
+		Timeout:         config.Timeout,
+		Auth:            auth,
+		HostKeyCallback: buildHostKeyVerifier(config).Check,
+	}
+
+	o := core.SSHConnectionOptions{
+		Retries:            config.Retries,
+		Backoff:            config.Backoff.Backoff(),
+		KeepAliveInterval:  config.KeepAliveInterval,
+		KeepAliveMaxMissed: config.KeepAliveMaxMissed,
+		Mode:               config.Mode,
+		IdleTimeout:        config.IdleTimeout,
+	}
+
+	// the address of a server behind a jump host is resolved by the jump host
+	if config.Via != "" {
+		a := core.NewUnresolvedAddr("tcp", config.Address)
+		return core.NewSSHConnectionWithOptions(s.servers[config.Via], a, c, o), nil
+	}
+
+	a, err := net.ResolveTCPAddr("tcp", config.Address)
 	if err != nil {
 		return nil, err
 	}
 
-	return core.NewSSHConnection(a, &ssh.ClientConfig{
-		User:    config.User,
-		Timeout: config.Timeout,
-		Auth:    []ssh.AuthMethod{agent},
-	}, config.Retries), nil
+	return core.NewSSHConnectionWithOptions(nil, a, c, o), nil
+}
+
+func buildHostKeyVerifier(config *SSHServerConfig) *core.HostKeyVerifier {
+	var knownHosts []string
+	for _, f := range config.KnownHosts {
+		knownHosts = append(knownHosts, expandHome(f))
+	}
+
+	return core.NewHostKeyVerifier(
+		config.Address, knownHosts, config.HostKey, config.StrictHostKeyChecking,
+	)
 }
 
-func (s *Server) loadPassages(c core.SSHConnection, config *SSHServerConfig) ([]string, error) {
-	var loadedPassages []string
+func (s *Server) loadPassages(server string, config *SSHServerConfig, rebuilt map[string]bool) error {
 	for name, p := range config.Passages {
-		if err := s.loadPassage(c, config, name, p); err != nil {
-			return loadedPassages, err
+		// a passage with backends or fallbacks at a rebuilt server holds the
+		// old connection
+		force := rebuilt[server]
+		for _, b := range p.Backends {
+			force = force || rebuilt[b.Server]
+		}
+
+		for _, f := range p.Fallbacks {
+			force = force || rebuilt[f]
+		}
+
+		if err := s.loadPassage(server, config, name, p, force); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// passageConnection returns the connection to the server of the passage, with
+// failover to the fallback servers if any
+func (s *Server) passageConnection(server string, config *PassageConfig) core.SSHConnection {
+	if len(config.Fallbacks) == 0 {
+		return s.servers[server]
+	}
+
+	conns := []core.SSHConnection{s.servers[server]}
+	for _, f := range config.Fallbacks {
+		conns = append(conns, s.servers[f])
+	}
+
+	return core.NewFailoverConnection(config.FailbackInterval, conns...)
+}
+
+// passageServers returns the server of the passage followed by its fallbacks
+func (s *Server) passageServers(passage string) []string {
+	if s.c == nil {
+		return nil
+	}
+
+	for _, name := range sortedKeys(s.c.Servers) {
+		if p, ok := s.c.Servers[name].Passages[passage]; ok {
+			return append([]string{name}, p.Fallbacks...)
+		}
+	}
+
+	return nil
+}
+
+// passageConfig returns the config of the passage, nil if not found
+func (s *Server) passageConfig(passage string) *PassageConfig {
+	if s.c == nil {
+		return nil
+	}
+
+	for _, name := range sortedKeys(s.c.Servers) {
+		if p, ok := s.c.Servers[name].Passages[passage]; ok {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// passagePath returns the servers of the passage and the one in use
+func (s *Server) passagePath(passage string) (PassagePath, error) {
+	p, ok := s.passages[passage]
+	if !ok {
+		return PassagePath{}, fmt.Errorf("unable to find a passage with name %q", passage)
+	}
+
+	servers := s.passageServers(passage)
+	if len(servers) == 0 {
+		return PassagePath{}, fmt.Errorf("unable to find the servers of passage %q", passage)
+	}
+
+	active := 0
+	if f, ok := p.Conn().(*core.FailoverConnection); ok {
+		active = f.Active()
+	}
+
+	return PassagePath{Servers: servers, Active: servers[active]}, nil
+}
+
+// passageNames returns the names of the running passages, sorted
+func (s *Server) passageNames() []string {
+	var names []string
+	for name := range s.passages {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func (s *Server) passageInfo(name string) PassageInfo {
+	p := s.passages[name]
+	info := PassageInfo{
+		Name:   name,
+		Local:  p.Addr(),
+		Remote: p.Remote(),
+		State:  PassageStateUp,
+	}
+
+	if servers := s.passageServers(name); len(servers) != 0 {
+		info.Server = servers[0]
+	}
+
+	if config := s.passageConfig(name); config != nil {
+		info.Type = config.Type
+	}
+
+	info.Ephemeral, info.Expires = s.isEphemeral(name)
+
+	if info.Local == "<nil>" {
+		info.State = PassageStatePending
+	}
+
+	if err := p.Err(); err != nil {
+		info.State = PassageStateDown
+		info.Error = err.Error()
+	}
+
+	return info
+}
+
+// serverInfos returns the given SSH servers, or all of them if empty, sorted
+// by name
+func (s *Server) serverInfos(names []string) []ServerInfo {
+	infos := []ServerInfo{}
+	if s.c == nil {
+		return infos
+	}
+
+	owned := make(map[string][]string)
+	for _, name := range s.passageNames() {
+		if servers := s.passageServers(name); len(servers) != 0 {
+			owned[servers[0]] = append(owned[servers[0]], name)
+		}
+	}
+
+	for _, name := range sortedKeys(s.c.Servers) {
+		conn, ok := s.servers[name]
+		if !ok || (len(names) != 0 && !contains(names, name)) {
+			continue
+		}
+
+		config := s.c.Servers[name]
+		info := ServerInfo{
+			Name:     name,
+			Address:  config.Address,
+			User:     config.User,
+			Via:      config.Via,
+			Mode:     config.Mode,
+			State:    ServerStateDisconnected,
+			Passages: owned[name],
+		}
+
+		stats := s.connectionStats(name)
+		switch {
+		case stats.Connected:
+			info.State = ServerStateConnected
+			info.Connected = true
+			info.Uptime = time.Since(stats.ConnectedSince)
+		case stats.Connecting:
+			info.State = ServerStateConnecting
+		}
+
+		if err := conn.Err(); err != nil {
+			info.LastError = err.Error()
 		}
 
-		loadedPassages = append(loadedPassages, name)
+		infos = append(infos, info)
 	}
 
-	return loadedPassages, nil
+	return infos
+}
+
+// connectionStats returns the metrics of the connection to the server
+func (s *Server) connectionStats(server string) core.ConnectionStats {
+	if c, ok := s.servers[server].(interface {
+		Stats() core.ConnectionStats
+	}); ok {
+		return c.Stats()
+	}
 
+	return core.ConnectionStats{}
 }
 
 func (s *Server) loadPassage(
-	c core.SSHConnection, sc *SSHServerConfig, name string, config *PassageConfig,
+	server string, sc *SSHServerConfig, name string, config *PassageConfig, force bool,
 ) error {
-	r, err := s.buildRemote(config)
-	if err != nil {
-		return err
+	// the unchanged passages are kept, without building anything
+	if !s.f.IsNewPassage(name, sc, config) && !force {
+		return nil
 	}
 
-	a, err := net.ResolveTCPAddr("tcp", config.Local)
+	p, a, err := s.preparePassage(server, sc, name, config)
 	if err != nil {
+		// forgotten, so the next load tries again
+		delete(s.f, name)
 		return err
 	}
 
-	if !s.f.IsNewPassage(name, sc, config) {
-		return nil
-	}
-
-	if _, ok := s.passages[name]; ok {
-		if err := s.passages[name].Close(); err != nil {
+	// the metrics survive the rebuilds of the passage
+	if old, ok := s.passages[name]; ok {
+		p.Metrics = old.Metrics
+		if err := s.removePassage(name); err != nil {
 			return err
 		}
 	}
 
-	s.passages[name] = core.NewPassage(c, r)
-	if err := s.passages[name].Start(a); err != nil {
+	s.passages[name] = p
+	if err := p.Start(a); err != nil {
 		return err
 	}
 
-	log15.Info(
-		"new passage created",
-		"name", name, "ssh", c, "remote", r, "addr", s.passages[name].Addr(),
-	)
+	log15.Info("new passage created", "name", name, "passage", p, "addr", p.Addr())
 
 	return nil
 }
 
-func (s *Server) buildRemote(config *PassageConfig) (core.Remote, error) {
+// preparePassage builds the passage and its listen address, the address and
+// the socket options are checked first, so nothing is left to close if they fail
+func (s *Server) preparePassage(
+	server string, sc *SSHServerConfig, name string, config *PassageConfig,
+) (*core.Passage, net.Addr, error) {
+	a, err := resolveListenAddress(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var socket *core.SocketOptions
+	if config.IsUnix() {
+		if socket, err = buildSocketOptions(config); err != nil {
+			return nil, nil, fmt.Errorf("passage %q: %s", name, err)
+		}
+	}
+
+	c := s.passageConnection(server, config)
+	p, err := s.buildPassage(c, sc, config)
+	if err != nil {
+		if f, ok := c.(*core.FailoverConnection); ok {
+			f.Close()
+		}
+
+		return nil, nil, err
+	}
+
+	p.Socket = socket
+	return p, a, nil
+}
+
+func resolveListenAddress(config *PassageConfig) (net.Addr, error) {
+	switch {
+	case config.Type == "reverse":
+		// the address is bound at the SSH server, so it's resolved there
+		return core.NewUnresolvedAddr("tcp", config.ListenAddress()), nil
+	case config.Type == "udp":
+		return net.ResolveUDPAddr("udp", config.ListenAddress())
+	case config.IsUnix():
+		return net.ResolveUnixAddr("unix", config.ListenAddress())
+	}
+
+	return net.ResolveTCPAddr("tcp", config.ListenAddress())
+}
+
+// an absolute path is a unix socket
+func addressNetwork(address string) string {
+	if filepath.IsAbs(address) {
+		return "unix"
+	}
+
+	return "tcp"
+}
+
+func (s *Server) buildPassage(
+	c core.SSHConnection, sc *SSHServerConfig, config *PassageConfig,
+) (*core.Passage, error) {
+	switch config.Type {
+	case "socks", "http-proxy":
+		f, err := core.NewDestinationFilter(config.Allow, config.Deny)
+		if err != nil {
+			return nil, err
+		}
+
+		if config.Type == "socks" {
+			return core.NewProxyPassage(c, core.NewSOCKSProxy(config.Users, f)), nil
+		}
+
+		return core.NewProxyPassage(c, core.NewHTTPProxy(config.Users, f)), nil
+	}
+
+	if len(config.Backends) != 0 {
+		return s.buildBalancedPassage(c, config), nil
+	}
+
+	r, err := s.buildRemote(sc, config)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Type {
+	case "reverse":
+		return core.NewReversePassage(c, r), nil
+	case "udp":
+		return core.NewUDPPassage(c, r, config.IdleTimeout), nil
+	}
+
+	return core.NewPassage(c, r), nil
+}
+
+func (s *Server) buildBalancedPassage(c core.SSHConnection, config *PassageConfig) *core.Passage {
+	var backends []core.Backend
+	for _, b := range config.Backends {
+		conn := c
+		if b.Server != "" {
+			conn = s.servers[b.Server]
+		}
+
+		backends = append(backends, core.Backend{
+			Conn:   conn,
+			Remote: core.NewRemote(addressNetwork(b.Address), b.Address),
+		})
+	}
+
+	b := core.NewBalancer(config.Policy, config.HealthCheckInterval, backends...)
+	return core.NewBalancedPassage(b)
+}
+
+func (s *Server) buildRemote(sc *SSHServerConfig, config *PassageConfig) (core.Remote, error) {
 	switch config.Type {
-	case "tcp":
-		return core.NewRemote("tcp", config.Address), nil
+	case "tcp", "udp":
+		return core.NewRemote(addressNetwork(config.Address), config.Address), nil
+	case "reverse":
+		return core.NewRemote(addressNetwork(config.Local), config.Local), nil
 	case "container":
-		return core.NewContainerRemote("tcp", config.Container, config.Port), nil
+		e, err := buildDockerEndpoint(&sc.Docker)
+		if err != nil {
+			return nil, err
+		}
+
+		selector, err := config.ContainerSelector()
+		if err != nil {
+			return nil, err
+		}
+
+		return core.NewContainerRemoteWithSelector("tcp", selector, config.Port, e), nil
+	case "kubernetes":
+		e, namespace, err := buildKubernetesEndpoint(&sc.Kubernetes)
+		if err != nil {
+			return nil, err
+		}
+
+		return core.NewKubernetesRemote(config.KubernetesSelector(namespace), config.Port, e), nil
 	}
 
 	return nil, fmt.Errorf("invalid remote type: %q", config.Type)
 }
 
+func buildSocketOptions(config *PassageConfig) (*core.SocketOptions, error) {
+	o := &core.SocketOptions{UID: -1, GID: -1}
+	if config.SocketMode != "" {
+		mode, err := strconv.ParseUint(config.SocketMode, 8, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		o.Mode = os.FileMode(mode)
+	}
+
+	var err error
+	if config.SocketOwner != "" {
+		if o.UID, err = lookupID(config.SocketOwner, lookupUID); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.SocketGroup != "" {
+		if o.GID, err = lookupID(config.SocketGroup, lookupGID); err != nil {
+			return nil, err
+		}
+	}
+
+	return o, nil
+}
+
+// lookupID returns the numeric id of a user or group given its name or id
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+
+	return strconv.Atoi(id)
+}
+
+func lookupUID(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+
+	return u.Uid, nil
+}
+
+func lookupGID(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+
+	return g.Gid, nil
+}
+
 func (s *Server) cleanServers(loadedServers []string) {
-	for k := range s.servers {
+	for k, c := range s.servers {
 		if !contains(loadedServers, k) {
+			closeConnection(c)
 			delete(s.servers, k)
 		}
 	}
 }
 
-func (s *Server) cleanPassages(loadedPassages []string) {
+func (s *Server) cleanPassages(loadedPassages []string) error {
 	var removed []string
 	for k := range s.passages {
-		if !contains(loadedPassages, k) {
-			delete(s.passages, k)
-			removed = append(removed, k)
+		if contains(loadedPassages, k) {
+			continue
 		}
+
+		if err := s.removePassage(k); err != nil {
+			return err
+		}
+
+		delete(s.f, k)
+		removed = append(removed, k)
 	}
 
 	if len(removed) == 0 {
-		return
+		return nil
 	}
 
 	log15.Debug("removed passages", "names", removed)
+	return nil
+}
+
+// removePassage stops accepting connections in the passage, the active tunnels
+// are drained in background
+func (s *Server) removePassage(name string) error {
+	p := s.passages[name]
+	delete(s.passages, name)
+
+	if err := p.Close(); err != nil {
+		return err
+	}
+
+	go drainPassage(name, p, s.drainTimeout)
+	return nil
 }
 
+func drainPassage(name string, p *core.Passage, timeout time.Duration) int {
+	cut, err := p.Drain(timeout)
+	if err != nil {
+		log15.Error("error draining passage", "name", name, "error", err)
+	}
+
+	if cut != 0 {
+		log15.Warn("passage drained, active tunnels cut", "name", name, "cut", cut)
+	}
+
+	return cut
+}
+
+// Close closes all the passages, waiting for the active tunnels to finish
+// during the drain timeout. The passages are drained without holding the lock,
+// so the RPC and metrics servers keep answering meanwhile.
 func (s *Server) Close() error {
-	for _, p := range s.passages {
+	s.m.Lock()
+	for _, e := range s.ephemeral {
+		if e.timer != nil {
+			e.timer.Stop()
+		}
+	}
+
+	passages := make(map[string]*core.Passage, len(s.passages))
+	for name, p := range s.passages {
+		passages[name] = p
+	}
+
+	servers := make([]core.SSHConnection, 0, len(s.servers))
+	for _, c := range s.servers {
+		servers = append(servers, c)
+	}
+
+	timeout := s.drainTimeout
+	s.m.Unlock()
+
+	for _, p := range passages {
 		if err := p.Close(); err != nil {
 			return err
 		}
 	}
 
+	var wg sync.WaitGroup
+	var cut int32
+	for name, p := range passages {
+		wg.Add(1)
+		go func(name string, p *core.Passage) {
+			defer wg.Done()
+			atomic.AddInt32(&cut, int32(drainPassage(name, p, timeout)))
+		}(name, p)
+	}
+
+	wg.Wait()
+	for _, c := range servers {
+		closeConnection(c)
+	}
+
+	log15.Info("passages closed", "tunnels_cut", cut)
 	return nil
 }
 
 func (s *Server) String() string {
+	s.m.RLock()
+	defer s.m.RUnlock()
+
 	var out []string
 	for _, p := range s.passages {
 		out = append(out, p.String())
@@ -213,7 +795,16 @@ func (fp *fingerprints) IsNewSSHServer(id string, c *SSHServerConfig) bool {
 }
 
 func (fp *fingerprints) fpSSHServer(c *SSHServerConfig) [20]byte {
-	payload := fmt.Sprintf("%s,%d,%s,%s", c.Address, c.Retries, c.Timeout, c.User)
+	payload := fmt.Sprintf("%s,%d,%s,%s,%s", c.Address, c.Retries, c.Timeout, c.User, c.Via)
+	for _, a := range c.Auth {
+		payload += fmt.Sprintf(",%v", *a)
+	}
+
+	payload += fmt.Sprintf(",%v,%v,%s", c.KnownHosts, c.HostKey, c.StrictHostKeyChecking)
+	payload += fmt.Sprintf(",%s,%d,%v", c.KeepAliveInterval, c.KeepAliveMaxMissed, c.Backoff)
+	payload += fmt.Sprintf(",%v,%v", c.Docker, c.Kubernetes)
+	payload += fmt.Sprintf(",%s,%s", c.Mode, c.IdleTimeout)
+
 	return sha1.Sum([]byte(payload))
 }
 
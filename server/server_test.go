@@ -1,6 +1,15 @@
 package server
 
-import . "gopkg.in/check.v1"
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mcuadros/passage/core"
+
+	. "gopkg.in/check.v1"
+)
 
 type ServerSuite struct{}
 
@@ -42,6 +51,35 @@ func (s *ServerSuite) TestLoadChangeServer(c *C) {
 	c.Assert(server.passages, HasLen, 3)
 }
 
+func (s *ServerSuite) TestLoadEager(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Address = closedAddr(c)
+	config.Servers["baz"].Mode = "eager"
+	config.Servers["baz"].Backoff = BackoffConfig{InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	// the server is dialed at load time, and again on failure
+	waitDialErrors(c, server, "baz", 2)
+	eager := server.servers["baz"].(interface {
+		Stats() core.ConnectionStats
+	})
+
+	// the replaced connection stops reconnecting
+	config.Servers["baz"].Mode = "lazy"
+	err = server.Load(config)
+	c.Assert(err, IsNil)
+
+	time.Sleep(50 * time.Millisecond)
+	errs := eager.Stats().DialErrors
+	time.Sleep(100 * time.Millisecond)
+	c.Assert(eager.Stats().DialErrors, Equals, errs)
+	c.Assert(server.connectionStats("baz").DialErrors, Equals, uint64(0))
+}
+
 func (s *ServerSuite) TestLoadChangePassage(c *C) {
 	config := getConfigFixture()
 
@@ -52,12 +90,15 @@ func (s *ServerSuite) TestLoadChangePassage(c *C) {
 
 	c.Assert(server.servers, HasLen, 1)
 	c.Assert(server.passages, HasLen, 3)
+	metrics := server.passages["foo"].Metrics
 
 	config.Servers["baz"].Passages["foo"].Type = "container"
+	config.Servers["baz"].Passages["foo"].Container = "foo"
 	err = server.Load(config)
 	c.Assert(err, IsNil)
 	c.Assert(server.servers, HasLen, 1)
 	c.Assert(server.passages, HasLen, 3)
+	c.Assert(server.passages["foo"].Metrics, Equals, metrics)
 }
 
 func (s *ServerSuite) TestLoadNoChange(c *C) {
@@ -77,6 +118,298 @@ func (s *ServerSuite) TestLoadNoChange(c *C) {
 	c.Assert(server.passages, HasLen, 3)
 }
 
+func (s *ServerSuite) TestLoadPassageErrorRetried(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Passages["bar"].Local = "unknown.invalid:8080"
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, ErrorMatches, ".*unknown.invalid.*")
+	defer server.Close()
+
+	// the failed passage is not taken as loaded
+	err = server.Load(config)
+	c.Assert(err, ErrorMatches, ".*unknown.invalid.*")
+
+	config.Servers["baz"].Passages["bar"].Local = "127.0.0.1:0"
+	err = server.Load(config)
+	c.Assert(err, IsNil)
+	c.Assert(server.passages, HasLen, 3)
+}
+
+func (s *ServerSuite) TestLoadSOCKS(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Passages["socks"] = &PassageConfig{Type: "socks"}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	c.Assert(server.passages, HasLen, 4)
+	c.Assert(server.passages["socks"].String(), Equals, "(root@127.0.0.1:22)-[socks]")
+}
+
+func (s *ServerSuite) TestLoadHTTPProxy(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Passages["proxy"] = &PassageConfig{Type: "http-proxy"}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	c.Assert(server.passages, HasLen, 4)
+	c.Assert(server.passages["proxy"].String(), Equals, "(root@127.0.0.1:22)-[http-proxy]")
+}
+
+func (s *ServerSuite) TestLoadBalanced(c *C) {
+	config := getConfigFixture()
+	config.Servers["qux"] = &SSHServerConfig{User: "root", Address: "127.0.0.2:22", Passages: map[string]*PassageConfig{
+		"web": {Policy: "least-conn", Backends: []BackendConfig{
+			{Address: "10.0.0.1:80"},
+			{Server: "baz", Address: "10.0.0.2:80"},
+		}},
+	}}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	c.Assert(server.passages, HasLen, 4)
+	c.Assert(server.passages["web"].String(), Equals,
+		"<least-conn>{(root@127.0.0.2:22)-[10.0.0.1:80/tcp], (root@127.0.0.1:22)-[10.0.0.2:80/tcp]}",
+	)
+
+	web := server.passages["web"]
+	config.Servers["baz"].Retries = 2
+	err = server.Load(config)
+	c.Assert(err, IsNil)
+	c.Assert(server.passages["web"] == web, Equals, false)
+}
+
+func (s *ServerSuite) TestLoadFallbacks(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Passages["foo"].Fallbacks = []string{"qux"}
+	config.Servers["qux"] = &SSHServerConfig{User: "root", Address: "127.0.0.2:22"}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	c.Assert(server.passages, HasLen, 3)
+	f, ok := server.passages["foo"].Conn().(*core.FailoverConnection)
+	c.Assert(ok, Equals, true)
+	c.Assert(f.ActiveConn(), Equals, server.servers["baz"])
+
+	foo := server.passages["foo"]
+	config.Servers["qux"].Retries = 2
+	err = server.Load(config)
+	c.Assert(err, IsNil)
+	c.Assert(server.passages["foo"] == foo, Equals, false)
+}
+
+func (s *ServerSuite) TestLoadUDP(c *C) {
+	config := getConfigFixture()
+	config.Servers["baz"].Passages["dns"] = &PassageConfig{Type: "udp", Address: "10.0.0.2:53"}
+	config.Servers["baz"].Passages["statsd"] = &PassageConfig{Type: "udp", Address: "/run/statsd.sock"}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	c.Assert(server.passages, HasLen, 5)
+	c.Assert(server.passages["dns"].String(), Equals, "(root@127.0.0.1:22)-[10.0.0.2:53/tcp]")
+	c.Assert(server.passages["statsd"].String(), Equals, "(root@127.0.0.1:22)-[/run/statsd.sock/unix]")
+
+	conn, err := net.Dial("udp", server.passages["dns"].Addr())
+	c.Assert(err, IsNil)
+	conn.Close()
+}
+
+func (s *ServerSuite) TestLoadUnix(c *C) {
+	path := filepath.Join(c.MkDir(), "docker.sock")
+
+	config := getConfigFixture()
+	config.Servers["baz"].Passages["docker"] = &PassageConfig{
+		Address:    "/var/run/docker.sock",
+		Local:      path,
+		SocketMode: "0660",
+	}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	c.Assert(server.passages["docker"].String(), Equals, "(root@127.0.0.1:22)-[/var/run/docker.sock/unix]")
+	c.Assert(server.passages["docker"].Addr(), Equals, path)
+
+	fi, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(fi.Mode().Perm(), Equals, os.FileMode(0660))
+}
+
+func (s *ServerSuite) TestResolveListenAddressReverse(c *C) {
+	a, err := resolveListenAddress(&PassageConfig{Type: "reverse", Address: "bastion.invalid:8080"})
+	c.Assert(err, IsNil)
+	c.Assert(a.Network(), Equals, "tcp")
+	c.Assert(a.String(), Equals, "bastion.invalid:8080")
+}
+
+func (s *ServerSuite) TestBuildSocketOptions(c *C) {
+	o, err := buildSocketOptions(&PassageConfig{SocketMode: "0600", SocketOwner: "root", SocketGroup: "42"})
+	c.Assert(err, IsNil)
+	c.Assert(*o, Equals, core.SocketOptions{Mode: 0600, UID: 0, GID: 42})
+
+	_, err = buildSocketOptions(&PassageConfig{SocketOwner: "nonexistent-passage-user"})
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestBuildDockerEndpoint(c *C) {
+	e, err := buildDockerEndpoint(&DockerConfig{Endpoint: "tcp://localhost:2375", APIVersion: "1.24"})
+	c.Assert(err, IsNil)
+	c.Assert(e.Address, Equals, "tcp://localhost:2375")
+	c.Assert(e.APIVersion, Equals, "1.24")
+	c.Assert(e.TLS, IsNil)
+
+	e, err = buildDockerEndpoint(&DockerConfig{CacheTTL: -1, WatchEvents: true})
+	c.Assert(err, IsNil)
+	c.Assert(e.CacheTTL, Equals, time.Duration(0))
+	c.Assert(e.WatchEvents, Equals, true)
+
+	_, err = buildDockerEndpoint(&DockerConfig{
+		Endpoint: "tcp://localhost:2376", TLSCert: "/nonexistent/cert.pem", TLSKey: "/nonexistent/key.pem",
+	})
+	c.Assert(err, ErrorMatches, "error loading docker tls certificate: .*")
+}
+
+func (s *ServerSuite) TestLoadVia(c *C) {
+	config := getConfigFixture()
+	config.Servers["bastion"] = &SSHServerConfig{User: "root", Address: "localhost:22"}
+	config.Servers["baz"].Via = "bastion"
+	config.Servers["baz"].Address = "foo:22"
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	c.Assert(server.servers, HasLen, 2)
+	c.Assert(server.servers["baz"].String(), Equals, "root@foo:22 via root@127.0.0.1:22")
+
+	baz := server.servers["baz"]
+	foo := server.passages["foo"]
+
+	config.Servers["bastion"].User = "qux"
+	err = server.Load(config)
+	c.Assert(err, IsNil)
+	c.Assert(server.servers["baz"] == baz, Equals, false)
+	c.Assert(server.servers["baz"].String(), Equals, "root@foo:22 via qux@127.0.0.1:22")
+	c.Assert(server.passages["foo"] == foo, Equals, false)
+}
+
+func (s *ServerSuite) TestLoadRemovePassage(c *C) {
+	config := getConfigFixture()
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	defer server.Close()
+
+	foo := config.Servers["baz"].Passages["foo"]
+	delete(config.Servers["baz"].Passages, "foo")
+
+	err = server.Load(config)
+	c.Assert(err, IsNil)
+	c.Assert(server.passages, HasLen, 2)
+
+	_, err = net.Dial("tcp", "127.0.0.1:8400")
+	c.Assert(err, NotNil)
+
+	config.Servers["baz"].Passages["foo"] = foo
+	err = server.Load(config)
+	c.Assert(err, IsNil)
+	c.Assert(server.passages, HasLen, 3)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8400")
+	c.Assert(err, IsNil)
+	conn.Close()
+}
+
+func (s *ServerSuite) TestCloseDrainUnlocked(c *C) {
+	config := getConfigFixture()
+	config.DrainTimeout = 500 * time.Millisecond
+	config.Servers["baz"].Address = closedAddr(c)
+	config.Servers["baz"].Retries = 10
+	config.Servers["baz"].Backoff = BackoffConfig{InitialDelay: time.Minute, MaxDelay: time.Hour}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8400")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	waitActiveConnections(c, server, "foo", 1)
+
+	closed := make(chan error)
+	go func() { closed <- server.Close() }()
+
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	c.Assert(server.Reloads().Successes, Equals, uint64(1))
+	c.Assert(time.Since(start) < 100*time.Millisecond, Equals, true)
+
+	select {
+	case err := <-closed:
+		c.Assert(err, IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("server not closed")
+	}
+}
+
+func (s *ServerSuite) TestCloseNoDrain(c *C) {
+	config := getConfigFixture()
+	config.DrainTimeout = -1
+	config.Servers["baz"].Address = closedAddr(c)
+	config.Servers["baz"].Retries = 10
+	config.Servers["baz"].Backoff = BackoffConfig{InitialDelay: time.Minute, MaxDelay: time.Hour}
+
+	server := NewServer()
+	err := server.Load(config)
+	c.Assert(err, IsNil)
+	c.Assert(server.drainTimeout, Equals, time.Duration(-1))
+
+	conn, err := net.Dial("tcp", "127.0.0.1:8400")
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	waitActiveConnections(c, server, "foo", 1)
+
+	start := time.Now()
+	c.Assert(server.Close(), IsNil)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+func waitActiveConnections(c *C, server *Server, name string, n int64) {
+	for i := 0; i < 300 && server.passages[name].Stats().ActiveConnections < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(server.passages[name].Stats().ActiveConnections >= n, Equals, true)
+}
+
+func waitDialErrors(c *C, server *Server, name string, n uint64) {
+	for i := 0; i < 300 && server.connectionStats(name).DialErrors < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	c.Assert(server.connectionStats(name).DialErrors >= n, Equals, true)
+}
+
 func getConfigFixture() *Config {
 	return &Config{
 		Servers: map[string]*SSHServerConfig{